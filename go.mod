@@ -2,7 +2,12 @@ module github.com/larkin1/wmsproject
 
 go 1.21
 
-require fyne.io/fyne/v2 v2.7.2
+require (
+	fyne.io/fyne/v2 v2.7.2
+	github.com/google/uuid v1.6.0
+	go.etcd.io/bbolt v1.3.10
+	golang.org/x/crypto v0.33.0
+)
 
 require (
 	fyne.io/systray v1.12.0 // indirect
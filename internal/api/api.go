@@ -2,330 +2,335 @@ package api
 
 import (
 	"bytes"
-	"encoding/csv"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/larkin1/wmsproject/internal/storage"
 )
 
+// Client is the Backend for a Supabase/PostgREST project.
 type Client struct {
-	BaseURL  string
-	APIKey   string
-	Client   *http.Client
-	BasePath string
+	BaseURL   string
+	APIKey    string
+	Client    *http.Client
+	BatchSize int // commits per request in SendCommits
+
+	cache
+	authMu  sync.Mutex
+	session *AuthSession // see auth.go
 }
 
+// DefaultBatchSize keeps each bulk insert well under PostgREST's request size
+// limits while still clearing a shift's backlog in a handful of requests.
+const DefaultBatchSize = 200
+
+// CommitPayload is the row written to the commits table. UUID is generated on
+// the device and is unique server-side, so resending a commit is a no-op.
 type CommitPayload struct {
-	DeviceID string `json:"device_id"`
-	Location string `json:"location"`
-	Delta    int    `json:"delta"`
-	ItemID   int    `json:"item_id"`
+	UUID       string    `json:"uuid"`
+	CapturedAt time.Time `json:"captured_at"`
+	DeviceID   string    `json:"device_id"`
+	OperatorID int       `json:"operator_id,omitempty"`
+	Location   string    `json:"location"`
+	Delta      int       `json:"delta"`
+	ItemID     int       `json:"item_id"`
+	Overrides  []string  `json:"overrides,omitempty"`
+	// SupervisorID is the supervisor who approved an override, if one had to.
+	SupervisorID int `json:"supervisor_id,omitempty"`
+	// TransferID links the two legs of a stock transfer; see SendTransfer.
+	TransferID string `json:"transfer_id,omitempty"`
+	// Kind tags commits that aren't plain movements, such as count
+	// adjustments, which also carry the quantity counted and the count task
+	// if there was one. The server rejects a count whose counted_qty - delta
+	// no longer matches its total.
+	Kind        string `json:"kind,omitempty"`
+	CountedQty  *int   `json:"counted_qty,omitempty"`
+	CountTaskID int    `json:"count_task_id,omitempty"`
+	// VoidOf is the UUID of the commit a void reverses, with the reason.
+	VoidOf     string `json:"void_of,omitempty"`
+	VoidReason string `json:"void_reason,omitempty"`
+	// DocumentID is the document the commit is a line of; see SendDocument.
+	DocumentID string `json:"document_id,omitempty"`
+	// ReceiptRef is the reference of the expected receipt the commit
+	// received stock against; see receipts.go.
+	ReceiptRef string `json:"receipt_ref,omitempty"`
 }
 
-type Item struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
+// DocumentPayload is a header with lines that the server stores all or
+// nothing. Resending a document it already has is a no-op.
+type DocumentPayload struct {
+	UUID       string          `json:"uuid"`
+	CapturedAt time.Time       `json:"captured_at"`
+	DeviceID   string          `json:"device_id"`
+	OperatorID int             `json:"operator_id,omitempty"`
+	Reason     string          `json:"reason,omitempty"`
+	Reference  string          `json:"reference,omitempty"`
+	Lines      []CommitPayload `json:"lines"`
 }
 
-type Location struct {
-	LocationName string `json:"location"`
-	Items        []int  `json:"items"`
+// AssignmentPayload adds an item to a location, creating the location if it
+// doesn't exist. Like commits, assignments carry a device-generated UUID so
+// resending one is a no-op, and the server merges assignments from different
+// devices into one location instead of creating it twice.
+type AssignmentPayload struct {
+	UUID       string    `json:"uuid"`
+	CapturedAt time.Time `json:"captured_at"`
+	DeviceID   string    `json:"device_id"`
+	OperatorID int       `json:"operator_id,omitempty"`
+	Location   string    `json:"location"`
+	ItemID     int       `json:"item_id"`
 }
 
-// CachedItems wraps items with metadata
-type CachedItems struct {
-	Timestamp int64  `json:"timestamp"`
-	Items     []Item `json:"items"`
+// Item and Location carry updated_at and deleted_at for catalog sync;
+// a row with DeletedAt set is a tombstone. Barcodes holds the codes printed
+// on the item (GTIN/UPC/EAN or internal labels).
+type Item struct {
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	Barcodes  []string   `json:"barcodes,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
-// CachedLocations wraps locations with metadata
-type CachedLocations struct {
-	Timestamp int64       `json:"timestamp"`
-	Locations []Location  `json:"locations"`
+type Location struct {
+	LocationName string     `json:"location"`
+	Items        []int      `json:"items"`
+	UpdatedAt    *time.Time `json:"updated_at,omitempty"`
+	DeletedAt    *time.Time `json:"deleted_at,omitempty"`
 }
 
-func NewClient(baseURL, apiKey, basePath string) *Client {
-	return &Client{
-		BaseURL:  strings.TrimSuffix(baseURL, "/"),
-		APIKey:   apiKey,
-		BasePath: basePath,
+// NewClient creates a client for a Supabase/PostgREST project. apiKey is the
+// project's anon key; a signed-in user's session saved by an earlier run is
+// restored from db, which also holds the offline cache.
+func NewClient(baseURL, apiKey string, db *storage.DB) *Client {
+	c := &Client{
+		cache:     cache{db: db},
+		BaseURL:   strings.TrimSuffix(baseURL, "/"),
+		APIKey:    apiKey,
+		BatchSize: DefaultBatchSize,
 		Client: &http.Client{
 			Timeout: 10 * time.Second,
 		},
 	}
+	c.importLegacy()
+	c.loadSession()
+	return c
 }
 
-func (c *Client) getCacheFilePath(filename string) string {
-	return filepath.Join(c.BasePath, filename)
-}
-
-func (c *Client) saveItemsCache(items []Item) error {
-	cached := CachedItems{
-		Timestamp: time.Now().Unix(),
-		Items:     items,
+func (c *Client) Check(ctx context.Context) bool {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/rest/v1/items?select=*&limit=1", nil)
+	if err != nil {
+		return false
 	}
 
-	data, err := json.MarshalIndent(cached, "", "  ")
+	resp, err := c.do(req)
 	if err != nil {
-		return err
+		return false
 	}
+	defer resp.Body.Close()
 
-	cachePath := c.getCacheFilePath("items.cache.json")
-	log.Printf("[API] Saving items cache to: %s\n", cachePath)
-	return os.WriteFile(cachePath, data, 0644)
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
 }
 
-func (c *Client) loadItemsCache() ([]Item, error) {
-	cachePath := c.getCacheFilePath("items.cache.json")
-	data, err := os.ReadFile(cachePath)
+// Reachable reports whether the API host answers at all. Unlike Check it
+// doesn't require valid credentials: any HTTP response below 500 from the
+// PostgREST root means the server can be reached and commits can be tried.
+// It sends only the apikey, so probing never refreshes the session.
+func (c *Client) Reachable(ctx context.Context) bool {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/rest/v1/", nil)
 	if err != nil {
-		log.Printf("[API] Items cache not found: %v\n", err)
-		return nil, err
+		return false
 	}
+	req.Header.Set("apikey", c.APIKey)
 
-	var cached CachedItems
-	err = json.Unmarshal(data, &cached)
+	probe := &http.Client{
+		Timeout:   3 * time.Second,
+		Transport: c.Client.Transport,
+	}
+	resp, err := probe.Do(req)
 	if err != nil {
-		log.Printf("[API] Failed to parse items cache: %v\n", err)
-		return nil, err
+		log.Printf("[API] Reachability probe failed: %v\n", err)
+		return false
 	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
 
-	log.Printf("[API] Loaded items cache from %s (%d items, cached at %d)\n", cachePath, len(cached.Items), cached.Timestamp)
-	return cached.Items, nil
+	return resp.StatusCode < 500
 }
 
-func (c *Client) saveLocationsCache(locations []Location) error {
-	cached := CachedLocations{
-		Timestamp: time.Now().Unix(),
-		Locations: locations,
-	}
+// SendCommits bulk-inserts payloads, BatchSize rows per request. Duplicates of
+// rows already on the server are ignored.
+func (c *Client) SendCommits(ctx context.Context, payloads []CommitPayload) []ChunkResult {
+	return sendInChunks(ctx, payloads, c.BatchSize, c.sendCommitChunk)
+}
 
-	data, err := json.MarshalIndent(cached, "", "  ")
+func (c *Client) sendCommitChunk(ctx context.Context, chunk []CommitPayload) error {
+	data, err := json.Marshal(chunk)
 	if err != nil {
 		return err
 	}
-
-	cachePath := c.getCacheFilePath("locations.cache.json")
-	log.Printf("[API] Saving locations cache to: %s\n", cachePath)
-	return os.WriteFile(cachePath, data, 0644)
-}
-
-func (c *Client) loadLocationsCache() ([]Location, error) {
-	cachePath := c.getCacheFilePath("locations.cache.json")
-	data, err := os.ReadFile(cachePath)
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+"/rest/v1/commits?on_conflict=uuid", bytes.NewBuffer(data))
 	if err != nil {
-		log.Printf("[API] Locations cache not found: %v\n", err)
-		return nil, err
+		return err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "resolution=ignore-duplicates,return=minimal")
 
-	var cached CachedLocations
-	err = json.Unmarshal(data, &cached)
+	resp, err := c.do(req)
 	if err != nil {
-		log.Printf("[API] Failed to parse locations cache: %v\n", err)
-		return nil, err
+		return err
 	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
 
-	log.Printf("[API] Loaded locations cache from %s (%d locations, cached at %d)\n", cachePath, len(cached.Locations), cached.Timestamp)
-	return cached.Locations, nil
+	if resp.StatusCode >= 400 {
+		return newAPIError(resp.StatusCode, body)
+	}
+	return nil
 }
 
-func (c *Client) Check() bool {
-	req, err := http.NewRequest("GET", c.BaseURL+"/rest/v1/items?select=*&limit=1", nil)
+// SendTransfer inserts the legs of a transfer through the apply_transfer
+// function, so they are stored together or not at all.
+func (c *Client) SendTransfer(ctx context.Context, legs []CommitPayload) error {
+	data, err := json.Marshal(map[string][]CommitPayload{"p_commits": legs})
 	if err != nil {
-		return false
+		return err
 	}
-
-	c.setAuthHeaders(req)
-	resp, err := c.Client.Do(req)
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+"/rest/v1/rpc/apply_transfer", bytes.NewBuffer(data))
 	if err != nil {
-		return false
-	}
-	defer resp.Body.Close()
-
-	return resp.StatusCode >= 200 && resp.StatusCode < 300
-}
-
-func (c *Client) SendCommit(deviceID, location string, delta, itemID int) (map[string]interface{}, error) {
-	payload := CommitPayload{
-		DeviceID: deviceID,
-		Location: location,
-		Delta:    delta,
-		ItemID:   itemID,
+		return err
 	}
-
-	data, _ := json.Marshal(payload)
-	req, _ := http.NewRequest("POST", c.BaseURL+"/rest/v1/commits", bytes.NewBuffer(data))
-	c.setAuthHeaders(req)
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Prefer", "return=representation")
 
-	resp, err := c.Client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer resp.Body.Close()
-
 	body, _ := io.ReadAll(resp.Body)
-	var result map[string]interface{}
-	json.Unmarshal(body, &result)
 
 	if resp.StatusCode >= 400 {
-		return nil, fmt.Errorf("API error: %d", resp.StatusCode)
+		return newAPIError(resp.StatusCode, body)
 	}
-
-	return result, nil
+	return nil
 }
 
-func (c *Client) FetchItems() ([]Item, error) {
-	log.Println("[API] FetchItems() called")
-	req, _ := http.NewRequest("GET", c.BaseURL+"/rest/v1/items?select=*", nil)
-	c.setAuthHeaders(req)
-
-	log.Printf("[API] Making request to: %s\n", c.BaseURL+"/rest/v1/items?select=*")
-	resp, err := c.Client.Do(req)
+// SendDocument stores a document and its lines through the apply_document
+// function, in one transaction.
+func (c *Client) SendDocument(ctx context.Context, doc DocumentPayload) error {
+	data, err := json.Marshal(map[string]DocumentPayload{"p_document": doc})
 	if err != nil {
-		log.Printf("[API] Request error: %v (trying cache)\n", err)
-		return c.loadItemsCache()
+		return err
 	}
-	defer resp.Body.Close()
-
-	log.Printf("[API] Response status: %d\n", resp.StatusCode)
-
-	body, _ := io.ReadAll(resp.Body)
-	log.Printf("[API] Response body: %s\n", string(body))
-
-	var items []Item
-	err = json.Unmarshal(body, &items)
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+"/rest/v1/rpc/apply_document", bytes.NewBuffer(data))
 	if err != nil {
-		log.Printf("[API] JSON unmarshal error: %v (trying cache)\n", err)
-		return c.loadItemsCache()
-	}
-
-	if resp.StatusCode >= 400 {
-		log.Printf("[API] HTTP error %d (trying cache)\n", resp.StatusCode)
-		return c.loadItemsCache()
-	}
-
-	// Success: save to cache
-	if len(items) > 0 {
-		c.saveItemsCache(items)
-	}
-
-	log.Printf("[API] Parsed %d items\n", len(items))
-	for i, item := range items {
-		log.Printf("[API] Item %d: ID=%d, Name=%s\n", i, item.ID, item.Name)
+		return err
 	}
+	req.Header.Set("Content-Type", "application/json")
 
-	return items, nil
-}
-
-func (c *Client) FetchLocations() ([]Location, error) {
-	log.Println("[API] FetchLocations() called")
-	req, _ := http.NewRequest("GET", c.BaseURL+"/rest/v1/locations?select=*", nil)
-	c.setAuthHeaders(req)
-
-	log.Printf("[API] Making request to: %s\n", c.BaseURL+"/rest/v1/locations?select=*")
-	resp, err := c.Client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		log.Printf("[API] Request error: %v (trying cache)\n", err)
-		return c.loadLocationsCache()
+		return err
 	}
 	defer resp.Body.Close()
-
-	log.Printf("[API] Response status: %d\n", resp.StatusCode)
-
 	body, _ := io.ReadAll(resp.Body)
-	log.Printf("[API] Response body: %s\n", string(body))
-
-	var locations []Location
-	err = json.Unmarshal(body, &locations)
-	if err != nil {
-		log.Printf("[API] JSON unmarshal error: %v (trying cache)\n", err)
-		return c.loadLocationsCache()
-	}
 
 	if resp.StatusCode >= 400 {
-		log.Printf("[API] HTTP error %d (trying cache)\n", resp.StatusCode)
-		return c.loadLocationsCache()
-	}
-
-	// Success: save to cache
-	if len(locations) > 0 {
-		c.saveLocationsCache(locations)
+		return newAPIError(resp.StatusCode, body)
 	}
-
-	log.Printf("[API] Parsed %d locations\n", len(locations))
-	for i, loc := range locations {
-		log.Printf("[API] Location %d: %s with %d items\n", i, loc.LocationName, len(loc.Items))
-	}
-
-	return locations, nil
+	return nil
 }
 
-func (c *Client) ExportItemsToCSV(filePath string) error {
-	log.Println("[API] ExportItemsToCSV() called")
-	items, err := c.FetchItems()
+// SendAssignments applies assignments through the assign_location_items
+// function, in one transaction.
+func (c *Client) SendAssignments(ctx context.Context, assignments []AssignmentPayload) error {
+	data, err := json.Marshal(map[string][]AssignmentPayload{"p_assignments": assignments})
 	if err != nil {
-		log.Printf("[API] FetchItems error: %v\n", err)
 		return err
 	}
-
-	log.Printf("[API] Exporting %d items to CSV\n", len(items))
-
-	file, err := os.Create(filePath)
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+"/rest/v1/rpc/assign_location_items", bytes.NewBuffer(data))
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	writer := csv.NewWriter(file)
-	writer.Write([]string{"id", "name"})
+	req.Header.Set("Content-Type", "application/json")
 
-	for _, item := range items {
-		writer.Write([]string{fmt.Sprintf("%d", item.ID), item.Name})
+	resp, err := c.do(req)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
 
-	writer.Flush()
-	log.Printf("[API] CSV export complete: %s\n", filePath)
+	if resp.StatusCode >= 400 {
+		return newAPIError(resp.StatusCode, body)
+	}
 	return nil
 }
 
-func (c *Client) ExportLocationsToCSV(filePath string) error {
-	log.Println("[API] ExportLocationsToCSV() called")
-	locations, err := c.FetchLocations()
+// SyncCatalog brings the cached items and locations up to date with the
+// changes since the last sync. See sync.go.
+func (c *Client) SyncCatalog(ctx context.Context) ([]SyncStats, error) {
+	return c.syncCatalog(ctx, c.fetchChanges)
+}
+
+// fetchChanges asks PostgREST for one page of table from cur on. Past the
+// first row at cur.Since, the (updated_at, key) pair is compared in an or
+// filter with its values quoted, since location names may hold commas.
+func (c *Client) fetchChanges(ctx context.Context, table string, cur cursor, limit int, etag string) (*changes, error) {
+	key := keyField(table)
+	q := url.Values{}
+	q.Set("select", "*")
+	q.Set("limit", strconv.Itoa(limit))
+	since := cur.Since.UTC().Format(time.RFC3339Nano)
+	switch {
+	case cur.Since.IsZero():
+		q.Set("order", key+".asc")
+		if cur.Key != "" {
+			q.Set(key, "gt."+cur.Key)
+		}
+	case cur.Key == "":
+		q.Set("order", "updated_at.asc,"+key+".asc")
+		q.Set("updated_at", "gte."+since)
+	default:
+		q.Set("order", "updated_at.asc,"+key+".asc")
+		q.Set("or", fmt.Sprintf("(updated_at.gt.%[1]s,and(updated_at.eq.%[1]s,%[2]s.gt.%[3]s))",
+			pgQuote(since), key, pgQuote(cur.Key)))
+	}
+	endpoint := c.BaseURL + "/rest/v1/" + table + "?" + q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
 	if err != nil {
-		log.Printf("[API] FetchLocations error: %v\n", err)
-		return err
+		return nil, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
 	}
 
-	log.Printf("[API] Exporting %d locations to CSV\n", len(locations))
-
-	file, err := os.Create(filePath)
+	resp, err := c.do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer file.Close()
-
-	writer := csv.NewWriter(file)
-	writer.Write([]string{"location", "items"})
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
 
-	for _, loc := range locations {
-		itemsStr := fmt.Sprintf("%v", loc.Items)
-		writer.Write([]string{loc.LocationName, itemsStr})
+	if resp.StatusCode == http.StatusNotModified {
+		return &changes{ETag: etag, NotModified: true}, nil
 	}
-
-	writer.Flush()
-	log.Printf("[API] CSV export complete: %s\n", filePath)
-	return nil
+	if resp.StatusCode >= 400 {
+		return nil, newAPIError(resp.StatusCode, body)
+	}
+	return &changes{Rows: body, ETag: resp.Header.Get("ETag")}, nil
 }
 
-func (c *Client) setAuthHeaders(req *http.Request) {
-	req.Header.Set("Authorization", "Bearer "+c.APIKey)
-	req.Header.Set("apikey", c.APIKey)
+// pgQuote double-quotes a value for a PostgREST logic tree.
+func pgQuote(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
 }
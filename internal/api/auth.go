@@ -0,0 +1,249 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/larkin1/wmsproject/internal/storage"
+)
+
+// AuthSession is a signed-in Supabase Auth (GoTrue) user. The access token is
+// sent as the Bearer token so row-level security applies per user; the
+// refresh token gets a new access token when it expires.
+type AuthSession struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	UserID       string    `json:"user_id"`
+	Email        string    `json:"email"`
+}
+
+// refreshMargin is how long before expiry the access token is refreshed, so
+// a request never goes out with a token that expires in flight.
+const refreshMargin = time.Minute
+
+var ErrNotSignedIn = errors.New("not signed in")
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	ExpiresAt    int64  `json:"expires_at"`
+	User         struct {
+		ID    string `json:"id"`
+		Email string `json:"email"`
+	} `json:"user"`
+}
+
+// SignInWithPassword signs in a Supabase Auth user. Operators signing in with
+// a PIN use the email mapped to their operator record and the password the
+// server returns once it has accepted the PIN; see SignInOperator.
+func (c *Client) SignInWithPassword(ctx context.Context, email, password string) error {
+	log.Printf("[API] Signing in %s\n", email)
+	body, _ := json.Marshal(map[string]string{"email": email, "password": password})
+	session, err := c.requestToken(ctx, "password", body)
+	if err != nil {
+		return err
+	}
+	c.setSession(session)
+	return nil
+}
+
+// RefreshSession exchanges the refresh token for a new access token.
+func (c *Client) RefreshSession(ctx context.Context) error {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	return c.refreshLocked(ctx)
+}
+
+func (c *Client) refreshLocked(ctx context.Context) error {
+	if c.session == nil || c.session.RefreshToken == "" {
+		return ErrNotSignedIn
+	}
+
+	log.Printf("[API] Refreshing session for %s\n", c.session.Email)
+	body, _ := json.Marshal(map[string]string{"refresh_token": c.session.RefreshToken})
+	session, err := c.requestToken(ctx, "refresh_token", body)
+	if err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.Permanent() {
+			// The refresh token was revoked or already used. Fall back to
+			// the anon key until someone signs in again.
+			log.Printf("[API] Refresh token rejected, dropping session: %v\n", err)
+			c.session = nil
+			c.saveSession()
+		}
+		return err
+	}
+	c.session = session
+	c.saveSession()
+	return nil
+}
+
+// SignOut forgets the current session locally and in the database. Requests
+// fall back to the anon key until someone signs in again.
+func (c *Client) SignOut() {
+	c.setSession(nil)
+}
+
+// Session returns a copy of the current session, or nil if not signed in.
+func (c *Client) Session() *AuthSession {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	if c.session == nil {
+		return nil
+	}
+	s := *c.session
+	return &s
+}
+
+func (c *Client) setSession(session *AuthSession) {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	c.session = session
+	c.saveSession()
+}
+
+func (c *Client) requestToken(ctx context.Context, grantType string, body []byte) (*AuthSession, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+"/auth/v1/token?grant_type="+grantType, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("apikey", c.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		return nil, newAPIError(resp.StatusCode, respBody)
+	}
+
+	var tok tokenResponse
+	if err := json.Unmarshal(respBody, &tok); err != nil {
+		return nil, fmt.Errorf("parse token response: %w", err)
+	}
+	if tok.AccessToken == "" {
+		return nil, errors.New("token response has no access token")
+	}
+
+	expiresAt := time.Unix(tok.ExpiresAt, 0)
+	if tok.ExpiresAt == 0 {
+		expiresAt = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	}
+	return &AuthSession{
+		AccessToken:  tok.AccessToken,
+		RefreshToken: tok.RefreshToken,
+		ExpiresAt:    expiresAt.UTC(),
+		UserID:       tok.User.ID,
+		Email:        tok.User.Email,
+	}, nil
+}
+
+// bearerToken returns the token for the Authorization header, refreshing it
+// first if it is about to expire. Without a session it is the anon key.
+func (c *Client) bearerToken(ctx context.Context) string {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	if c.session == nil {
+		return c.APIKey
+	}
+	if time.Until(c.session.ExpiresAt) < refreshMargin {
+		if err := c.refreshLocked(ctx); err != nil {
+			log.Printf("[API] Token refresh failed: %v\n", err)
+		}
+	}
+	if c.session == nil {
+		return c.APIKey
+	}
+	return c.session.AccessToken
+}
+
+// do sends req with auth headers. If the server answers 401 while signed in,
+// the session is refreshed and the request retried once.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	c.setAuthHeaders(req)
+	resp, err := c.Client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || c.Session() == nil {
+		return resp, err
+	}
+
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	log.Println("[API] Got 401, refreshing session and retrying")
+	if err := c.RefreshSession(req.Context()); err != nil {
+		return nil, err
+	}
+
+	retry := req.Clone(req.Context())
+	if req.Body != nil {
+		if req.GetBody == nil {
+			return nil, errors.New("request body can't be replayed")
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	c.setAuthHeaders(retry)
+	return c.Client.Do(retry)
+}
+
+func (c *Client) setAuthHeaders(req *http.Request) {
+	// The apikey header identifies the project and is always the anon key;
+	// the Bearer token identifies the user.
+	req.Header.Set("apikey", c.APIKey)
+	req.Header.Set("Authorization", "Bearer "+c.bearerToken(req.Context()))
+}
+
+// authSessionKey is where the session is kept in the settings bucket.
+var authSessionKey = []byte("auth_session")
+
+// saveSession persists the session so the device stays signed in to the API
+// across restarts. Callers must hold authMu.
+func (c *Client) saveSession() {
+	err := c.db.Update(func(tx *storage.Tx) error {
+		if c.session == nil {
+			return tx.Delete(storage.BucketSettings, authSessionKey)
+		}
+		return tx.PutSealed(storage.BucketSettings, authSessionKey, c.session)
+	})
+	if err != nil {
+		log.Printf("[API] Failed to save session: %v\n", err)
+	}
+}
+
+func (c *Client) loadSession() {
+	var session AuthSession
+	var found bool
+	err := c.db.View(func(tx *storage.Tx) error {
+		var err error
+		found, err = tx.GetSealed(storage.BucketSettings, authSessionKey, &session)
+		return err
+	})
+	if err != nil {
+		log.Printf("[API] Failed to read saved session: %v\n", err)
+		return
+	}
+	if !found {
+		return
+	}
+	c.session = &session
+	log.Printf("[API] Restored session for %s\n", session.Email)
+}
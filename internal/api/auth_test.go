@@ -0,0 +1,304 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/larkin1/wmsproject/internal/securefile"
+	"github.com/larkin1/wmsproject/internal/storage"
+)
+
+const testAnonKey = "anon-key"
+
+// openTestDB opens an empty database in a temporary directory.
+func openTestDB(t *testing.T) *storage.DB {
+	t.Helper()
+	dir := t.TempDir()
+	files, err := securefile.Open(filepath.Join(dir, "device.key"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := storage.Open(filepath.Join(dir, "wms.db"), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// fakeGoTrue stands in for the Supabase Auth token endpoint and a PostgREST
+// table, recording the grants asked for and the Bearer tokens seen.
+type fakeGoTrue struct {
+	mu        sync.Mutex
+	expiresIn int64  // lifetime of issued tokens, in seconds
+	refusing  bool   // refresh grants are rejected
+	reject    string // access token answered with 401
+	issued    int
+	grants    []string
+	bearers   []string
+}
+
+func (f *fakeGoTrue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("apikey") != testAnonKey {
+		http.Error(w, "no apikey", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path != "/auth/v1/token" {
+		bearer := r.Header.Get("Authorization")
+		f.bearers = append(f.bearers, bearer)
+		if f.reject != "" && bearer == "Bearer "+f.reject {
+			http.Error(w, `{"message":"JWT expired"}`, http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("[]"))
+		return
+	}
+
+	grant := r.URL.Query().Get("grant_type")
+	f.grants = append(f.grants, grant)
+	var req map[string]string
+	json.NewDecoder(r.Body).Decode(&req)
+	switch {
+	case grant == "password" && req["password"] != "secret":
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	case grant == "refresh_token" && (f.refusing || req["refresh_token"] != tokenName("refresh", f.issued)):
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	f.issued++
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  tokenName("access", f.issued),
+		"refresh_token": tokenName("refresh", f.issued),
+		"expires_in":    f.expiresIn,
+		"user":          map[string]string{"id": "user-1", "email": req["email"]},
+	})
+}
+
+func tokenName(kind string, n int) string {
+	return kind + "-" + strconv.Itoa(n)
+}
+
+func (f *fakeGoTrue) lastBearer() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.bearers) == 0 {
+		return ""
+	}
+	return f.bearers[len(f.bearers)-1]
+}
+
+func (f *fakeGoTrue) grantsSeen() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.grants...)
+}
+
+func newAuthTest(t *testing.T, expiresIn int64) (*Client, *fakeGoTrue, *storage.DB) {
+	t.Helper()
+	fake := &fakeGoTrue{expiresIn: expiresIn}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	db := openTestDB(t)
+	return NewClient(srv.URL, testAnonKey, db), fake, db
+}
+
+func TestSignInSendsAccessToken(t *testing.T) {
+	c, fake, db := newAuthTest(t, 3600)
+	ctx := context.Background()
+
+	if err := c.SignInWithPassword(ctx, "op@example.com", "wrong"); err == nil {
+		t.Fatal("sign-in with a wrong password succeeded")
+	}
+	if c.Session() != nil {
+		t.Fatal("failed sign-in left a session")
+	}
+
+	if err := c.SignInWithPassword(ctx, "op@example.com", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Check(ctx) {
+		t.Fatal("Check failed")
+	}
+	if got := fake.lastBearer(); got != "Bearer access-1" {
+		t.Fatalf("Authorization = %q, want the access token", got)
+	}
+
+	// The session survives a restart.
+	restored := NewClient(c.BaseURL, testAnonKey, db).Session()
+	if restored == nil || restored.AccessToken != "access-1" || restored.Email != "op@example.com" {
+		t.Fatalf("restored session = %+v", restored)
+	}
+}
+
+func TestTokenRefreshedBeforeExpiry(t *testing.T) {
+	// Tokens expire within refreshMargin, so the next request refreshes.
+	c, fake, db := newAuthTest(t, 30)
+	ctx := context.Background()
+
+	if err := c.SignInWithPassword(ctx, "op@example.com", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	c.Check(ctx)
+
+	if got := fake.grantsSeen(); len(got) != 2 || got[1] != "refresh_token" {
+		t.Fatalf("grants = %v, want password then refresh_token", got)
+	}
+	if got := fake.lastBearer(); got != "Bearer access-2" {
+		t.Fatalf("Authorization = %q, want the refreshed token", got)
+	}
+	if s := NewClient(c.BaseURL, testAnonKey, db).Session(); s == nil || s.RefreshToken != "refresh-2" {
+		t.Fatalf("saved session = %+v, want the refreshed one", s)
+	}
+}
+
+func TestRetryAfter401(t *testing.T) {
+	c, fake, _ := newAuthTest(t, 3600)
+	ctx := context.Background()
+
+	if err := c.SignInWithPassword(ctx, "op@example.com", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	fake.reject = "access-1"
+	fake.mu.Unlock()
+
+	if !c.Check(ctx) {
+		t.Fatal("request was not retried after a refresh")
+	}
+	if got := fake.lastBearer(); got != "Bearer access-2" {
+		t.Fatalf("retry Authorization = %q, want the refreshed token", got)
+	}
+}
+
+func TestRefreshFailureDropsSession(t *testing.T) {
+	c, fake, db := newAuthTest(t, 30)
+	ctx := context.Background()
+
+	if err := c.SignInWithPassword(ctx, "op@example.com", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	fake.refusing = true
+	fake.mu.Unlock()
+
+	err := c.RefreshSession(ctx)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("RefreshSession error = %v, want an APIError", err)
+	}
+	if c.Session() != nil {
+		t.Fatal("session kept after the refresh token was rejected")
+	}
+	if NewClient(c.BaseURL, testAnonKey, db).Session() != nil {
+		t.Fatal("rejected session still saved")
+	}
+
+	c.Check(ctx)
+	if got := fake.lastBearer(); got != "Bearer "+testAnonKey {
+		t.Fatalf("Authorization = %q, want the anon key", got)
+	}
+}
+
+func TestSignOutForgetsSession(t *testing.T) {
+	c, fake, db := newAuthTest(t, 3600)
+	ctx := context.Background()
+
+	if err := c.SignInWithPassword(ctx, "op@example.com", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	c.SignOut()
+
+	if c.Session() != nil {
+		t.Fatal("session kept after SignOut")
+	}
+	if NewClient(c.BaseURL, testAnonKey, db).Session() != nil {
+		t.Fatal("session still saved after SignOut")
+	}
+	c.Check(ctx)
+	if got := fake.lastBearer(); got != "Bearer "+testAnonKey {
+		t.Fatalf("Authorization = %q, want the anon key", got)
+	}
+}
+
+func TestVerifyPINFallsBackToDeviceVerifier(t *testing.T) {
+	refuse := 0 // status the server answers every check with, if set
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if refuse != 0 {
+			http.Error(w, `{"message":"too many attempts"}`, refuse)
+			return
+		}
+		var req struct {
+			OperatorID int    `json:"p_operator_id"`
+			PIN        string `json:"p_pin"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.URL.Path != "/rest/v1/rpc/verify_operator_pin" || req.OperatorID != 7 || req.PIN != "1234" {
+			w.Write([]byte(`{"valid":false}`))
+			return
+		}
+		w.Write([]byte(`{"valid":true,"auth_password":"secret"}`))
+	}))
+	c := NewClient(srv.URL, testAnonKey, openTestDB(t))
+	ctx := context.Background()
+
+	if err := c.VerifyPIN(ctx, 7, "9999"); !errors.Is(err, ErrWrongPIN) {
+		t.Fatalf("wrong PIN: err = %v", err)
+	}
+	if err := c.VerifyPIN(ctx, 7, "1234"); err != nil {
+		t.Fatalf("right PIN: err = %v", err)
+	}
+
+	// A server that answers but refuses, say after too many guesses, is
+	// final: the device's verifier would let guessing go on unthrottled.
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusLocked, http.StatusServiceUnavailable} {
+		refuse = status
+		for _, pin := range []string{"1234", "9999"} {
+			var apiErr *APIError
+			if err := c.VerifyPIN(ctx, 7, pin); !errors.As(err, &apiErr) || apiErr.StatusCode != status {
+				t.Fatalf("server answered %d, PIN %s: err = %v, want the server's refusal", status, pin, err)
+			}
+		}
+	}
+	refuse = 0
+
+	srv.Close()
+	if err := c.VerifyPIN(ctx, 7, "1234"); err != nil {
+		t.Fatalf("offline, right PIN: err = %v", err)
+	}
+	if err := c.VerifyPIN(ctx, 7, "9999"); !errors.Is(err, ErrWrongPIN) {
+		t.Fatalf("offline, wrong PIN: err = %v", err)
+	}
+	if err := c.VerifyPIN(ctx, 8, "1234"); !errors.Is(err, ErrPINOffline) {
+		t.Fatalf("offline, never verified: err = %v", err)
+	}
+}
+
+func TestReachableDoesNotRefresh(t *testing.T) {
+	c, fake, _ := newAuthTest(t, 30)
+	ctx := context.Background()
+
+	if err := c.SignInWithPassword(ctx, "op@example.com", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Reachable(ctx) {
+		t.Fatal("Reachable = false")
+	}
+	if got := fake.grantsSeen(); len(got) != 1 {
+		t.Fatalf("grants = %v, want only the sign-in", got)
+	}
+	if got := fake.lastBearer(); got != "" {
+		t.Fatalf("probe Authorization = %q, want none", got)
+	}
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// Backend is the server the device syncs with. The UI and the queue only talk
+// to a Backend, so the server can change without touching them: Client talks
+// to Supabase/PostgREST, RESTClient to any JSON API described in settings.
+//
+// Fetches fall back to the last cached response when the server can't be
+// reached, so callers work the same online and offline. The Local methods
+// return that cache without touching the network, for callers that must not
+// wait (the UI shows local data first and refreshes in the background).
+//
+// Every network call takes a context; cancelling it aborts the request.
+type Backend interface {
+	FetchOperators(ctx context.Context) ([]Operator, error)
+	FetchStock(ctx context.Context, location string) (*LocationStock, error)
+	// FetchCountTasks returns the open count tasks assigned to deviceID.
+	FetchCountTasks(ctx context.Context, deviceID string) ([]CountTask, error)
+	// FetchReceipts returns the open expected receipts (purchase orders and
+	// advance shipping notices).
+	FetchReceipts(ctx context.Context) ([]ExpectedReceipt, error)
+
+	// SyncCatalog updates the cached items and locations with what changed
+	// on the server since the last sync, and reports what it did per table.
+	SyncCatalog(ctx context.Context) ([]SyncStats, error)
+	// SyncHistory returns the stats of recent syncs, oldest first.
+	SyncHistory() []SyncStats
+
+	LocalItems() ([]Item, error)
+	LocalLocations() ([]Location, error)
+	LocalOperators() ([]Operator, error)
+	LocalStock(location string) (*LocationStock, error)
+	LocalCountTasks() ([]CountTask, error)
+	LocalReceipts() ([]ExpectedReceipt, error)
+
+	// Indexed lookups in the cached catalog. They return ErrNotCached if
+	// the row isn't there.
+	LocalItem(id int) (*Item, error)
+	LocalItemByName(name string) (*Item, error)
+	LocalItemByBarcode(code string) (*Item, error)
+	LocalLocation(name string) (*Location, error)
+	LocalItemLocations(itemID int) ([]string, error)
+	// CatalogUpdatedAt is when the cached items and locations were last
+	// known to match the server, or zero if they never were.
+	CatalogUpdatedAt() time.Time
+
+	// SendCommits inserts payloads, ignoring any whose UUID the server
+	// already has, and reports the outcome per chunk. It stops at the first
+	// chunk that fails; the ones after it report ErrNotAttempted.
+	SendCommits(ctx context.Context, payloads []CommitPayload) []ChunkResult
+	// SendTransfer inserts the legs of one transfer atomically, ignoring
+	// UUIDs the server already has.
+	SendTransfer(ctx context.Context, legs []CommitPayload) error
+	// SendDocument stores a document and its lines atomically, ignoring a
+	// document the server already has.
+	SendDocument(ctx context.Context, doc DocumentPayload) error
+	// VerifyPIN checks an operator's PIN with the server, which never hands
+	// out PIN hashes. Offline it checks the slow, salted verifier the device
+	// keeps from the last time the server accepted the PIN. It returns
+	// ErrWrongPIN, ErrPINOffline when there is nothing to check against, or
+	// the server's *APIError when it refused to check, e.g. a lockout.
+	VerifyPIN(ctx context.Context, operatorID int, pin string) error
+
+	// SendAssignments adds items to locations, creating locations as
+	// needed, all or nothing.
+	SendAssignments(ctx context.Context, assignments []AssignmentPayload) error
+	// SendCountResults records completed count tasks, all or nothing.
+	SendCountResults(ctx context.Context, results []CountResultPayload) error
+
+	// Check reports whether the server accepts our credentials.
+	Check(ctx context.Context) bool
+	// Reachable reports whether the server answers at all.
+	Reachable(ctx context.Context) bool
+}
+
+// Authenticator is implemented by backends where operators also sign in to
+// the server, so requests run with their permissions. SignOut forgets the
+// server session, including the copy kept in the database, so the next
+// operator's requests never go out under the previous operator's identity.
+type Authenticator interface {
+	// SignInOperator checks the operator's PIN like Backend.VerifyPIN and
+	// signs them in to the server if it accepts it.
+	SignInOperator(ctx context.Context, op Operator, pin string) error
+	SignOut()
+}
+
+// ChunkResult is the outcome of one bulk insert request. Each chunk is inserted
+// in a single statement, so it either fully succeeded or fully failed.
+type ChunkResult struct {
+	Commits []CommitPayload
+	Err     error
+}
+
+// ErrNotAttempted is the error of a chunk that wasn't sent because an earlier
+// one failed. It is never permanent.
+var ErrNotAttempted = errors.New("not sent: an earlier chunk failed")
+
+// sendInChunks calls send for each run of size payloads, in order. Once a
+// request fails, for any reason, the remaining chunks are not attempted and
+// report ErrNotAttempted, so nothing is stored ahead of a commit before it.
+func sendInChunks(ctx context.Context, payloads []CommitPayload, size int, send func(context.Context, []CommitPayload) error) []ChunkResult {
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+
+	var results []ChunkResult
+	failed := false
+	for start := 0; start < len(payloads); start += size {
+		end := start + size
+		if end > len(payloads) {
+			end = len(payloads)
+		}
+		chunk := payloads[start:end]
+
+		if failed {
+			results = append(results, ChunkResult{Commits: chunk, Err: ErrNotAttempted})
+			continue
+		}
+
+		err := send(ctx, chunk)
+		if err != nil {
+			log.Printf("[API] Chunk of %d commits failed: %v\n", len(chunk), err)
+			failed = true
+		}
+		results = append(results, ChunkResult{Commits: chunk, Err: err})
+	}
+	return results
+}
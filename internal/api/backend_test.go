@@ -0,0 +1,49 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSendInChunksStopsAtFirstError(t *testing.T) {
+	var payloads []CommitPayload
+	for id := 1; id <= 7; id++ {
+		payloads = append(payloads, CommitPayload{ItemID: id})
+	}
+
+	for _, failure := range []error{
+		&APIError{StatusCode: 422, Message: "unknown item"},
+		&APIError{StatusCode: 503, Message: "unavailable"},
+		errors.New("connection refused"),
+	} {
+		// The second chunk fails; nothing after it may reach the server
+		// ahead of it.
+		var calls int
+		results := sendInChunks(context.Background(), payloads, 2, func(ctx context.Context, chunk []CommitPayload) error {
+			calls++
+			if calls == 2 {
+				return failure
+			}
+			return nil
+		})
+
+		if calls != 2 {
+			t.Fatalf("%v: sent %d requests, want 2", failure, calls)
+		}
+		if len(results) != 4 {
+			t.Fatalf("%v: got %d results, want one per chunk", failure, len(results))
+		}
+		if results[0].Err != nil || results[1].Err != failure {
+			t.Fatalf("%v: results = %+v", failure, results[:2])
+		}
+		for i, res := range results[2:] {
+			if res.Err != ErrNotAttempted || IsPermanent(res.Err) {
+				t.Fatalf("%v: result %d error = %v, want %v", failure, i+2, res.Err, ErrNotAttempted)
+			}
+		}
+		if last := results[3].Commits; len(last) != 1 || last[0].ItemID != 7 {
+			t.Fatalf("%v: last chunk = %+v, want the odd commit", failure, last)
+		}
+	}
+}
@@ -0,0 +1,561 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/larkin1/wmsproject/internal/storage"
+)
+
+// cache keeps the last successful response of each fetch in the local
+// database, so every backend can fall back to it when offline.
+type cache struct {
+	db     *storage.DB
+	syncMu sync.Mutex // serialises catalog syncs; see sync.go
+}
+
+// CachedItems wraps items with metadata. Older versions kept it in
+// items.cache.json.
+type CachedItems struct {
+	Timestamp int64  `json:"timestamp"`
+	Items     []Item `json:"items"`
+}
+
+// CachedLocations wraps locations with metadata
+type CachedLocations struct {
+	Timestamp int64      `json:"timestamp"`
+	Locations []Location `json:"locations"`
+}
+
+// CachedOperators wraps operators with metadata
+type CachedOperators struct {
+	Timestamp int64      `json:"timestamp"`
+	Operators []Operator `json:"operators"`
+}
+
+// CachedStock maps location to its last fetched stock
+type CachedStock struct {
+	Locations map[string]LocationStock `json:"locations"`
+}
+
+var operatorsKey = []byte("operators")
+
+// cachedAtKey is where the sync bucket records when table was last known to
+// match the server.
+func cachedAtKey(table string) []byte {
+	return []byte("cached_at:" + table)
+}
+
+// putItem stores item and keeps the name and barcode indexes in step.
+func putItem(tx *storage.Tx, item Item) error {
+	var old Item
+	found, err := tx.Get(storage.BucketItems, storage.IntKey(item.ID), &old)
+	if err != nil {
+		return err
+	}
+	if found {
+		if err := unindexItem(tx, old); err != nil {
+			return err
+		}
+	}
+	if err := tx.Put(storage.BucketItems, storage.IntKey(item.ID), item); err != nil {
+		return err
+	}
+	for _, code := range item.Barcodes {
+		if err := tx.PutRaw(storage.BucketItemsByCode, storage.BarcodeKey(code), storage.IntKey(item.ID)); err != nil {
+			return err
+		}
+	}
+	return tx.PutRaw(storage.BucketItemsByName, storage.NameKey(item.Name), storage.IntKey(item.ID))
+}
+
+// deleteItem removes an item and its index entries, reporting whether it
+// was there.
+func deleteItem(tx *storage.Tx, id int) (bool, error) {
+	var old Item
+	found, err := tx.Get(storage.BucketItems, storage.IntKey(id), &old)
+	if err != nil || !found {
+		return false, err
+	}
+	if err := unindexItem(tx, old); err != nil {
+		return false, err
+	}
+	return true, tx.Delete(storage.BucketItems, storage.IntKey(id))
+}
+
+// unindexItem drops the index entries of item, except any another item with
+// the same name or barcode has taken over.
+func unindexItem(tx *storage.Tx, item Item) error {
+	if err := unindex(tx, storage.BucketItemsByName, storage.NameKey(item.Name), item.ID); err != nil {
+		return err
+	}
+	for _, code := range item.Barcodes {
+		if err := unindex(tx, storage.BucketItemsByCode, storage.BarcodeKey(code), item.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unindex(tx *storage.Tx, bucket string, key []byte, itemID int) error {
+	id, err := tx.GetRaw(bucket, key)
+	if err != nil || id == nil || storage.KeyInt(id) != itemID {
+		return err
+	}
+	return tx.Delete(bucket, key)
+}
+
+func itemLocationKey(itemID int, location string) []byte {
+	return append(storage.IntKey(itemID), location...)
+}
+
+// putLocation stores loc and keeps the item to location index in step.
+func putLocation(tx *storage.Tx, loc Location) error {
+	if _, err := deleteLocation(tx, loc.LocationName); err != nil {
+		return err
+	}
+	if err := tx.Put(storage.BucketLocations, []byte(loc.LocationName), loc); err != nil {
+		return err
+	}
+	for _, id := range loc.Items {
+		if err := tx.PutRaw(storage.BucketItemLocations, itemLocationKey(id, loc.LocationName), []byte(loc.LocationName)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteLocation removes a location and its index entries, reporting whether
+// it was there.
+func deleteLocation(tx *storage.Tx, name string) (bool, error) {
+	var old Location
+	found, err := tx.Get(storage.BucketLocations, []byte(name), &old)
+	if err != nil || !found {
+		return false, err
+	}
+	for _, id := range old.Items {
+		if err := tx.Delete(storage.BucketItemLocations, itemLocationKey(id, name)); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Delete(storage.BucketLocations, []byte(name))
+}
+
+// replaceItems replaces the cached items with items, as they were on the
+// server at cachedAt. A zero cachedAt leaves the table's age unrecorded, so
+// the catalog reads as stale until it syncs.
+func replaceItems(tx *storage.Tx, items []Item, cachedAt time.Time) error {
+	if err := tx.Clear(storage.BucketItems); err != nil {
+		return err
+	}
+	if err := tx.Clear(storage.BucketItemsByName); err != nil {
+		return err
+	}
+	if err := tx.Clear(storage.BucketItemsByCode); err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := putItem(tx, item); err != nil {
+			return err
+		}
+	}
+	return putCachedAt(tx, TableItems, cachedAt)
+}
+
+// replaceLocations is replaceItems for locations.
+func replaceLocations(tx *storage.Tx, locations []Location, cachedAt time.Time) error {
+	if err := tx.Clear(storage.BucketLocations); err != nil {
+		return err
+	}
+	if err := tx.Clear(storage.BucketItemLocations); err != nil {
+		return err
+	}
+	for _, loc := range locations {
+		if err := putLocation(tx, loc); err != nil {
+			return err
+		}
+	}
+	return putCachedAt(tx, TableLocations, cachedAt)
+}
+
+func putCachedAt(tx *storage.Tx, table string, cachedAt time.Time) error {
+	if cachedAt.IsZero() {
+		return nil
+	}
+	return tx.Put(storage.BucketSync, cachedAtKey(table), cachedAt.UTC())
+}
+
+func (c *cache) loadItemsCache() ([]Item, error) {
+	var items []Item
+	err := c.db.View(func(tx *storage.Tx) error {
+		return tx.ForEach(storage.BucketItems, func(_, value []byte) error {
+			var item Item
+			if err := json.Unmarshal(value, &item); err != nil {
+				return err
+			}
+			items = append(items, item)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("[API] Failed to read items cache: %v\n", err)
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("no cached items")
+	}
+
+	log.Printf("[API] Loaded %d items from cache\n", len(items))
+	return items, nil
+}
+
+func (c *cache) loadLocationsCache() ([]Location, error) {
+	var locations []Location
+	err := c.db.View(func(tx *storage.Tx) error {
+		return tx.ForEach(storage.BucketLocations, func(_, value []byte) error {
+			var loc Location
+			if err := json.Unmarshal(value, &loc); err != nil {
+				return err
+			}
+			locations = append(locations, loc)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("[API] Failed to read locations cache: %v\n", err)
+		return nil, err
+	}
+	if len(locations) == 0 {
+		return nil, fmt.Errorf("no cached locations")
+	}
+
+	log.Printf("[API] Loaded %d locations from cache\n", len(locations))
+	return locations, nil
+}
+
+func (c *cache) saveOperatorsCache(operators []Operator) error {
+	cached := CachedOperators{
+		Timestamp: time.Now().Unix(),
+		Operators: operators,
+	}
+	// Sealed: names and emails are personal data.
+	return c.db.Update(func(tx *storage.Tx) error {
+		return tx.PutSealed(storage.BucketOperators, operatorsKey, cached)
+	})
+}
+
+func (c *cache) loadOperatorsCache() ([]Operator, error) {
+	var cached CachedOperators
+	var found bool
+	err := c.db.View(func(tx *storage.Tx) error {
+		var err error
+		found, err = tx.GetSealed(storage.BucketOperators, operatorsKey, &cached)
+		return err
+	})
+	if err != nil {
+		log.Printf("[API] Failed to read operators cache: %v\n", err)
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("no cached operators")
+	}
+
+	log.Printf("[API] Loaded %d operators from cache (cached at %d)\n", len(cached.Operators), cached.Timestamp)
+	return cached.Operators, nil
+}
+
+func (c *cache) saveStockCache(stock *LocationStock) error {
+	return c.db.Update(func(tx *storage.Tx) error {
+		return tx.Put(storage.BucketStock, []byte(stock.Location), stock)
+	})
+}
+
+func (c *cache) loadStockCache(location string) (*LocationStock, error) {
+	var stock LocationStock
+	var found bool
+	err := c.db.View(func(tx *storage.Tx) error {
+		var err error
+		found, err = tx.Get(storage.BucketStock, []byte(location), &stock)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("no cached stock for location %s", location)
+	}
+	stock.Cached = true
+	log.Printf("[API] Loaded stock for %s from cache (fetched %s)\n", location, stock.FetchedAt)
+	return &stock, nil
+}
+
+// LocalItems returns the items from the last successful fetch.
+func (c *cache) LocalItems() ([]Item, error) {
+	return c.loadItemsCache()
+}
+
+// LocalLocations returns the locations from the last successful fetch.
+func (c *cache) LocalLocations() ([]Location, error) {
+	return c.loadLocationsCache()
+}
+
+// LocalOperators returns the operators from the last successful fetch.
+func (c *cache) LocalOperators() ([]Operator, error) {
+	return c.loadOperatorsCache()
+}
+
+// LocalStock returns the last fetched stock for location, marked Cached.
+func (c *cache) LocalStock(location string) (*LocationStock, error) {
+	return c.loadStockCache(location)
+}
+
+// ErrNotCached is returned by lookups for rows the local cache doesn't have.
+var ErrNotCached = errors.New("not in local cache")
+
+// LocalItem returns the cached item with the given ID.
+func (c *cache) LocalItem(id int) (*Item, error) {
+	var item Item
+	err := c.db.View(func(tx *storage.Tx) error {
+		found, err := tx.Get(storage.BucketItems, storage.IntKey(id), &item)
+		if err == nil && !found {
+			err = ErrNotCached
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// LocalItemByName returns the cached item with the given name, ignoring case.
+func (c *cache) LocalItemByName(name string) (*Item, error) {
+	var item Item
+	err := c.db.View(func(tx *storage.Tx) error {
+		id, err := tx.GetRaw(storage.BucketItemsByName, storage.NameKey(name))
+		if err != nil {
+			return err
+		}
+		if id == nil {
+			return ErrNotCached
+		}
+		found, err := tx.Get(storage.BucketItems, id, &item)
+		if err == nil && !found {
+			err = ErrNotCached
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// LocalItemByBarcode returns the cached item carrying the given barcode.
+func (c *cache) LocalItemByBarcode(code string) (*Item, error) {
+	var item Item
+	err := c.db.View(func(tx *storage.Tx) error {
+		id, err := tx.GetRaw(storage.BucketItemsByCode, storage.BarcodeKey(code))
+		if err != nil {
+			return err
+		}
+		if id == nil {
+			return ErrNotCached
+		}
+		found, err := tx.Get(storage.BucketItems, id, &item)
+		if err == nil && !found {
+			err = ErrNotCached
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// LocalLocation returns the cached location with the given name.
+func (c *cache) LocalLocation(name string) (*Location, error) {
+	var loc Location
+	err := c.db.View(func(tx *storage.Tx) error {
+		found, err := tx.Get(storage.BucketLocations, []byte(name), &loc)
+		if err == nil && !found {
+			err = ErrNotCached
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &loc, nil
+}
+
+// LocalItemLocations returns the cached locations an item is assigned to, in
+// name order.
+func (c *cache) LocalItemLocations(itemID int) ([]string, error) {
+	var names []string
+	err := c.db.View(func(tx *storage.Tx) error {
+		return tx.ForEachPrefix(storage.BucketItemLocations, storage.IntKey(itemID), func(_, value []byte) error {
+			names = append(names, string(value))
+			return nil
+		})
+	})
+	return names, err
+}
+
+// CatalogUpdatedAt returns the older of the items' and locations' last
+// confirmed sync, so the catalog is only as fresh as its stalest table.
+func (c *cache) CatalogUpdatedAt() time.Time {
+	var oldest time.Time
+	err := c.db.View(func(tx *storage.Tx) error {
+		for i, table := range []string{TableItems, TableLocations} {
+			var at time.Time
+			found, err := tx.Get(storage.BucketSync, cachedAtKey(table), &at)
+			if err != nil {
+				return err
+			}
+			if !found {
+				oldest = time.Time{}
+				return nil
+			}
+			if i == 0 || at.Before(oldest) {
+				oldest = at
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[API] Failed to read catalog age: %v\n", err)
+		return time.Time{}
+	}
+	return oldest
+}
+
+// importLegacy moves the cache files older versions wrote next to the
+// executable into the database, deleting each once it is in. A file that
+// fails to import is left in place and tried again next start.
+func (c *cache) importLegacy() {
+	imports := []struct {
+		name string
+		fn   func(tx *storage.Tx, data []byte) error
+	}{
+		{"items.cache.json", func(tx *storage.Tx, data []byte) error {
+			var cached CachedItems
+			if err := json.Unmarshal(data, &cached); err != nil {
+				return err
+			}
+			return replaceItems(tx, cached.Items, c.legacyCachedAt("items.cache.json", cached.Timestamp))
+		}},
+		{"items.csv", func(tx *storage.Tx, data []byte) error {
+			// The CSV export only matters if there was no JSON cache.
+			if n, err := tx.Count(storage.BucketItems); err != nil || n > 0 {
+				return err
+			}
+			items, err := parseItemsCSV(data)
+			if err != nil {
+				return err
+			}
+			return replaceItems(tx, items, c.legacyCachedAt("items.csv", 0))
+		}},
+		{"locations.cache.json", func(tx *storage.Tx, data []byte) error {
+			var cached CachedLocations
+			if err := json.Unmarshal(data, &cached); err != nil {
+				return err
+			}
+			return replaceLocations(tx, cached.Locations, c.legacyCachedAt("locations.cache.json", cached.Timestamp))
+		}},
+		{"locations.csv", func(tx *storage.Tx, data []byte) error {
+			return nil // only ever a copy of locations.cache.json
+		}},
+		{"stock.cache.json", func(tx *storage.Tx, data []byte) error {
+			var cached CachedStock
+			if err := json.Unmarshal(data, &cached); err != nil {
+				return err
+			}
+			for location, stock := range cached.Locations {
+				if err := tx.Put(storage.BucketStock, []byte(location), stock); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{"operators.cache.json", func(tx *storage.Tx, data []byte) error {
+			var cached CachedOperators
+			if err := json.Unmarshal(data, &cached); err != nil {
+				return err
+			}
+			return tx.PutSealed(storage.BucketOperators, operatorsKey, cached)
+		}},
+		{"auth_session.json", func(tx *storage.Tx, data []byte) error {
+			var session AuthSession
+			if err := json.Unmarshal(data, &session); err != nil {
+				return err
+			}
+			return tx.PutSealed(storage.BucketSettings, authSessionKey, session)
+		}},
+		{"catalog_sync.json", func(tx *storage.Tx, data []byte) error {
+			var state SyncState
+			if err := json.Unmarshal(data, &state); err != nil {
+				return err
+			}
+			return putSyncState(tx, &state)
+		}},
+	}
+
+	for _, imp := range imports {
+		fn := imp.fn
+		err := c.db.ImportFile(imp.name, func(data []byte) error {
+			return c.db.Update(func(tx *storage.Tx) error {
+				return fn(tx, data)
+			})
+		})
+		if err != nil {
+			log.Printf("[API] Failed to import %s: %v\n", imp.name, err)
+		}
+	}
+}
+
+// legacyCachedAt is when an old cache file last matched the server: its
+// timestamp (Unix seconds) if it has one, else the time the file was written,
+// else zero.
+func (c *cache) legacyCachedAt(name string, timestamp int64) time.Time {
+	if timestamp > 0 {
+		return time.Unix(timestamp, 0).UTC()
+	}
+	info, err := os.Stat(c.db.Path(name))
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime().UTC()
+}
+
+// parseItemsCSV reads the id,name export older versions kept in items.csv.
+func parseItemsCSV(data []byte) ([]Item, error) {
+	records, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var items []Item
+	for _, record := range records {
+		if len(record) < 2 {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSpace(record[0]))
+		if err != nil {
+			continue // header
+		}
+		if name := strings.TrimSpace(record[1]); name != "" {
+			items = append(items, Item{ID: id, Name: name})
+		}
+	}
+	return items, nil
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/larkin1/wmsproject/internal/storage"
+)
+
+func cachedAt(t *testing.T, db *storage.DB, table string) time.Time {
+	t.Helper()
+	var at time.Time
+	err := db.View(func(tx *storage.Tx) error {
+		_, err := tx.Get(storage.BucketSync, cachedAtKey(table), &at)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return at
+}
+
+func TestImportedLegacyCacheKeepsItsAge(t *testing.T) {
+	db := openTestDB(t)
+	itemsAt := time.Now().Add(-72 * time.Hour).Truncate(time.Second).UTC()
+	locationsAt := time.Now().Add(-48 * time.Hour).Truncate(time.Second).UTC()
+
+	items, _ := json.Marshal(CachedItems{Timestamp: itemsAt.Unix(), Items: []Item{{ID: 1, Name: "Widget"}}})
+	locations, _ := json.Marshal(CachedLocations{Locations: []Location{{LocationName: "A1", Items: []int{1}}}})
+	if err := os.WriteFile(db.Path("items.cache.json"), items, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Without a timestamp the file's own time stands in.
+	if err := os.WriteFile(db.Path("locations.cache.json"), locations, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(db.Path("locations.cache.json"), locationsAt, locationsAt); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient("http://127.0.0.1:1", testAnonKey, db)
+	if item, err := c.LocalItem(1); err != nil || item.Name != "Widget" {
+		t.Fatalf("item 1 = %+v, %v", item, err)
+	}
+	if got := cachedAt(t, db, TableLocations); !got.Equal(locationsAt) {
+		t.Fatalf("locations cached at %v, want the file's time %v", got, locationsAt)
+	}
+	if got := c.CatalogUpdatedAt(); !got.Equal(itemsAt) {
+		t.Fatalf("catalog updated at %v, want the old cache's %v", got, itemsAt)
+	}
+}
+
+func TestImportedItemsCSVLeavesCatalogStale(t *testing.T) {
+	db := openTestDB(t)
+	writtenAt := time.Now().Add(-24 * time.Hour).Truncate(time.Second).UTC()
+	if err := os.WriteFile(db.Path("items.csv"), []byte("id,name\n1,Widget\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(db.Path("items.csv"), writtenAt, writtenAt); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient("http://127.0.0.1:1", testAnonKey, db)
+	if got := cachedAt(t, db, TableItems); !got.Equal(writtenAt) {
+		t.Fatalf("items cached at %v, want the file's time %v", got, writtenAt)
+	}
+	// Locations were never imported, so the catalog has no age at all.
+	if got := c.CatalogUpdatedAt(); !got.IsZero() {
+		t.Fatalf("catalog updated at %v, want zero", got)
+	}
+}
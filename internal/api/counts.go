@@ -0,0 +1,162 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/larkin1/wmsproject/internal/storage"
+)
+
+// CountCampaign is a stocktake scheduled by an auditor. In a blind campaign
+// the device hides the expected quantity while counting. Variances larger
+// than VarianceThreshold (in either direction) need a supervisor.
+type CountCampaign struct {
+	ID                int       `json:"id"`
+	Name              string    `json:"name"`
+	DueAt             time.Time `json:"due_at"`
+	Blind             bool      `json:"blind"`
+	VarianceThreshold int       `json:"variance_threshold"`
+}
+
+// CountTask is one location of a campaign, assigned to a device.
+type CountTask struct {
+	ID       int           `json:"id"`
+	Location string        `json:"location"`
+	Campaign CountCampaign `json:"campaign"`
+}
+
+// CountLine is the count of one item in a task. Held lines had a variance
+// above the threshold that no supervisor approved on the device, so the
+// stock was left alone for the auditors to review.
+type CountLine struct {
+	ItemID       int  `json:"item_id"`
+	Expected     int  `json:"expected"`
+	Counted      int  `json:"counted"`
+	Held         bool `json:"held,omitempty"`
+	SupervisorID int  `json:"supervisor_id,omitempty"`
+}
+
+// CountResultPayload reports a counted task. The adjustments themselves are
+// sent as count commits tagged with the task ID.
+type CountResultPayload struct {
+	UUID       string      `json:"uuid"`
+	CapturedAt time.Time   `json:"captured_at"`
+	DeviceID   string      `json:"device_id"`
+	OperatorID int         `json:"operator_id,omitempty"`
+	TaskID     int         `json:"task_id"`
+	Lines      []CountLine `json:"lines"`
+}
+
+// FetchCountTasks returns the open count tasks assigned to deviceID, falling
+// back to the cached list when offline.
+func (c *Client) FetchCountTasks(ctx context.Context, deviceID string) ([]CountTask, error) {
+	log.Println("[API] FetchCountTasks() called")
+	endpoint := c.BaseURL + "/rest/v1/count_tasks?select=id,location,campaign:count_campaigns(id,name,due_at,blind,variance_threshold)" +
+		"&status=eq.open&device_id=eq." + url.QueryEscape(deviceID)
+	req, _ := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+
+	resp, err := c.do(req)
+	if err != nil {
+		log.Printf("[API] Request error: %v (trying cache)\n", err)
+		return c.LocalCountTasks()
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		log.Printf("[API] HTTP error %d (trying cache)\n", resp.StatusCode)
+		return c.LocalCountTasks()
+	}
+
+	var tasks []CountTask
+	if err := json.Unmarshal(body, &tasks); err != nil {
+		log.Printf("[API] JSON unmarshal error: %v (trying cache)\n", err)
+		return c.LocalCountTasks()
+	}
+
+	if err := c.saveCountTasks(tasks); err != nil {
+		log.Printf("[API] Failed to save count tasks: %v\n", err)
+	}
+	log.Printf("[API] Parsed %d count tasks\n", len(tasks))
+	sortCountTasks(tasks)
+	return tasks, nil
+}
+
+// SendCountResults records completed tasks through the complete_count_tasks
+// function, which closes them, in one transaction.
+func (c *Client) SendCountResults(ctx context.Context, results []CountResultPayload) error {
+	data, err := json.Marshal(map[string][]CountResultPayload{"p_results": results})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+"/rest/v1/rpc/complete_count_tasks", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode >= 400 {
+		return newAPIError(resp.StatusCode, body)
+	}
+	return nil
+}
+
+// saveCountTasks replaces the cached tasks. An empty list is saved too, since
+// it means every task was completed or withdrawn.
+func (c *cache) saveCountTasks(tasks []CountTask) error {
+	return c.db.Update(func(tx *storage.Tx) error {
+		if err := tx.Clear(storage.BucketCountTasks); err != nil {
+			return err
+		}
+		for _, task := range tasks {
+			if err := tx.Put(storage.BucketCountTasks, storage.IntKey(task.ID), task); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LocalCountTasks returns the cached count tasks, soonest due first.
+func (c *cache) LocalCountTasks() ([]CountTask, error) {
+	var tasks []CountTask
+	err := c.db.View(func(tx *storage.Tx) error {
+		return tx.ForEach(storage.BucketCountTasks, func(_, value []byte) error {
+			var task CountTask
+			if err := json.Unmarshal(value, &task); err != nil {
+				return err
+			}
+			tasks = append(tasks, task)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortCountTasks(tasks)
+	return tasks, nil
+}
+
+func sortCountTasks(tasks []CountTask) {
+	sort.SliceStable(tasks, func(i, j int) bool {
+		a, b := tasks[i], tasks[j]
+		if !a.Campaign.DueAt.Equal(b.Campaign.DueAt) {
+			return a.Campaign.DueAt.Before(b.Campaign.DueAt)
+		}
+		return a.Location < b.Location
+	})
+}
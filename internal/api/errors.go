@@ -0,0 +1,64 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// APIError is returned when the server answered with an error status. For
+// PostgREST the body is a JSON object with code/message/details/hint, which
+// is decoded into the matching fields when present.
+type APIError struct {
+	StatusCode int    `json:"status_code"`
+	Code       string `json:"code,omitempty"`
+	Message    string `json:"message,omitempty"`
+	Details    string `json:"details,omitempty"`
+	Hint       string `json:"hint,omitempty"`
+	Body       string `json:"body,omitempty"`
+}
+
+func newAPIError(statusCode int, body []byte) *APIError {
+	e := &APIError{StatusCode: statusCode, Body: string(body)}
+	json.Unmarshal(body, e)
+	e.StatusCode = statusCode // the body must not override the real status
+	return e
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("API error: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	if e.Code != "" {
+		return fmt.Sprintf("API error: %d (%s) %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("API error: %d %s", e.StatusCode, e.Message)
+}
+
+// Permanent reports whether resending the same request can never succeed,
+// i.e. the server rejected the data itself. Auth and missing-endpoint errors
+// are configuration problems that get fixed without touching the data, so
+// they count as retryable, as do timeouts, rate limits and 5xx.
+func (e *APIError) Permanent() bool {
+	if e.StatusCode < 400 || e.StatusCode >= 500 {
+		return false
+	}
+	switch e.StatusCode {
+	case http.StatusUnauthorized,
+		http.StatusForbidden,
+		http.StatusNotFound,
+		http.StatusRequestTimeout,
+		http.StatusTooEarly,
+		http.StatusTooManyRequests:
+		return false
+	}
+	return true
+}
+
+// IsPermanent reports whether err is an APIError that will not go away on
+// retry. Network errors are never permanent.
+func IsPermanent(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Permanent()
+}
@@ -0,0 +1,213 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/larkin1/wmsproject/internal/storage"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Operator is a person who can sign in on a device. PINs are checked by the
+// server, which never hands out their hashes; see VerifyPIN. Email is the
+// Supabase Auth user the operator maps to. Supervisors can approve
+// overrides on another operator's device.
+type Operator struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email,omitempty"`
+	Role  string `json:"role,omitempty"`
+}
+
+// RoleSupervisor is the Role of operators who can approve overrides.
+const RoleSupervisor = "supervisor"
+
+func (o Operator) IsSupervisor() bool {
+	return o.Role == RoleSupervisor
+}
+
+var (
+	ErrWrongPIN = errors.New("wrong PIN")
+	// ErrPINOffline means the server couldn't be reached and the PIN was
+	// never accepted on this device, so there is nothing to check it against.
+	ErrPINOffline = errors.New("PIN can't be checked offline on this device")
+)
+
+// pinCost is the bcrypt cost of the PIN verifiers kept on the device. PINs
+// are short, so only a slow, salted hash makes guessing them from a copy of
+// the database expensive.
+const pinCost = 12
+
+// pinCheck is the server's answer to a PIN. AuthPassword is the operator's
+// Supabase Auth password, a random secret that is never the PIN.
+type pinCheck struct {
+	Valid        bool   `json:"valid"`
+	AuthPassword string `json:"auth_password,omitempty"`
+}
+
+// FetchOperators returns the operators allowed to sign in, falling back to the
+// cached list so sign-in keeps working offline.
+func (c *Client) FetchOperators(ctx context.Context) ([]Operator, error) {
+	log.Println("[API] FetchOperators() called")
+	req, _ := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/rest/v1/operators?select=id,name,email,role", nil)
+
+	resp, err := c.do(req)
+	if err != nil {
+		log.Printf("[API] Request error: %v (trying cache)\n", err)
+		return c.loadOperatorsCache()
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		log.Printf("[API] HTTP error %d (trying cache)\n", resp.StatusCode)
+		return c.loadOperatorsCache()
+	}
+
+	var operators []Operator
+	if err := json.Unmarshal(body, &operators); err != nil {
+		log.Printf("[API] JSON unmarshal error: %v (trying cache)\n", err)
+		return c.loadOperatorsCache()
+	}
+
+	if len(operators) > 0 {
+		c.saveOperatorsCache(operators)
+	}
+
+	log.Printf("[API] Parsed %d operators\n", len(operators))
+	return operators, nil
+}
+
+// VerifyPIN checks an operator's PIN with the verify_operator_pin function.
+// When the server can't be reached it checks the verifier kept from the
+// last time the server accepted the PIN on this device; see pinUnchecked.
+func (c *Client) VerifyPIN(ctx context.Context, operatorID int, pin string) error {
+	check, err := c.checkPIN(ctx, operatorID, pin)
+	if err != nil {
+		return c.pinUnchecked(operatorID, pin, err)
+	}
+	return c.pinChecked(operatorID, pin, check.Valid)
+}
+
+// SignInOperator checks the PIN like VerifyPIN. If the server accepts it and
+// the operator has an email, it then signs in to Supabase Auth with the
+// password the server returned with the check.
+func (c *Client) SignInOperator(ctx context.Context, op Operator, pin string) error {
+	check, err := c.checkPIN(ctx, op.ID, pin)
+	if err != nil {
+		return c.pinUnchecked(op.ID, pin, err)
+	}
+	if err := c.pinChecked(op.ID, pin, check.Valid); err != nil {
+		return err
+	}
+	if op.Email == "" || check.AuthPassword == "" {
+		return nil
+	}
+	return c.SignInWithPassword(ctx, op.Email, check.AuthPassword)
+}
+
+func (c *Client) checkPIN(ctx context.Context, operatorID int, pin string) (pinCheck, error) {
+	data, err := json.Marshal(map[string]interface{}{"p_operator_id": operatorID, "p_pin": pin})
+	if err != nil {
+		return pinCheck{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+"/rest/v1/rpc/verify_operator_pin", bytes.NewBuffer(data))
+	if err != nil {
+		return pinCheck{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return pinCheck{}, err
+	}
+	return decodePINCheck(resp)
+}
+
+func decodePINCheck(resp *http.Response) (pinCheck, error) {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		return pinCheck{}, newAPIError(resp.StatusCode, body)
+	}
+
+	// An unknown operator comes back as null, which is a wrong PIN too.
+	var check pinCheck
+	if err := json.Unmarshal(body, &check); err != nil {
+		return pinCheck{}, fmt.Errorf("parse PIN check: %w", err)
+	}
+	return check, nil
+}
+
+// pinChecked records the server's verdict on a PIN: an accepted PIN becomes
+// the device's verifier, and a refused one that the verifier still accepts
+// (the PIN was changed) removes it.
+func (c *cache) pinChecked(operatorID int, pin string, valid bool) error {
+	if valid {
+		if err := c.savePINVerifier(operatorID, pin); err != nil {
+			log.Printf("[API] Failed to save PIN verifier: %v\n", err)
+		}
+		return nil
+	}
+	if c.LocalVerifyPIN(operatorID, pin) == nil {
+		log.Printf("[API] PIN of operator %d changed, dropping device verifier\n", operatorID)
+		if err := c.db.Update(func(tx *storage.Tx) error {
+			return tx.Delete(storage.BucketPINs, storage.IntKey(operatorID))
+		}); err != nil {
+			log.Printf("[API] Failed to drop PIN verifier: %v\n", err)
+		}
+	}
+	return ErrWrongPIN
+}
+
+func (c *cache) savePINVerifier(operatorID int, pin string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pin), pinCost)
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *storage.Tx) error {
+		return tx.PutSealed(storage.BucketPINs, storage.IntKey(operatorID), string(hash))
+	})
+}
+
+// pinUnchecked handles a PIN check that failed. Only a server that couldn't
+// be reached falls back to the device's verifier. Any answer from the server,
+// such as a lockout after too many guesses, is a refusal, so its throttling
+// can't be sidestepped by guessing against the device instead.
+func (c *cache) pinUnchecked(operatorID int, pin string, err error) error {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		log.Printf("[API] Server refused PIN check for operator %d: %v\n", operatorID, err)
+		return fmt.Errorf("PIN check refused: %w", err)
+	}
+	log.Printf("[API] PIN check failed: %v (trying device verifier)\n", err)
+	return c.LocalVerifyPIN(operatorID, pin)
+}
+
+// LocalVerifyPIN checks a PIN against the verifier kept on the device. It
+// returns ErrPINOffline if the operator has no verifier here.
+func (c *cache) LocalVerifyPIN(operatorID int, pin string) error {
+	var hash string
+	var found bool
+	err := c.db.View(func(tx *storage.Tx) error {
+		var err error
+		found, err = tx.GetSealed(storage.BucketPINs, storage.IntKey(operatorID), &hash)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrPINOffline
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pin)) != nil {
+		return ErrWrongPIN
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/larkin1/wmsproject/internal/storage"
+)
+
+// ExpectedReceipt is a shipment the warehouse is waiting for: a purchase
+// order or an advance shipping notice. Reference is the number printed (and
+// barcoded) on its paperwork. FetchedAt is set by the device when it fetches
+// the receipt.
+type ExpectedReceipt struct {
+	ID         int           `json:"id"`
+	Reference  string        `json:"reference"`
+	Supplier   string        `json:"supplier"`
+	ExpectedAt time.Time     `json:"expected_at"`
+	Lines      []ReceiptLine `json:"lines"`
+	FetchedAt  time.Time     `json:"fetched_at"`
+}
+
+// ReceiptLine is an item on a receipt. Received is what the server has
+// recorded against it so far, from commits tagged with the receipt.
+type ReceiptLine struct {
+	ItemID   int `json:"item_id"`
+	Expected int `json:"expected"`
+	Received int `json:"received"`
+}
+
+// Line returns the receipt's line for an item.
+func (r ExpectedReceipt) Line(itemID int) (ReceiptLine, bool) {
+	for _, line := range r.Lines {
+		if line.ItemID == itemID {
+			return line, true
+		}
+	}
+	return ReceiptLine{}, false
+}
+
+// FindReceipt returns the receipt whose reference matches code, ignoring case.
+func FindReceipt(receipts []ExpectedReceipt, code string) (ExpectedReceipt, bool) {
+	for _, r := range receipts {
+		if strings.EqualFold(r.Reference, code) {
+			return r, true
+		}
+	}
+	return ExpectedReceipt{}, false
+}
+
+// FetchReceipts returns the open expected receipts with their lines, falling
+// back to the cached list when offline.
+func (c *Client) FetchReceipts(ctx context.Context) ([]ExpectedReceipt, error) {
+	log.Println("[API] FetchReceipts() called")
+	endpoint := c.BaseURL + "/rest/v1/expected_receipts?select=id,reference,supplier,expected_at,lines:expected_receipt_lines(item_id,expected,received)" +
+		"&status=eq.open"
+	req, _ := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+
+	resp, err := c.do(req)
+	if err != nil {
+		log.Printf("[API] Request error: %v (trying cache)\n", err)
+		return c.LocalReceipts()
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		log.Printf("[API] HTTP error %d (trying cache)\n", resp.StatusCode)
+		return c.LocalReceipts()
+	}
+
+	var receipts []ExpectedReceipt
+	if err := json.Unmarshal(body, &receipts); err != nil {
+		log.Printf("[API] JSON unmarshal error: %v (trying cache)\n", err)
+		return c.LocalReceipts()
+	}
+
+	stampReceipts(receipts)
+	if err := c.saveReceipts(receipts); err != nil {
+		log.Printf("[API] Failed to save receipts: %v\n", err)
+	}
+	log.Printf("[API] Parsed %d receipts\n", len(receipts))
+	sortReceipts(receipts)
+	return receipts, nil
+}
+
+// stampReceipts records that receipts were fetched now, so their Received
+// figures are known to include what the server had by then.
+func stampReceipts(receipts []ExpectedReceipt) {
+	now := time.Now().UTC()
+	for i := range receipts {
+		receipts[i].FetchedAt = now
+	}
+}
+
+// saveReceipts replaces the cached receipts, so closed ones drop out.
+func (c *cache) saveReceipts(receipts []ExpectedReceipt) error {
+	return c.db.Update(func(tx *storage.Tx) error {
+		if err := tx.Clear(storage.BucketReceipts); err != nil {
+			return err
+		}
+		for _, r := range receipts {
+			if err := tx.Put(storage.BucketReceipts, storage.IntKey(r.ID), r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LocalReceipts returns the cached receipts, soonest expected first.
+func (c *cache) LocalReceipts() ([]ExpectedReceipt, error) {
+	var receipts []ExpectedReceipt
+	err := c.db.View(func(tx *storage.Tx) error {
+		return tx.ForEach(storage.BucketReceipts, func(_, value []byte) error {
+			var r ExpectedReceipt
+			if err := json.Unmarshal(value, &r); err != nil {
+				return err
+			}
+			receipts = append(receipts, r)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortReceipts(receipts)
+	return receipts, nil
+}
+
+func sortReceipts(receipts []ExpectedReceipt) {
+	sort.SliceStable(receipts, func(i, j int) bool {
+		a, b := receipts[i], receipts[j]
+		if !a.ExpectedAt.Equal(b.ExpectedAt) {
+			return a.ExpectedAt.Before(b.ExpectedAt)
+		}
+		return a.Reference < b.Reference
+	})
+}
@@ -0,0 +1,548 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/larkin1/wmsproject/internal/storage"
+)
+
+// RESTConfig describes a plain JSON API. Every path is relative to the base
+// URL; StockPath has {location} replaced with the escaped location name.
+//
+// Fields renames top-level JSON keys, from the names this app uses (e.g.
+// "location", "item_id") to the server's. Unlisted keys are sent as is.
+type RESTConfig struct {
+	ItemsPath        string            `json:"items_path,omitempty"`
+	LocationsPath    string            `json:"locations_path,omitempty"`
+	OperatorsPath    string            `json:"operators_path,omitempty"`
+	VerifyPINPath    string            `json:"verify_pin_path,omitempty"`
+	StockPath        string            `json:"stock_path,omitempty"`
+	CommitsPath      string            `json:"commits_path,omitempty"`
+	AssignPath       string            `json:"assign_path,omitempty"`
+	TransfersPath    string            `json:"transfers_path,omitempty"`
+	DocumentsPath    string            `json:"documents_path,omitempty"`
+	CountTasksPath   string            `json:"count_tasks_path,omitempty"` // {device} is replaced
+	CountResultsPath string            `json:"count_results_path,omitempty"`
+	ReceiptsPath     string            `json:"receipts_path,omitempty"`
+	HealthPath       string            `json:"health_path,omitempty"`
+	SinceParam       string            `json:"since_param,omitempty"` // query parameter for changes since a time
+	AfterParam       string            `json:"after_param,omitempty"` // query parameter for the key a page starts after
+	LimitParam       string            `json:"limit_param,omitempty"` // query parameter for the rows per page
+	AuthHeader       string            `json:"auth_header,omitempty"` // e.g. "X-API-Key" or "Authorization"
+	AuthScheme       string            `json:"auth_scheme,omitempty"` // e.g. "Bearer"; empty sends the bare key
+	Fields           map[string]string `json:"fields,omitempty"`
+	BatchSize        int               `json:"batch_size,omitempty"`
+}
+
+// DefaultRESTConfig is the layout of our own VPS API.
+func DefaultRESTConfig() RESTConfig {
+	return RESTConfig{
+		ItemsPath:        "/api/items",
+		LocationsPath:    "/api/locations",
+		OperatorsPath:    "/api/operators",
+		VerifyPINPath:    "/api/operators/verify-pin",
+		StockPath:        "/api/stock?location={location}",
+		CommitsPath:      "/api/commits",
+		AssignPath:       "/api/locations/assign",
+		TransfersPath:    "/api/transfers",
+		DocumentsPath:    "/api/documents",
+		CountTasksPath:   "/api/count-tasks?device_id={device}",
+		CountResultsPath: "/api/count-results",
+		ReceiptsPath:     "/api/receipts",
+		HealthPath:       "/api/health",
+		SinceParam:       "updated_since",
+		AfterParam:       "after",
+		LimitParam:       "limit",
+		AuthHeader:       "X-API-Key",
+		BatchSize:        DefaultBatchSize,
+	}
+}
+
+// withDefaults fills every unset field from DefaultRESTConfig, so settings
+// only need to list what differs.
+func (rc RESTConfig) withDefaults() RESTConfig {
+	def := DefaultRESTConfig()
+	for _, f := range []struct {
+		dst *string
+		def string
+	}{
+		{&rc.ItemsPath, def.ItemsPath},
+		{&rc.LocationsPath, def.LocationsPath},
+		{&rc.OperatorsPath, def.OperatorsPath},
+		{&rc.VerifyPINPath, def.VerifyPINPath},
+		{&rc.StockPath, def.StockPath},
+		{&rc.CommitsPath, def.CommitsPath},
+		{&rc.AssignPath, def.AssignPath},
+		{&rc.TransfersPath, def.TransfersPath},
+		{&rc.DocumentsPath, def.DocumentsPath},
+		{&rc.CountTasksPath, def.CountTasksPath},
+		{&rc.CountResultsPath, def.CountResultsPath},
+		{&rc.ReceiptsPath, def.ReceiptsPath},
+		{&rc.HealthPath, def.HealthPath},
+		{&rc.SinceParam, def.SinceParam},
+		{&rc.AfterParam, def.AfterParam},
+		{&rc.LimitParam, def.LimitParam},
+		{&rc.AuthHeader, def.AuthHeader},
+	} {
+		if *f.dst == "" {
+			*f.dst = f.def
+		}
+	}
+	if rc.BatchSize <= 0 {
+		rc.BatchSize = def.BatchSize
+	}
+	return rc
+}
+
+// RESTClient is the Backend for a generic JSON API. Lists are fetched with
+// GET and must return a JSON array; commits are POSTed as a JSON array and
+// the server is expected to ignore UUIDs it has already stored.
+type RESTClient struct {
+	BaseURL string
+	APIKey  string
+	Config  RESTConfig
+	Client  *http.Client
+
+	cache
+}
+
+func NewRESTClient(baseURL, apiKey string, cfg RESTConfig, db *storage.DB) *RESTClient {
+	c := &RESTClient{
+		cache:   cache{db: db},
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		APIKey:  apiKey,
+		Config:  cfg.withDefaults(),
+		Client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+	c.importLegacy()
+	return c
+}
+
+func (c *RESTClient) newRequest(ctx context.Context, method, path string, body []byte) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	key := c.APIKey
+	if c.Config.AuthScheme != "" {
+		key = c.Config.AuthScheme + " " + key
+	}
+	req.Header.Set(c.Config.AuthHeader, key)
+	return req, nil
+}
+
+// getList fetches path and decodes the JSON array into v, renaming fields
+// from the server's names to ours.
+func (c *RESTClient) getList(ctx context.Context, path string, v interface{}) error {
+	req, err := c.newRequest(ctx, "GET", path, nil)
+	if err != nil {
+		return err
+	}
+	log.Printf("[API] Making request to: %s\n", req.URL)
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		return newAPIError(resp.StatusCode, body)
+	}
+
+	body, err = renameFields(body, invert(c.Config.Fields))
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	return json.Unmarshal(body, v)
+}
+
+func (c *RESTClient) FetchOperators(ctx context.Context) ([]Operator, error) {
+	log.Println("[API] FetchOperators() called")
+	var operators []Operator
+	if err := c.getList(ctx, c.Config.OperatorsPath, &operators); err != nil {
+		log.Printf("[API] FetchOperators failed: %v (trying cache)\n", err)
+		return c.loadOperatorsCache()
+	}
+	if len(operators) > 0 {
+		c.saveOperatorsCache(operators)
+	}
+	log.Printf("[API] Parsed %d operators\n", len(operators))
+	return operators, nil
+}
+
+// VerifyPIN POSTs {operator_id, pin} to VerifyPINPath, which answers
+// {"valid": bool}. Offline it checks the device's verifier; see pinUnchecked.
+func (c *RESTClient) VerifyPIN(ctx context.Context, operatorID int, pin string) error {
+	check, err := c.checkPIN(ctx, operatorID, pin)
+	if err != nil {
+		return c.pinUnchecked(operatorID, pin, err)
+	}
+	return c.pinChecked(operatorID, pin, check.Valid)
+}
+
+func (c *RESTClient) checkPIN(ctx context.Context, operatorID int, pin string) (pinCheck, error) {
+	data, err := json.Marshal(map[string]interface{}{"operator_id": operatorID, "pin": pin})
+	if err != nil {
+		return pinCheck{}, err
+	}
+	req, err := c.newRequest(ctx, "POST", c.Config.VerifyPINPath, data)
+	if err != nil {
+		return pinCheck{}, err
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return pinCheck{}, err
+	}
+	return decodePINCheck(resp)
+}
+
+func (c *RESTClient) FetchStock(ctx context.Context, location string) (*LocationStock, error) {
+	log.Printf("[API] FetchStock(%s) called\n", location)
+	path := strings.ReplaceAll(c.Config.StockPath, "{location}", url.QueryEscape(location))
+
+	var levels []StockLevel
+	if err := c.getList(ctx, path, &levels); err != nil {
+		log.Printf("[API] FetchStock failed: %v (trying cache)\n", err)
+		return c.loadStockCache(location)
+	}
+
+	stock := &LocationStock{
+		Location:  location,
+		Levels:    levels,
+		FetchedAt: time.Now().UTC(),
+	}
+	if err := c.saveStockCache(stock); err != nil {
+		log.Printf("[API] Failed to save stock cache: %v\n", err)
+	}
+	log.Printf("[API] Location %s has %d stock rows\n", location, len(levels))
+	return stock, nil
+}
+
+// FetchCountTasks returns the open count tasks assigned to deviceID, falling
+// back to the cached list when offline.
+func (c *RESTClient) FetchCountTasks(ctx context.Context, deviceID string) ([]CountTask, error) {
+	log.Println("[API] FetchCountTasks() called")
+	path := strings.ReplaceAll(c.Config.CountTasksPath, "{device}", url.QueryEscape(deviceID))
+
+	var tasks []CountTask
+	if err := c.getList(ctx, path, &tasks); err != nil {
+		log.Printf("[API] FetchCountTasks failed: %v (trying cache)\n", err)
+		return c.LocalCountTasks()
+	}
+	if err := c.saveCountTasks(tasks); err != nil {
+		log.Printf("[API] Failed to save count tasks: %v\n", err)
+	}
+	log.Printf("[API] Parsed %d count tasks\n", len(tasks))
+	sortCountTasks(tasks)
+	return tasks, nil
+}
+
+func (c *RESTClient) FetchReceipts(ctx context.Context) ([]ExpectedReceipt, error) {
+	log.Println("[API] FetchReceipts() called")
+	var receipts []ExpectedReceipt
+	if err := c.getList(ctx, c.Config.ReceiptsPath, &receipts); err != nil {
+		log.Printf("[API] FetchReceipts failed: %v (trying cache)\n", err)
+		return c.LocalReceipts()
+	}
+	stampReceipts(receipts)
+	if err := c.saveReceipts(receipts); err != nil {
+		log.Printf("[API] Failed to save receipts: %v\n", err)
+	}
+	log.Printf("[API] Parsed %d receipts\n", len(receipts))
+	sortReceipts(receipts)
+	return receipts, nil
+}
+
+func (c *RESTClient) SendCommits(ctx context.Context, payloads []CommitPayload) []ChunkResult {
+	return sendInChunks(ctx, payloads, c.Config.BatchSize, func(ctx context.Context, chunk []CommitPayload) error {
+		return c.sendCommitChunk(ctx, chunk, c.Config.CommitsPath)
+	})
+}
+
+func (c *RESTClient) sendCommitChunk(ctx context.Context, chunk []CommitPayload, path string) error {
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return err
+	}
+	data, err = renameFields(data, c.Config.Fields)
+	if err != nil {
+		return err
+	}
+
+	req, err := c.newRequest(ctx, "POST", path, data)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode >= 400 {
+		return newAPIError(resp.StatusCode, body)
+	}
+	return nil
+}
+
+// SendTransfer POSTs the legs of a transfer as a JSON array, which the
+// server must store in one transaction.
+func (c *RESTClient) SendTransfer(ctx context.Context, legs []CommitPayload) error {
+	return c.sendCommitChunk(ctx, legs, c.Config.TransfersPath)
+}
+
+// SendDocument POSTs a document as one JSON object with its lines under
+// "lines". The server must store it in one transaction and ignore a document
+// UUID it has seen. fields renames the keys of the header and of each line.
+func (c *RESTClient) SendDocument(ctx context.Context, doc DocumentPayload) error {
+	lines, err := json.Marshal(doc.Lines)
+	if err != nil {
+		return err
+	}
+	if lines, err = renameFields(lines, c.Config.Fields); err != nil {
+		return err
+	}
+	doc.Lines = nil
+	header, err := json.Marshal([]DocumentPayload{doc})
+	if err != nil {
+		return err
+	}
+	if header, err = renameFields(header, c.Config.Fields); err != nil {
+		return err
+	}
+	var rows []map[string]json.RawMessage
+	if err := json.Unmarshal(header, &rows); err != nil {
+		return err
+	}
+	rows[0]["lines"] = lines
+	data, err := json.Marshal(rows[0])
+	if err != nil {
+		return err
+	}
+
+	req, err := c.newRequest(ctx, "POST", c.Config.DocumentsPath, data)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode >= 400 {
+		return newAPIError(resp.StatusCode, body)
+	}
+	return nil
+}
+
+// SendAssignments POSTs assignments as a JSON array. The server must ignore
+// UUIDs it has seen and add the item to an existing location rather than
+// create a second one.
+func (c *RESTClient) SendAssignments(ctx context.Context, assignments []AssignmentPayload) error {
+	data, err := json.Marshal(assignments)
+	if err != nil {
+		return err
+	}
+	data, err = renameFields(data, c.Config.Fields)
+	if err != nil {
+		return err
+	}
+
+	req, err := c.newRequest(ctx, "POST", c.Config.AssignPath, data)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode >= 400 {
+		return newAPIError(resp.StatusCode, body)
+	}
+	return nil
+}
+
+// SendCountResults POSTs completed tasks as a JSON array. The server must
+// ignore UUIDs it has seen and close each task.
+func (c *RESTClient) SendCountResults(ctx context.Context, results []CountResultPayload) error {
+	data, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	data, err = renameFields(data, c.Config.Fields)
+	if err != nil {
+		return err
+	}
+
+	req, err := c.newRequest(ctx, "POST", c.Config.CountResultsPath, data)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode >= 400 {
+		return newAPIError(resp.StatusCode, body)
+	}
+	return nil
+}
+
+// Check reports whether the health endpoint accepts our key with a 2xx. The
+// endpoint should check the key for this to catch a wrong one.
+func (c *RESTClient) Check(ctx context.Context) bool {
+	req, err := c.newRequest(ctx, "GET", c.Config.HealthPath, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+// Reachable reports whether the health endpoint answers below 500, whether
+// or not it accepts our key.
+func (c *RESTClient) Reachable(ctx context.Context) bool {
+	req, err := c.newRequest(ctx, "GET", c.Config.HealthPath, nil)
+	if err != nil {
+		return false
+	}
+
+	probe := &http.Client{
+		Timeout:   3 * time.Second,
+		Transport: c.Client.Transport,
+	}
+	resp, err := probe.Do(req)
+	if err != nil {
+		log.Printf("[API] Reachability probe failed: %v\n", err)
+		return false
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	return resp.StatusCode < 500
+}
+
+// SyncCatalog brings the cached items and locations up to date. The list
+// endpoints are paged: SinceParam (an RFC 3339 time) returns only rows updated
+// at or after it, ordered by updated_at and then key, deleted rows included
+// with deleted_at set; AfterParam skips the rows at that time up to and
+// including the given key, or without SinceParam lists every row in key order
+// after it; LimitParam caps the rows returned.
+func (c *RESTClient) SyncCatalog(ctx context.Context) ([]SyncStats, error) {
+	return c.syncCatalog(ctx, c.fetchChanges)
+}
+
+func (c *RESTClient) fetchChanges(ctx context.Context, table string, cur cursor, limit int, etag string) (*changes, error) {
+	path := c.Config.ItemsPath
+	if table == TableLocations {
+		path = c.Config.LocationsPath
+	}
+	q := url.Values{}
+	q.Set(c.Config.LimitParam, strconv.Itoa(limit))
+	if !cur.Since.IsZero() {
+		q.Set(c.Config.SinceParam, cur.Since.UTC().Format(time.RFC3339Nano))
+	}
+	if cur.Key != "" {
+		q.Set(c.Config.AfterParam, cur.Key)
+	}
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	path += sep + q.Encode()
+
+	req, err := c.newRequest(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode == http.StatusNotModified {
+		return &changes{ETag: etag, NotModified: true}, nil
+	}
+	if resp.StatusCode >= 400 {
+		return nil, newAPIError(resp.StatusCode, body)
+	}
+	body, err = renameFields(body, invert(c.Config.Fields))
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return &changes{Rows: body, ETag: resp.Header.Get("ETag")}, nil
+}
+
+// renameFields renames the top-level keys of a JSON array of objects.
+func renameFields(data []byte, names map[string]string) ([]byte, error) {
+	if len(names) == 0 {
+		return data, nil
+	}
+
+	var rows []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, err
+	}
+	for i, row := range rows {
+		renamed := make(map[string]json.RawMessage, len(row))
+		for k, v := range row {
+			if to, ok := names[k]; ok {
+				k = to
+			}
+			renamed[k] = v
+		}
+		rows[i] = renamed
+	}
+	return json.Marshal(rows)
+}
+
+func invert(m map[string]string) map[string]string {
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[v] = k
+	}
+	return out
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// StockLevel is one row of the overview view: the server's running total for
+// an item at a location.
+type StockLevel struct {
+	Location string `json:"location"`
+	ItemID   int    `json:"item_id"`
+	Qty      int    `json:"qty"`
+}
+
+// LocationStock holds the stock levels for one location. Cached is set when
+// the server couldn't be reached and the levels come from the last successful
+// fetch at FetchedAt.
+type LocationStock struct {
+	Location  string       `json:"location"`
+	Levels    []StockLevel `json:"levels"`
+	FetchedAt time.Time    `json:"fetched_at"`
+	Cached    bool         `json:"-"`
+}
+
+// Qty returns the server quantity for itemID, or 0 if the item has no rows
+// at this location.
+func (s *LocationStock) Qty(itemID int) int {
+	if s == nil {
+		return 0
+	}
+	for _, level := range s.Levels {
+		if level.ItemID == itemID {
+			return level.Qty
+		}
+	}
+	return 0
+}
+
+// FetchStock returns the overview totals for a location, falling back to the
+// cached copy when the request fails.
+func (c *Client) FetchStock(ctx context.Context, location string) (*LocationStock, error) {
+	log.Printf("[API] FetchStock(%s) called\n", location)
+	endpoint := c.BaseURL + "/rest/v1/overview?select=*&location=eq." + url.QueryEscape(location)
+	req, _ := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+
+	resp, err := c.do(req)
+	if err != nil {
+		log.Printf("[API] Request error: %v (trying cache)\n", err)
+		return c.loadStockCache(location)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		log.Printf("[API] HTTP error %d (trying cache)\n", resp.StatusCode)
+		return c.loadStockCache(location)
+	}
+
+	var levels []StockLevel
+	if err := json.Unmarshal(body, &levels); err != nil {
+		log.Printf("[API] JSON unmarshal error: %v (trying cache)\n", err)
+		return c.loadStockCache(location)
+	}
+
+	stock := &LocationStock{
+		Location:  location,
+		Levels:    levels,
+		FetchedAt: time.Now().UTC(),
+	}
+	if err := c.saveStockCache(stock); err != nil {
+		log.Printf("[API] Failed to save stock cache: %v\n", err)
+	}
+
+	log.Printf("[API] Location %s has %d stock rows\n", location, len(levels))
+	return stock, nil
+}
@@ -0,0 +1,461 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/larkin1/wmsproject/internal/storage"
+)
+
+// Catalog sync keeps the cached items and locations up to date without
+// downloading whole tables. Each table has a high-water mark, the newest
+// updated_at seen and the key of the last row seen with it; a sync asks only
+// for rows ordered after that pair and merges them into the cache. Rows that
+// share a timestamp are told apart by their key, so none are skipped at the
+// mark. Rows with deleted_at set are tombstones and are removed.
+//
+// Rows come in pages of syncPageSize, each starting after the last row of the
+// one before, until a short page.
+//
+// Rows deleted outright on the server never show up as changes, so once a
+// day (and on the first sync) the whole table is fetched and replaces the
+// cache instead.
+//
+// The request is conditional: the ETag from the last response is sent as
+// If-None-Match, so an unchanged table costs a 304 and no body.
+
+// fullReconcileInterval is how often a table is fetched in full.
+const fullReconcileInterval = 24 * time.Hour
+
+// syncPageSize is how many rows a sync asks for per request. It matches
+// PostgREST's usual max-rows, so a shorter page is the last.
+const syncPageSize = 1000
+
+// syncHistorySize is how many SyncStats are kept.
+const syncHistorySize = 50
+
+// Catalog tables kept in sync.
+const (
+	TableItems     = "items"
+	TableLocations = "locations"
+)
+
+// SyncStats describes what one sync of one table changed.
+type SyncStats struct {
+	Table       string        `json:"table"`
+	StartedAt   time.Time     `json:"started_at"`
+	Duration    time.Duration `json:"duration"`
+	Full        bool          `json:"full"`         // full reconcile instead of changes only
+	NotModified bool          `json:"not_modified"` // server answered 304
+	Upserted    int           `json:"upserted"`
+	Deleted     int           `json:"deleted"`
+	HighWater   time.Time     `json:"high_water"`
+	Error       string        `json:"error,omitempty"`
+}
+
+type tableSyncState struct {
+	HighWater time.Time `json:"high_water"`
+	// HighWaterKey is the key of the last row seen at HighWater; empty
+	// fetches every row at HighWater again.
+	HighWaterKey string    `json:"high_water_key,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastFull     time.Time `json:"last_full"`
+	LastSync     time.Time `json:"last_sync"`
+}
+
+// SyncState is the catalog_sync.json older versions kept; see putSyncState.
+type SyncState struct {
+	Tables  map[string]*tableSyncState `json:"tables"`
+	History []SyncStats                `json:"history"`
+}
+
+// changes is a backend's answer to a change request. Rows is a JSON array
+// in this app's field names.
+type changes struct {
+	Rows        []byte
+	ETag        string
+	NotModified bool
+}
+
+// cursor is where a page of rows starts. With Since set, rows are ordered by
+// updated_at and then key, and the page starts after the row (Since, Key),
+// or at Since itself if Key is empty. With Since zero, every row is listed
+// in key order, starting after Key.
+type cursor struct {
+	Since time.Time
+	Key   string
+}
+
+// changeFetcher returns up to limit rows of table from cur on.
+type changeFetcher func(ctx context.Context, table string, cur cursor, limit int, etag string) (*changes, error)
+
+// keyField is the field that identifies a row of table.
+func keyField(table string) string {
+	if table == TableLocations {
+		return "location"
+	}
+	return "id"
+}
+
+// syncCatalog brings every catalog table up to date. A table that fails to
+// sync keeps its cache and is retried from the same point next time.
+func (c *cache) syncCatalog(ctx context.Context, fetch changeFetcher) ([]SyncStats, error) {
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+
+	var stats []SyncStats
+	var firstErr error
+	for _, table := range []string{TableItems, TableLocations} {
+		st, err := c.syncTable(ctx, fetch, table)
+		st.Duration = time.Since(st.StartedAt)
+		if err != nil {
+			log.Printf("[API] Sync of %s failed: %v\n", table, err)
+			st.Error = err.Error()
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			log.Printf("[API] Synced %s: full=%v not_modified=%v upserted=%d deleted=%d in %s\n",
+				table, st.Full, st.NotModified, st.Upserted, st.Deleted, st.Duration)
+		}
+		stats = append(stats, st)
+	}
+
+	err := c.db.Update(func(tx *storage.Tx) error {
+		return appendSyncHistory(tx, stats)
+	})
+	if err != nil {
+		log.Printf("[API] Failed to save sync history: %v\n", err)
+	}
+	return stats, firstErr
+}
+
+// syncTable fetches the changes to table and merges them in the same
+// transaction that moves its high-water mark, so the two never disagree.
+func (c *cache) syncTable(ctx context.Context, fetch changeFetcher, table string) (SyncStats, error) {
+	st := SyncStats{Table: table, StartedAt: time.Now().UTC()}
+
+	var ts tableSyncState
+	err := c.db.View(func(tx *storage.Tx) error {
+		_, err := tx.Get(storage.BucketSync, syncStateKey(table), &ts)
+		return err
+	})
+	if err != nil {
+		return st, err
+	}
+	st.HighWater = ts.HighWater
+
+	st.Full = ts.HighWater.IsZero() || time.Since(ts.LastFull) > fullReconcileInterval
+	from, etag := cursor{Since: ts.HighWater, Key: ts.HighWaterKey}, ts.ETag
+	if st.Full {
+		from, etag = cursor{}, ""
+	}
+
+	ch, last, err := fetchPages(ctx, fetch, table, from, etag)
+	if err != nil {
+		return st, err
+	}
+
+	err = c.db.Update(func(tx *storage.Tx) error {
+		ts.LastSync = st.StartedAt
+		if err := tx.Put(storage.BucketSync, cachedAtKey(table), st.StartedAt); err != nil {
+			return err
+		}
+		if ch.NotModified {
+			st.NotModified = true
+			return tx.Put(storage.BucketSync, syncStateKey(table), ts)
+		}
+
+		var upserted, deleted int
+		var high time.Time
+		var err error
+		switch table {
+		case TableItems:
+			upserted, deleted, high, err = mergeItems(tx, ch.Rows, st.Full)
+		case TableLocations:
+			upserted, deleted, high, err = mergeLocations(tx, ch.Rows, st.Full)
+		default:
+			err = fmt.Errorf("unknown table %s", table)
+		}
+		if err != nil {
+			return err
+		}
+
+		st.Upserted, st.Deleted = upserted, deleted
+		if high.After(ts.HighWater) {
+			ts.HighWater = high
+		}
+		// A full fetch comes in key order, so which row was last at the
+		// mark isn't known; the next sync fetches that timestamp again.
+		ts.HighWaterKey = ""
+		if !st.Full && last.Key != "" && last.Since.Equal(ts.HighWater) {
+			ts.HighWaterKey = last.Key
+		}
+		st.HighWater = ts.HighWater
+		ts.ETag = ch.ETag
+		if st.Full {
+			ts.LastFull = st.StartedAt
+		}
+		return tx.Put(storage.BucketSync, syncStateKey(table), ts)
+	})
+	return st, err
+}
+
+// fetchPages fetches table from cur a page at a time until a short page and
+// joins the pages, keeping the newest copy of a row that moved between two of
+// them. Only the first request is conditional. It also returns the cursor of
+// the last row, zero if there were none.
+func fetchPages(ctx context.Context, fetch changeFetcher, table string, cur cursor, etag string) (*changes, cursor, error) {
+	var rows []json.RawMessage
+	var first *changes
+	var last cursor
+	for {
+		ch, err := fetch(ctx, table, cur, syncPageSize, etag)
+		if err != nil {
+			return nil, last, err
+		}
+		if first == nil {
+			if ch.NotModified {
+				return ch, last, nil
+			}
+			first, etag = ch, ""
+		}
+
+		var page []json.RawMessage
+		if err := json.Unmarshal(ch.Rows, &page); err != nil {
+			return nil, last, fmt.Errorf("parse %s: %w", table, err)
+		}
+		rows = append(rows, page...)
+		if len(page) == 0 {
+			break
+		}
+		if last, err = rowCursor(table, page[len(page)-1]); err != nil {
+			return nil, last, fmt.Errorf("parse %s: %w", table, err)
+		}
+		// A server that doesn't page returns more than it was asked for.
+		if len(page) != syncPageSize {
+			break
+		}
+
+		next := cursor{Key: last.Key}
+		if !cur.Since.IsZero() {
+			next.Since = last.Since
+		}
+		if next == cur {
+			return nil, last, fmt.Errorf("sync %s: page cursor didn't move past %s", table, cur.Key)
+		}
+		cur = next
+	}
+
+	data, err := json.Marshal(dedupRows(table, rows))
+	if err != nil {
+		return nil, last, err
+	}
+	return &changes{Rows: data, ETag: first.ETag}, last, nil
+}
+
+// rowCursor returns the cursor of a row: its updated_at and key.
+func rowCursor(table string, row json.RawMessage) (cursor, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(row, &fields); err != nil {
+		return cursor{}, err
+	}
+	var cur cursor
+	var updated *time.Time
+	if raw, ok := fields["updated_at"]; ok {
+		if err := json.Unmarshal(raw, &updated); err != nil {
+			return cursor{}, err
+		}
+	}
+	if updated != nil {
+		cur.Since = *updated
+	}
+	raw := fields[keyField(table)]
+	if err := json.Unmarshal(raw, &cur.Key); err != nil {
+		// Item IDs are numbers.
+		cur.Key = string(raw)
+	}
+	return cur, nil
+}
+
+// dedupRows keeps the last copy of each row, in the place of the first.
+func dedupRows(table string, rows []json.RawMessage) []json.RawMessage {
+	out := make([]json.RawMessage, 0, len(rows))
+	seen := make(map[string]int)
+	for _, row := range rows {
+		cur, err := rowCursor(table, row)
+		if err != nil {
+			out = append(out, row)
+			continue
+		}
+		if i, ok := seen[cur.Key]; ok {
+			out[i] = row
+			continue
+		}
+		seen[cur.Key] = len(out)
+		out = append(out, row)
+	}
+	return out
+}
+
+// errEmptyReconcile stops a full reconcile from wiping the cache when the
+// server returns no rows, which is far more often an auth or policy problem
+// than a real empty table.
+var errEmptyReconcile = errors.New("full sync returned no rows, keeping cache")
+
+func mergeItems(tx *storage.Tx, rows []byte, full bool) (upserted, deleted int, high time.Time, err error) {
+	var changed []Item
+	if err := json.Unmarshal(rows, &changed); err != nil {
+		return 0, 0, high, err
+	}
+	if full && len(changed) == 0 {
+		if n, err := tx.Count(storage.BucketItems); err != nil || n > 0 {
+			return 0, 0, high, errors.Join(err, errEmptyReconcile)
+		}
+	}
+
+	keep := make(map[int]bool)
+	for _, item := range changed {
+		if item.UpdatedAt != nil && item.UpdatedAt.After(high) {
+			high = *item.UpdatedAt
+		}
+		if item.DeletedAt != nil {
+			ok, err := deleteItem(tx, item.ID)
+			if err != nil {
+				return 0, 0, high, err
+			}
+			if ok {
+				deleted++
+			}
+			continue
+		}
+		if err := putItem(tx, item); err != nil {
+			return 0, 0, high, err
+		}
+		keep[item.ID] = true
+		upserted++
+	}
+
+	if full {
+		var gone []int
+		err := tx.ForEach(storage.BucketItems, func(key, _ []byte) error {
+			if id := storage.KeyInt(key); !keep[id] {
+				gone = append(gone, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, 0, high, err
+		}
+		for _, id := range gone {
+			if _, err := deleteItem(tx, id); err != nil {
+				return 0, 0, high, err
+			}
+			deleted++
+		}
+	}
+	return upserted, deleted, high, nil
+}
+
+func mergeLocations(tx *storage.Tx, rows []byte, full bool) (upserted, deleted int, high time.Time, err error) {
+	var changed []Location
+	if err := json.Unmarshal(rows, &changed); err != nil {
+		return 0, 0, high, err
+	}
+	if full && len(changed) == 0 {
+		if n, err := tx.Count(storage.BucketLocations); err != nil || n > 0 {
+			return 0, 0, high, errors.Join(err, errEmptyReconcile)
+		}
+	}
+
+	keep := make(map[string]bool)
+	for _, loc := range changed {
+		if loc.UpdatedAt != nil && loc.UpdatedAt.After(high) {
+			high = *loc.UpdatedAt
+		}
+		if loc.DeletedAt != nil {
+			ok, err := deleteLocation(tx, loc.LocationName)
+			if err != nil {
+				return 0, 0, high, err
+			}
+			if ok {
+				deleted++
+			}
+			continue
+		}
+		if err := putLocation(tx, loc); err != nil {
+			return 0, 0, high, err
+		}
+		keep[loc.LocationName] = true
+		upserted++
+	}
+
+	if full {
+		var gone []string
+		err := tx.ForEach(storage.BucketLocations, func(key, _ []byte) error {
+			if !keep[string(key)] {
+				gone = append(gone, string(key))
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, 0, high, err
+		}
+		for _, name := range gone {
+			if _, err := deleteLocation(tx, name); err != nil {
+				return 0, 0, high, err
+			}
+			deleted++
+		}
+	}
+	return upserted, deleted, high, nil
+}
+
+var syncHistoryKey = []byte("history")
+
+func syncStateKey(table string) []byte {
+	return []byte("state:" + table)
+}
+
+func appendSyncHistory(tx *storage.Tx, stats []SyncStats) error {
+	var history []SyncStats
+	if _, err := tx.Get(storage.BucketSync, syncHistoryKey, &history); err != nil {
+		return err
+	}
+	history = append(history, stats...)
+	if len(history) > syncHistorySize {
+		history = history[len(history)-syncHistorySize:]
+	}
+	return tx.Put(storage.BucketSync, syncHistoryKey, history)
+}
+
+// putSyncState stores state in the layout the sync bucket uses: one record
+// per table plus the history.
+func putSyncState(tx *storage.Tx, state *SyncState) error {
+	for table, ts := range state.Tables {
+		if ts == nil {
+			continue
+		}
+		if err := tx.Put(storage.BucketSync, syncStateKey(table), ts); err != nil {
+			return err
+		}
+	}
+	return appendSyncHistory(tx, state.History)
+}
+
+// SyncHistory returns the stats of recent catalog syncs, oldest first.
+func (c *cache) SyncHistory() []SyncStats {
+	var history []SyncStats
+	err := c.db.View(func(tx *storage.Tx) error {
+		_, err := tx.Get(storage.BucketSync, syncHistoryKey, &history)
+		return err
+	})
+	if err != nil {
+		log.Printf("[API] Failed to read sync history: %v\n", err)
+	}
+	return history
+}
@@ -0,0 +1,305 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/larkin1/wmsproject/internal/storage"
+)
+
+// fakeCatalog serves items the way the backends page them, by (updated_at,
+// id) or by id alone, and records the cursor of every request.
+type fakeCatalog struct {
+	items   map[int]Item
+	cursors []cursor
+}
+
+func (f *fakeCatalog) put(id int, at time.Time) {
+	f.items[id] = Item{ID: id, Name: fmt.Sprint("item ", id), UpdatedAt: &at}
+}
+
+func (f *fakeCatalog) fetch(ctx context.Context, table string, cur cursor, limit int, etag string) (*changes, error) {
+	if table != TableItems {
+		return &changes{Rows: []byte("[]")}, nil
+	}
+	f.cursors = append(f.cursors, cur)
+
+	after := -1
+	if cur.Key != "" {
+		after, _ = strconv.Atoi(cur.Key)
+	}
+	var rows []Item
+	for _, item := range f.items {
+		at := *item.UpdatedAt
+		switch {
+		case cur.Since.IsZero() && item.ID <= after:
+		case !cur.Since.IsZero() && at.Before(cur.Since):
+		case !cur.Since.IsZero() && at.Equal(cur.Since) && item.ID <= after:
+		default:
+			rows = append(rows, item)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if !cur.Since.IsZero() && !a.UpdatedAt.Equal(*b.UpdatedAt) {
+			return a.UpdatedAt.Before(*b.UpdatedAt)
+		}
+		return a.ID < b.ID
+	})
+	if len(rows) > limit {
+		rows = rows[:limit]
+	}
+	data, err := json.Marshal(rows)
+	return &changes{Rows: data}, err
+}
+
+// keys returns the keys of the cursors asked for, checking none had a time.
+func (f *fakeCatalog) keys() []string {
+	var keys []string
+	for _, cur := range f.cursors {
+		if !cur.Since.IsZero() {
+			return nil
+		}
+		keys = append(keys, cur.Key)
+	}
+	return keys
+}
+
+func syncState(t *testing.T, c *cache) tableSyncState {
+	t.Helper()
+	var ts tableSyncState
+	err := c.db.View(func(tx *storage.Tx) error {
+		_, err := tx.Get(storage.BucketSync, syncStateKey(TableItems), &ts)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+func TestSyncPagesThroughRowsSharingATimestamp(t *testing.T) {
+	c := &cache{db: openTestDB(t)}
+	ctx := context.Background()
+	t1 := time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+
+	server := &fakeCatalog{items: make(map[int]Item)}
+	for id := 1; id <= 2500; id++ {
+		server.put(id, t1)
+	}
+	if _, err := c.syncCatalog(ctx, server.fetch); err != nil {
+		t.Fatal(err)
+	}
+	// A full sync pages by ID alone.
+	if got := fmt.Sprintf("%q", server.keys()); got != `["" "1000" "2000"]` {
+		t.Fatalf("full sync cursors = %s", got)
+	}
+	if ts := syncState(t, c); !ts.HighWater.Equal(t1) || ts.HighWaterKey != "" {
+		t.Fatalf("state after full sync = %+v", ts)
+	}
+
+	// 1200 rows change in the same instant, more than a page.
+	for id := 1001; id <= 2200; id++ {
+		server.put(id, t2)
+	}
+	server.cursors = nil
+	stats, err := c.syncCatalog(ctx, server.fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(server.cursors); got != 3 {
+		t.Fatalf("incremental sync made %d requests, want 3: %v", got, server.cursors)
+	}
+	// The first page repeats the rows at the old mark, since a full sync
+	// doesn't know which came last; they merge again harmlessly.
+	if stats[0].Upserted != 1300+1200 || stats[0].Full {
+		t.Fatalf("stats = %+v", stats[0])
+	}
+	if ts := syncState(t, c); !ts.HighWater.Equal(t2) || ts.HighWaterKey != "2200" {
+		t.Fatalf("state after incremental sync = %+v", ts)
+	}
+
+	// A row committed later with the same timestamp isn't skipped, and rows
+	// already seen at the mark aren't fetched again.
+	server.put(2600, t2)
+	server.cursors = nil
+	stats, err = c.syncCatalog(ctx, server.fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[0].Upserted != 1 {
+		t.Fatalf("upserted %d, want only the new row", stats[0].Upserted)
+	}
+	items, err := c.LocalItems()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2501 {
+		t.Fatalf("cached %d items, want 2501", len(items))
+	}
+}
+
+func TestFetchPagesKeepsNewestCopy(t *testing.T) {
+	t1 := time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+
+	// Item 5 changes while the first page is being read, so it shows up on
+	// both pages.
+	var calls int
+	fetch := func(ctx context.Context, table string, cur cursor, limit int, etag string) (*changes, error) {
+		calls++
+		var rows []Item
+		if calls == 1 {
+			for id := 1; id <= limit; id++ {
+				rows = append(rows, Item{ID: id, Name: "old", UpdatedAt: &t1})
+			}
+		} else {
+			rows = []Item{{ID: 5, Name: "new", UpdatedAt: &t2}}
+		}
+		data, err := json.Marshal(rows)
+		return &changes{Rows: data}, err
+	}
+
+	ch, last, err := fetchPages(context.Background(), fetch, TableItems, cursor{Since: t1}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []Item
+	if err := json.Unmarshal(ch.Rows, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != syncPageSize || got[4].ID != 5 || got[4].Name != "new" {
+		t.Fatalf("got %d rows, row 5 = %+v", len(got), got[4])
+	}
+	if !last.Since.Equal(t2) || last.Key != "5" {
+		t.Fatalf("last = %+v", last)
+	}
+}
+
+func TestFetchChangesKeysetQuery(t *testing.T) {
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query().Encode())
+		w.Write([]byte("[]"))
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	since := time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+	cur := cursor{Since: since, Key: `A"1,2`}
+
+	c := NewClient(srv.URL, testAnonKey, openTestDB(t))
+	if _, err := c.fetchChanges(ctx, TableLocations, cur, 10, ""); err != nil {
+		t.Fatal(err)
+	}
+	rc := NewRESTClient(srv.URL, "key", RESTConfig{}, openTestDB(t))
+	if _, err := rc.fetchChanges(ctx, TableLocations, cur, 10, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		url.Values{
+			"select": {"*"},
+			"limit":  {"10"},
+			"order":  {"updated_at.asc,location.asc"},
+			"or":     {`(updated_at.gt."2026-01-01T08:00:00Z",and(updated_at.eq."2026-01-01T08:00:00Z",location.gt."A\"1,2"))`},
+		}.Encode(),
+		url.Values{
+			"limit":         {"10"},
+			"updated_since": {"2026-01-01T08:00:00Z"},
+			"after":         {`A"1,2`},
+		}.Encode(),
+	}
+	if fmt.Sprint(queries) != fmt.Sprint(want) {
+		t.Fatalf("queries:\n got %q\nwant %q", queries, want)
+	}
+}
+
+func TestSyncMergesTombstonesAndReconcilesDeletes(t *testing.T) {
+	c := &cache{db: openTestDB(t)}
+	ctx := context.Background()
+	t1 := time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+
+	server := &fakeCatalog{items: make(map[int]Item)}
+	for id := 1; id <= 4; id++ {
+		server.put(id, t1)
+	}
+	if _, err := c.syncCatalog(ctx, server.fetch); err != nil {
+		t.Fatal(err)
+	}
+
+	// Item 2 is renamed and item 3 soft-deleted; both reach the device as
+	// changes. Item 4 is deleted outright, which a change sync can't see.
+	server.put(2, t2)
+	renamed := server.items[2]
+	renamed.Name = "renamed"
+	server.items[2] = renamed
+	tombstone := server.items[3]
+	tombstone.UpdatedAt, tombstone.DeletedAt = &t2, &t2
+	server.items[3] = tombstone
+	delete(server.items, 4)
+
+	stats, err := c.syncCatalog(ctx, server.fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[0].Full || stats[0].Deleted != 1 {
+		t.Fatalf("stats = %+v, want one tombstone merged", stats[0])
+	}
+	if item, err := c.LocalItem(2); err != nil || item.Name != "renamed" {
+		t.Fatalf("item 2 = %+v, %v", item, err)
+	}
+	if item, _ := c.LocalItem(3); item != nil {
+		t.Fatalf("item 3 = %+v, want it removed", item)
+	}
+	if item, _ := c.LocalItem(4); item == nil {
+		t.Fatal("item 4 was removed by a change sync")
+	}
+
+	// The daily full sync drops what the server no longer has.
+	forceFullSync(t, c)
+	stats, err = c.syncCatalog(ctx, server.fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stats[0].Full || stats[0].Deleted != 1 {
+		t.Fatalf("stats = %+v, want a full sync that removed item 4", stats[0])
+	}
+	if item, _ := c.LocalItem(4); item != nil {
+		t.Fatalf("item 4 = %+v, want it removed", item)
+	}
+
+	// An empty full answer is far more often a policy problem than an empty
+	// table, so the cache is kept.
+	server.items = make(map[int]Item)
+	forceFullSync(t, c)
+	if _, err := c.syncCatalog(ctx, server.fetch); !errors.Is(err, errEmptyReconcile) {
+		t.Fatalf("sync error = %v, want %v", err, errEmptyReconcile)
+	}
+	if items, _ := c.LocalItems(); len(items) != 2 {
+		t.Fatalf("cached %d items after an empty full sync, want 2", len(items))
+	}
+}
+
+// forceFullSync makes the next sync of items a full one.
+func forceFullSync(t *testing.T, c *cache) {
+	t.Helper()
+	ts := syncState(t, c)
+	ts.LastFull = time.Time{}
+	err := c.db.Update(func(tx *storage.Tx) error {
+		return tx.Put(storage.BucketSync, syncStateKey(TableItems), ts)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,140 @@
+// Package catalog answers item and location lookups from the device's copy of
+// the catalog, so scanning and item search work the same with or without a
+// connection. Sync brings the copy up to date in the background, and Age
+// says how far behind the server it may be.
+package catalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/larkin1/wmsproject/internal/api"
+)
+
+// DefaultStaleAfter is how old the catalog may get before screens warn that
+// items or locations could be missing.
+const DefaultStaleAfter = 4 * time.Hour
+
+type Catalog struct {
+	backend    api.Backend
+	StaleAfter time.Duration
+}
+
+func New(backend api.Backend) *Catalog {
+	return &Catalog{backend: backend, StaleAfter: DefaultStaleAfter}
+}
+
+// Item returns the item with the given ID.
+func (c *Catalog) Item(id int) (api.Item, bool) {
+	item, err := c.backend.LocalItem(id)
+	if err != nil {
+		logMiss("item", id, err)
+		return api.Item{}, false
+	}
+	return *item, true
+}
+
+// ItemByName returns the item with the given name, ignoring case.
+func (c *Catalog) ItemByName(name string) (api.Item, bool) {
+	item, err := c.backend.LocalItemByName(name)
+	if err != nil {
+		logMiss("item", name, err)
+		return api.Item{}, false
+	}
+	return *item, true
+}
+
+// ItemByBarcode returns the item carrying the scanned barcode.
+func (c *Catalog) ItemByBarcode(code string) (api.Item, bool) {
+	item, err := c.backend.LocalItemByBarcode(code)
+	if err != nil {
+		logMiss("barcode", code, err)
+		return api.Item{}, false
+	}
+	return *item, true
+}
+
+// ItemName returns the name of an item, or its ID if it isn't in the catalog.
+func (c *Catalog) ItemName(id int) string {
+	if item, ok := c.Item(id); ok {
+		return item.Name
+	}
+	return fmt.Sprintf("ID: %d", id)
+}
+
+// Items returns every item, sorted by name.
+func (c *Catalog) Items() []api.Item {
+	items, err := c.backend.LocalItems()
+	if err != nil {
+		log.Printf("[Catalog] No items: %v\n", err)
+		return nil
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return items
+}
+
+// Location returns the location with the given name and the items assigned
+// to it.
+func (c *Catalog) Location(name string) (api.Location, bool) {
+	loc, err := c.backend.LocalLocation(name)
+	if err != nil {
+		logMiss("location", name, err)
+		return api.Location{}, false
+	}
+	return *loc, true
+}
+
+// LocationsOf returns the names of the locations an item is assigned to.
+func (c *Catalog) LocationsOf(itemID int) []string {
+	names, err := c.backend.LocalItemLocations(itemID)
+	if err != nil {
+		log.Printf("[Catalog] Locations of item %d: %v\n", itemID, err)
+	}
+	return names
+}
+
+func logMiss(kind string, key interface{}, err error) {
+	if !errors.Is(err, api.ErrNotCached) {
+		log.Printf("[Catalog] Lookup of %s %v failed: %v\n", kind, key, err)
+	}
+}
+
+// Sync pulls catalog changes from the server. Lookups keep answering from
+// the previous copy while it runs.
+func (c *Catalog) Sync(ctx context.Context) error {
+	_, err := c.backend.SyncCatalog(ctx)
+	return err
+}
+
+// UpdatedAt is when the catalog was last known to match the server, or zero
+// if it never was.
+func (c *Catalog) UpdatedAt() time.Time {
+	return c.backend.CatalogUpdatedAt()
+}
+
+// Stale reports whether the catalog is older than StaleAfter.
+func (c *Catalog) Stale() bool {
+	at := c.UpdatedAt()
+	return at.IsZero() || time.Since(at) > c.StaleAfter
+}
+
+// StaleWarning describes how old the catalog is, or returns "" if it is
+// fresh enough not to mention.
+func (c *Catalog) StaleWarning() string {
+	if !c.Stale() {
+		return ""
+	}
+	at := c.UpdatedAt()
+	if at.IsZero() {
+		return "Catalog not downloaded yet - connect to load items and locations"
+	}
+	hours := int(time.Since(at).Hours())
+	if hours == 1 {
+		return "Catalog last updated 1 hour ago"
+	}
+	return fmt.Sprintf("Catalog last updated %d hours ago", hours)
+}
@@ -2,50 +2,191 @@ package config
 
 import (
 	"encoding/json"
-	"os"
-	"path/filepath"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/larkin1/wmsproject/internal/api"
+	"github.com/larkin1/wmsproject/internal/storage"
 )
 
+// Settings are kept in the settings bucket of the local database, with the
+// API key sealed in a record of its own. To change them by hand, an admin
+// drops a settings.json next to the database: on the next start the fields it
+// sets are applied over the stored settings and the file is deleted.
 type Settings struct {
-	APIURL   string `json:"api_url"`
-	APIKey   string `json:"api_key"`
-	DeviceID string `json:"device_id"`
+	APIURL              string              `json:"api_url"`
+	APIKey              string              `json:"api_key,omitempty"` // only read from old plaintext files
+	DeviceID            string              `json:"device_id"`
+	NegativeStockPolicy NegativeStockPolicy `json:"negative_stock_policy,omitempty"`
+	Backend             string              `json:"backend,omitempty"`
+	REST                *api.RESTConfig     `json:"rest,omitempty"`              // only used by the rest backend
+	ConfirmItemScan     bool                `json:"confirm_item_scan,omitempty"` // require scanning the item before a commit
 }
 
-func Load(filePath string) (*Settings, error) {
-	data, err := os.ReadFile(filePath)
-	if err != nil {
+// Backends the app can sync with. An empty Backend means Supabase, which is
+// what settings from before the choice existed were written for.
+const (
+	BackendSupabase = "supabase"
+	BackendREST     = "rest"
+)
+
+// NewBackend returns the API client for the configured backend, with url and
+// key in place of the saved ones.
+func (s *Settings) NewBackend(url, key string, db *storage.DB) api.Backend {
+	if s.Backend == BackendREST {
+		cfg := api.DefaultRESTConfig()
+		if s.REST != nil {
+			cfg = *s.REST
+		}
+		return api.NewRESTClient(url, key, cfg, db)
+	}
+	return api.NewClient(url, key, db)
+}
+
+// NegativeStockPolicy decides what happens when a removal would take the
+// projected on-hand quantity below zero.
+type NegativeStockPolicy string
+
+const (
+	NegativeStockBlock NegativeStockPolicy = "block" // refuse the commit
+	NegativeStockWarn  NegativeStockPolicy = "warn"  // ask the operator to confirm
+	NegativeStockAllow NegativeStockPolicy = "allow" // commit, but record it
+)
+
+// ParseNegativeStockPolicy returns the policy named by s, defaulting to warn
+// for empty or unknown values.
+func ParseNegativeStockPolicy(s string) NegativeStockPolicy {
+	switch p := NegativeStockPolicy(s); p {
+	case NegativeStockBlock, NegativeStockWarn, NegativeStockAllow:
+		return p
+	}
+	return NegativeStockWarn
+}
+
+type credentials struct {
+	APIKey string `json:"api_key"`
+}
+
+var (
+	settingsKey    = []byte("settings")
+	credentialsKey = []byte("credentials")
+)
+
+// ErrNotConfigured is returned by Load on a device that has never been set up.
+var ErrNotConfigured = errors.New("settings not configured")
+
+// Load reads settings and decrypts the credentials, after importing a
+// settings.json or credentials.json left next to the database by an admin or
+// an older version.
+func Load(db *storage.DB) (*Settings, error) {
+	if err := importFiles(db); err != nil {
 		return nil, err
 	}
 
 	var settings Settings
-	err = json.Unmarshal(data, &settings)
+	err := db.View(func(tx *storage.Tx) error {
+		found, err := tx.Get(storage.BucketSettings, settingsKey, &settings)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return ErrNotConfigured
+		}
+		var creds credentials
+		if _, err := tx.GetSealed(storage.BucketSettings, credentialsKey, &creds); err != nil {
+			return err
+		}
+		settings.APIKey = creds.APIKey
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-
 	return &settings, nil
 }
 
-func Save(filePath string, settings *Settings) error {
-	dir := filepath.Dir(filePath)
-	os.MkdirAll(dir, 0755)
-
-	data, err := json.MarshalIndent(settings, "", "  ")
+// importFiles applies credentials.json and then settings.json, so an API key
+// in a plaintext settings.json wins. Fields missing from settings.json keep
+// their stored values.
+func importFiles(db *storage.DB) error {
+	err := db.ImportFile("credentials.json", func(data []byte) error {
+		var creds credentials
+		if err := json.Unmarshal(data, &creds); err != nil {
+			return err
+		}
+		return db.Update(func(tx *storage.Tx) error {
+			return tx.PutSealed(storage.BucketSettings, credentialsKey, creds)
+		})
+	})
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(filePath, data, 0644)
+	return db.ImportFile("settings.json", func(data []byte) error {
+		return db.Update(func(tx *storage.Tx) error {
+			var settings Settings
+			if _, err := tx.Get(storage.BucketSettings, settingsKey, &settings); err != nil {
+				return err
+			}
+			var creds credentials
+			if _, err := tx.GetSealed(storage.BucketSettings, credentialsKey, &creds); err != nil {
+				return err
+			}
+			settings.APIKey = creds.APIKey
+
+			if err := json.Unmarshal(data, &settings); err != nil {
+				return err
+			}
+			if settings.APIKey != creds.APIKey {
+				log.Println("[Config] Moving API key out of settings.json")
+			}
+			return put(tx, &settings)
+		})
+	})
+}
+
+func Save(db *storage.DB, settings *Settings) error {
+	return db.Update(func(tx *storage.Tx) error {
+		return put(tx, settings)
+	})
+}
+
+func put(tx *storage.Tx, settings *Settings) error {
+	if err := tx.PutSealed(storage.BucketSettings, credentialsKey, credentials{APIKey: settings.APIKey}); err != nil {
+		return err
+	}
+	plain := *settings
+	plain.APIKey = ""
+	return tx.Put(storage.BucketSettings, settingsKey, plain)
 }
 
-func CreateDefault(filePath string) (*Settings, error) {
+func CreateDefault(db *storage.DB) (*Settings, error) {
 	settings := &Settings{
-		APIURL:   "",
-		APIKey:   "",
-		DeviceID: "TOUGHPAD01",
+		APIURL:              "",
+		APIKey:              "",
+		DeviceID:            NewDeviceID(),
+		NegativeStockPolicy: NegativeStockWarn,
 	}
 
-	err := Save(filePath, settings)
+	err := Save(db, settings)
 	return settings, err
 }
+
+// NewDeviceID generates a device ID for handhelds that weren't given a name.
+// It is stored in settings on first run, so it stays the same afterwards.
+func NewDeviceID() string {
+	return "PDA-" + strings.ToUpper(strings.ReplaceAll(uuid.NewString(), "-", "")[:8])
+}
+
+// EnsureDeviceID fills in a generated device ID if none is set. It returns
+// true if the settings changed and need saving.
+func (s *Settings) EnsureDeviceID() bool {
+	s.DeviceID = strings.TrimSpace(s.DeviceID)
+	if s.DeviceID != "" {
+		return false
+	}
+	s.DeviceID = NewDeviceID()
+	return true
+}
@@ -0,0 +1,227 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/larkin1/wmsproject/internal/api"
+	"github.com/larkin1/wmsproject/internal/storage"
+)
+
+// Assignment adds an item to a location, creating the location if the server
+// doesn't have it. Assignments are queued and sent like commits; until then
+// PendingItems lets the UI treat the item as assigned.
+type Assignment struct {
+	ID         string    `json:"id"`
+	CapturedAt time.Time `json:"captured_at"`
+	DeviceID   string    `json:"device_id"`
+	OperatorID int       `json:"operator_id,omitempty"`
+	Location   string    `json:"location"`
+	ItemID     int       `json:"item_id"`
+}
+
+// Payload converts the assignment into the API representation.
+func (a Assignment) Payload() api.AssignmentPayload {
+	return api.AssignmentPayload{
+		UUID:       a.ID,
+		CapturedAt: a.CapturedAt,
+		DeviceID:   a.DeviceID,
+		OperatorID: a.OperatorID,
+		Location:   a.Location,
+		ItemID:     a.ItemID,
+	}
+}
+
+// SubmitAssignment assigns the assignment its ID and capture time and queues
+// it. Submitting an item already pending for the location is a no-op.
+func (q *Queue) SubmitAssignment(a Assignment) (Assignment, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, pending := range q.assignments {
+		if pending.Location == a.Location && pending.ItemID == a.ItemID {
+			return pending, nil
+		}
+	}
+
+	a.ID = uuid.NewString()
+	a.CapturedAt = time.Now().UTC()
+	if a.DeviceID == "" {
+		a.DeviceID = q.deviceID
+	}
+
+	err := q.db.Update(func(tx *storage.Tx) error {
+		return tx.Append(storage.ListAssignments, a.ID, a)
+	})
+	if err != nil {
+		log.Printf("[Queue] Failed to store assignment: %v\n", err)
+		return a, err
+	}
+	q.assignments = append(q.assignments, a)
+	q.notifyLocked()
+
+	log.Printf("[Queue] Assignment queued: %+v\n", a)
+	q.Flush()
+	return a, nil
+}
+
+// PendingItems returns the items queued for assignment to location that the
+// server doesn't know about yet.
+func (q *Queue) PendingItems(location string) []int {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	var ids []int
+	for _, a := range q.assignments {
+		if a.Location == location {
+			ids = append(ids, a.ItemID)
+		}
+	}
+	return ids
+}
+
+func (q *Queue) loadAssignments(tx *storage.Tx) error {
+	records, err := tx.Records(storage.ListAssignments)
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		var a Assignment
+		if err := json.Unmarshal(rec.Data, &a); err != nil {
+			log.Printf("[Queue] Skipping unreadable assignment %s: %v\n", rec.ID, err)
+			continue
+		}
+		q.assignments = append(q.assignments, a)
+	}
+	return nil
+}
+
+// processAssignments sends the pending assignments in one request. If the
+// server rejects the batch as invalid, each is retried alone so one bad
+// assignment (say, an item deleted since) can't hold up the rest; the ones
+// rejected on their own go to the dead letters, like commits.
+func (q *Queue) processAssignments(ctx context.Context) error {
+	q.mu.RLock()
+	pending := make([]Assignment, len(q.assignments))
+	copy(pending, q.assignments)
+	q.mu.RUnlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	payloads := make([]api.AssignmentPayload, len(pending))
+	for i, a := range pending {
+		payloads[i] = a.Payload()
+	}
+
+	var done []string
+	var rejected []DeadLetter
+	var stopErr error
+	err := q.api.SendAssignments(ctx, payloads)
+	switch {
+	case err == nil:
+		for _, a := range pending {
+			done = append(done, a.ID)
+		}
+	case api.IsPermanent(err) && len(pending) > 1:
+		// One at a time to find the rejected ones. A failure that isn't a
+		// rejection would only repeat for the rest, so they wait for the next
+		// flush.
+		for i := 0; i < len(pending) && stopErr == nil; i++ {
+			a := pending[i]
+			err := q.api.SendAssignments(ctx, payloads[i:i+1])
+			switch {
+			case err == nil:
+				done = append(done, a.ID)
+			case api.IsPermanent(err):
+				rejected = append(rejected, rejectAssignment(a, err))
+			default:
+				stopErr = err
+			}
+		}
+	case api.IsPermanent(err):
+		rejected = append(rejected, rejectAssignment(pending[0], err))
+	default:
+		return err
+	}
+	for _, dl := range rejected {
+		done = append(done, dl.ID())
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	err = q.db.Update(func(tx *storage.Tx) error {
+		for _, dl := range rejected {
+			if err := tx.Append(storage.ListDeadLetters, dl.ID(), dl); err != nil {
+				return err
+			}
+		}
+		return tx.Remove(storage.ListAssignments, done...)
+	})
+	if err != nil {
+		// Resent next time; the server ignores UUIDs it has seen.
+		log.Printf("[Queue] Failed to record sent assignments: %v\n", err)
+		return err
+	}
+	q.deadLetters = append(q.deadLetters, rejected...)
+
+	sent := make(map[string]bool, len(done))
+	for _, id := range done {
+		sent[id] = true
+	}
+	remaining := q.assignments[:0]
+	for _, a := range q.assignments {
+		if !sent[a.ID] {
+			remaining = append(remaining, a)
+		}
+	}
+	q.assignments = remaining
+	log.Printf("[Queue] Sent %d assignments, rejected %d, %d still pending\n", len(done)-len(rejected), len(rejected), len(q.assignments))
+	return stopErr
+}
+
+func rejectAssignment(a Assignment, err error) DeadLetter {
+	log.Printf("[Queue] Assignment of item %d to %s rejected, moving to dead letters: %v\n", a.ItemID, a.Location, err)
+	dl := newDeadLetter(Commit{}, err)
+	dl.Assignment = &a
+	return dl
+}
+
+// ResubmitAssignment moves a rejected assignment back to the queue with the
+// location and item of edited. It keeps its ID, since the server never
+// stored it.
+func (q *Queue) ResubmitAssignment(id string, edited Assignment) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	idx := q.deadLetterIndex(id)
+	if idx < 0 || q.deadLetters[idx].Assignment == nil {
+		return ErrDeadLetterNotFound
+	}
+	a := *q.deadLetters[idx].Assignment
+	a.Location = edited.Location
+	a.ItemID = edited.ItemID
+
+	err := q.db.Update(func(tx *storage.Tx) error {
+		if err := tx.Append(storage.ListAssignments, a.ID, a); err != nil {
+			return err
+		}
+		return tx.Remove(storage.ListDeadLetters, a.ID)
+	})
+	if err != nil {
+		return fmt.Errorf("requeue assignment: %w", err)
+	}
+	q.assignments = append(q.assignments, a)
+	q.removeDeadLetters(idx)
+	q.notifyLocked()
+
+	log.Printf("[Queue] Rejected assignment %s resubmitted: %+v\n", id, a)
+	q.Flush()
+	return nil
+}
@@ -0,0 +1,94 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestRejectedAssignmentIsDeadLettered(t *testing.T) {
+	q, fake, db := newTestQueue(t)
+	ctx := context.Background()
+
+	for _, itemID := range []int{1, 2, 3} {
+		if _, err := q.SubmitAssignment(Assignment{Location: "A1", ItemID: itemID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake.badItems[2] = true
+
+	if err := q.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, fake, "assign 1,2,3", "assign 1", "assign 2", "assign 3")
+	if got := q.PendingItems("A1"); len(got) != 0 {
+		t.Fatalf("pending items = %v, want none", got)
+	}
+
+	dead := q.DeadLetters()
+	if len(dead) != 1 || dead[0].Assignment == nil || dead[0].Assignment.ItemID != 2 || dead[0].StatusCode != 422 {
+		t.Fatalf("dead letters = %+v, want the assignment of item 2", dead)
+	}
+
+	// The dead letter survives a restart.
+	reopened, err := NewQueue(fake, db, "device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dead := reopened.DeadLetters(); len(dead) != 1 || dead[0].ID() != q.DeadLetters()[0].ID() {
+		t.Fatalf("dead letters after restart = %+v", dead)
+	}
+
+	// A commit resubmit can't pick it up, an assignment resubmit can.
+	id := dead[0].ID()
+	if err := q.ResubmitDeadLetter(id, Commit{}); err != ErrDeadLetterNotFound {
+		t.Fatalf("ResubmitDeadLetter = %v, want ErrDeadLetterNotFound", err)
+	}
+	if err := q.ResubmitAssignment(id, Assignment{Location: "A2", ItemID: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if got := q.PendingItems("A2"); len(got) != 1 || got[0] != 4 {
+		t.Fatalf("pending items = %v, want the corrected assignment", got)
+	}
+	if err := q.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(q.DeadLetters()) != 0 || q.Status().Pending != 0 {
+		t.Fatalf("status after resubmit = %+v", q.Status())
+	}
+}
+
+func TestAssignmentRetryStopsWhenOffline(t *testing.T) {
+	q, fake, _ := newTestQueue(t)
+	ctx := context.Background()
+
+	for _, itemID := range []int{1, 2, 3} {
+		if _, err := q.SubmitAssignment(Assignment{Location: "A1", ItemID: itemID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake.badItems[2] = true
+
+	// The connection drops during the one-at-a-time retry: the rest aren't
+	// tried, and nothing is dead-lettered on an unanswered request.
+	fake.failAt = 3
+	if err := q.flush(ctx); !errors.Is(err, errOffline) {
+		t.Fatalf("flush error = %v, want %v", err, errOffline)
+	}
+	checkRequests(t, fake, "assign 1,2,3", "assign 1", "assign 2")
+	if got := fmt.Sprint(q.PendingItems("A1")); got != "[2 3]" {
+		t.Fatalf("pending items = %s, want [2 3]", got)
+	}
+	if dead := q.DeadLetters(); len(dead) != 0 {
+		t.Fatalf("dead letters = %+v, want none", dead)
+	}
+
+	if err := q.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, fake, "assign 1,2,3", "assign 1", "assign 2", "assign 2,3", "assign 2", "assign 3")
+	if dead := q.DeadLetters(); len(dead) != 1 || dead[0].Assignment.ItemID != 2 {
+		t.Fatalf("dead letters = %+v, want the assignment of item 2", dead)
+	}
+}
@@ -0,0 +1,41 @@
+package queue
+
+import (
+	"github.com/larkin1/wmsproject/internal/storage"
+)
+
+// A cart holds the lines an operator collects on the stock screen before
+// submitting them as one document. Carts are kept per operator, so a cart
+// survives leaving the screen, an idle sign-out or a restart and comes back
+// when the same operator signs in again, and is never submitted under
+// another operator's name.
+
+// Cart returns the operator's saved cart, or nil if there is none.
+func (q *Queue) Cart(operatorID int) ([]Commit, error) {
+	var lines []Commit
+	err := q.db.View(func(tx *storage.Tx) error {
+		_, err := tx.GetSealed(storage.BucketCarts, storage.IntKey(operatorID), &lines)
+		return err
+	})
+	return lines, err
+}
+
+// SaveCart replaces the operator's saved cart with lines. An empty cart is
+// deleted.
+func (q *Queue) SaveCart(operatorID int, lines []Commit) error {
+	return q.db.Update(func(tx *storage.Tx) error {
+		if len(lines) == 0 {
+			return tx.Delete(storage.BucketCarts, storage.IntKey(operatorID))
+		}
+		return tx.PutSealed(storage.BucketCarts, storage.IntKey(operatorID), lines)
+	})
+}
+
+// SubmitCart queues lines as one document like SubmitDocument, and deletes
+// the operator's saved cart in the same transaction, so the cart can never
+// be submitted twice.
+func (q *Queue) SubmitCart(doc Document, operatorID int, lines []Commit) ([]Commit, error) {
+	return q.submitDocument(doc, lines, func(tx *storage.Tx) error {
+		return tx.Delete(storage.BucketCarts, storage.IntKey(operatorID))
+	})
+}
@@ -0,0 +1,34 @@
+package queue
+
+import "testing"
+
+func TestCartSavedPerOperatorAndClearedOnSubmit(t *testing.T) {
+	q, fake, db := newTestQueue(t)
+
+	lines := []Commit{{Location: "A1", ItemID: 1, Delta: 3}, {Location: "A1", ItemID: 2, Delta: -1}}
+	if err := q.SaveCart(7, lines); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewQueue(fake, db, "device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cart, err := reopened.Cart(7); err != nil || len(cart) != 2 || cart[1].Delta != -1 {
+		t.Fatalf("cart after restart = %+v, %v", cart, err)
+	}
+	if cart, err := reopened.Cart(8); err != nil || cart != nil {
+		t.Fatalf("another operator's cart = %+v, %v, want none", cart, err)
+	}
+
+	queued, err := reopened.SubmitCart(Document{Reason: "delivery"}, 7, lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queued) != 2 || queued[0].Document == nil || queued[0].Document.ID != queued[1].Document.ID {
+		t.Fatalf("queued = %+v, want two lines of one document", queued)
+	}
+	if cart, err := reopened.Cart(7); err != nil || cart != nil {
+		t.Fatalf("cart after submit = %+v, %v, want none", cart, err)
+	}
+}
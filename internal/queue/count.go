@@ -0,0 +1,236 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/larkin1/wmsproject/internal/api"
+	"github.com/larkin1/wmsproject/internal/storage"
+)
+
+// CountResult reports a completed count task. Its adjustments are queued as
+// count commits tagged with the task; the result itself only closes the task
+// and records what was counted, including held variances.
+type CountResult struct {
+	ID         string          `json:"id"`
+	CapturedAt time.Time       `json:"captured_at"`
+	DeviceID   string          `json:"device_id"`
+	OperatorID int             `json:"operator_id,omitempty"`
+	TaskID     int             `json:"task_id"`
+	Lines      []api.CountLine `json:"lines"`
+}
+
+// Payload converts the result into the API representation.
+func (r CountResult) Payload() api.CountResultPayload {
+	return api.CountResultPayload{
+		UUID:       r.ID,
+		CapturedAt: r.CapturedAt,
+		DeviceID:   r.DeviceID,
+		OperatorID: r.OperatorID,
+		TaskID:     r.TaskID,
+		Lines:      r.Lines,
+	}
+}
+
+// SubmitCountResult queues a count task's result together with its
+// adjustments, the count commits for the variances that weren't held. They
+// get their IDs and capture time here and are stored in one transaction, so a
+// count that failed to save can be finished again without applying any
+// adjustment twice.
+func (q *Queue) SubmitCountResult(r CountResult, adjustments []Commit) (CountResult, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	r.ID = uuid.NewString()
+	r.CapturedAt = time.Now().UTC()
+	if r.DeviceID == "" {
+		r.DeviceID = q.deviceID
+	}
+	queued := make([]Commit, len(adjustments))
+	for i, c := range adjustments {
+		c.ID = uuid.NewString()
+		c.CapturedAt = r.CapturedAt
+		if c.DeviceID == "" {
+			c.DeviceID = q.deviceID
+		}
+		queued[i] = c
+	}
+
+	err := q.db.Update(func(tx *storage.Tx) error {
+		for _, c := range queued {
+			if err := tx.Append(storage.ListPending, c.ID, c); err != nil {
+				return err
+			}
+		}
+		return tx.Append(storage.ListCountResults, r.ID, r)
+	})
+	if err != nil {
+		log.Printf("[Queue] Failed to store count result: %v\n", err)
+		return r, err
+	}
+	q.pending = append(q.pending, queued...)
+	q.countResults = append(q.countResults, r)
+	q.notifyLocked()
+
+	log.Printf("[Queue] Count result queued for task %d (%d lines, %d adjustments)\n", r.TaskID, len(r.Lines), len(queued))
+	q.Flush()
+	return r, nil
+}
+
+// CountTaskDone reports whether a result for the task is waiting to be sent,
+// so the task can be hidden before the server closes it.
+func (q *Queue) CountTaskDone(taskID int) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	for _, r := range q.countResults {
+		if r.TaskID == taskID {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *Queue) loadCountResults(tx *storage.Tx) error {
+	records, err := tx.Records(storage.ListCountResults)
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		var r CountResult
+		if err := json.Unmarshal(rec.Data, &r); err != nil {
+			log.Printf("[Queue] Skipping unreadable count result %s: %v\n", rec.ID, err)
+			continue
+		}
+		q.countResults = append(q.countResults, r)
+	}
+	return nil
+}
+
+// processCountResults sends the pending results in one request, falling back
+// to one at a time if the server rejects the batch, like processAssignments.
+// A result rejected on its own goes to the dead letters: its adjustments are
+// commits that go regardless, but the task stays open on the server until the
+// result is resubmitted or the task is counted again.
+func (q *Queue) processCountResults(ctx context.Context) error {
+	q.mu.RLock()
+	pending := make([]CountResult, len(q.countResults))
+	copy(pending, q.countResults)
+	q.mu.RUnlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	payloads := make([]api.CountResultPayload, len(pending))
+	for i, r := range pending {
+		payloads[i] = r.Payload()
+	}
+
+	var done []string
+	var rejected []DeadLetter
+	var stopErr error
+	err := q.api.SendCountResults(ctx, payloads)
+	switch {
+	case err == nil:
+		for _, r := range pending {
+			done = append(done, r.ID)
+		}
+	case api.IsPermanent(err) && len(pending) > 1:
+		// One at a time to find the rejected ones. A failure that isn't a
+		// rejection would only repeat for the rest, so they wait for the next
+		// flush.
+		for i := 0; i < len(pending) && stopErr == nil; i++ {
+			r := pending[i]
+			err := q.api.SendCountResults(ctx, payloads[i:i+1])
+			switch {
+			case err == nil:
+				done = append(done, r.ID)
+			case api.IsPermanent(err):
+				rejected = append(rejected, rejectCountResult(r, err))
+			default:
+				stopErr = err
+			}
+		}
+	case api.IsPermanent(err):
+		rejected = append(rejected, rejectCountResult(pending[0], err))
+	default:
+		return err
+	}
+	for _, dl := range rejected {
+		done = append(done, dl.ID())
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	err = q.db.Update(func(tx *storage.Tx) error {
+		for _, dl := range rejected {
+			if err := tx.Append(storage.ListDeadLetters, dl.ID(), dl); err != nil {
+				return err
+			}
+		}
+		return tx.Remove(storage.ListCountResults, done...)
+	})
+	if err != nil {
+		// Resent next time; the server ignores UUIDs it has seen.
+		log.Printf("[Queue] Failed to record sent count results: %v\n", err)
+		return err
+	}
+	q.deadLetters = append(q.deadLetters, rejected...)
+
+	sent := make(map[string]bool, len(done))
+	for _, id := range done {
+		sent[id] = true
+	}
+	remaining := q.countResults[:0]
+	for _, r := range q.countResults {
+		if !sent[r.ID] {
+			remaining = append(remaining, r)
+		}
+	}
+	q.countResults = remaining
+	log.Printf("[Queue] Sent %d count results, rejected %d, %d still pending\n", len(done)-len(rejected), len(rejected), len(q.countResults))
+	return stopErr
+}
+
+func rejectCountResult(r CountResult, err error) DeadLetter {
+	log.Printf("[Queue] Count result for task %d rejected, moving to dead letters: %v\n", r.TaskID, err)
+	dl := newDeadLetter(Commit{}, err)
+	dl.CountResult = &r
+	return dl
+}
+
+// ResubmitCountResult moves a rejected count result back to the queue as it
+// was, for when the server rejected it because of something fixed since.
+func (q *Queue) ResubmitCountResult(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	idx := q.deadLetterIndex(id)
+	if idx < 0 || q.deadLetters[idx].CountResult == nil {
+		return ErrDeadLetterNotFound
+	}
+	r := *q.deadLetters[idx].CountResult
+
+	err := q.db.Update(func(tx *storage.Tx) error {
+		if err := tx.Append(storage.ListCountResults, r.ID, r); err != nil {
+			return err
+		}
+		return tx.Remove(storage.ListDeadLetters, r.ID)
+	})
+	if err != nil {
+		return fmt.Errorf("requeue count result: %w", err)
+	}
+	q.countResults = append(q.countResults, r)
+	q.removeDeadLetters(idx)
+	q.notifyLocked()
+
+	log.Printf("[Queue] Rejected count result %s for task %d resubmitted\n", id, r.TaskID)
+	q.Flush()
+	return nil
+}
@@ -0,0 +1,109 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/larkin1/wmsproject/internal/api"
+)
+
+func TestCountResultQueuedWithAdjustments(t *testing.T) {
+	q, fake, db := newTestQueue(t)
+
+	counted := 7
+	r, err := q.SubmitCountResult(CountResult{TaskID: 9, Lines: []api.CountLine{{ItemID: 1, Expected: 5, Counted: 7}}},
+		[]Commit{{Location: "A1", ItemID: 1, Delta: 2, Kind: KindCountAdjustment, CountedQty: &counted, CountTaskID: 9}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewQueue(fake, db, "device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reopened.CountTaskDone(9) {
+		t.Fatal("count result not stored")
+	}
+	reopened.mu.RLock()
+	pending := reopened.pending
+	reopened.mu.RUnlock()
+	if len(pending) != 1 || pending[0].ID == "" || !pending[0].CapturedAt.Equal(r.CapturedAt) || pending[0].DeviceID != "device-1" {
+		t.Fatalf("pending = %+v, want the adjustment stamped with the result's capture time", pending)
+	}
+	if got := reopened.PendingDelta("A1", 1); got != 2 {
+		t.Fatalf("PendingDelta = %d, want 2", got)
+	}
+}
+
+func TestRejectedCountResultIsDeadLettered(t *testing.T) {
+	q, fake, _ := newTestQueue(t)
+	ctx := context.Background()
+
+	for _, task := range []int{1, 2} {
+		if _, err := q.SubmitCountResult(CountResult{TaskID: task, Lines: []api.CountLine{{ItemID: task, Counted: 1}}}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake.badItems[2] = true
+
+	if err := q.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, fake, "results 1,2", "results 1", "results 2")
+	if q.CountTaskDone(1) || q.CountTaskDone(2) {
+		t.Fatal("count results still pending")
+	}
+	dead := q.DeadLetters()
+	if len(dead) != 1 || dead[0].CountResult == nil || dead[0].CountResult.TaskID != 2 {
+		t.Fatalf("dead letters = %+v, want the result of task 2", dead)
+	}
+
+	delete(fake.badItems, 2)
+	if err := q.ResubmitCountResult(dead[0].ID()); err != nil {
+		t.Fatal(err)
+	}
+	if !q.CountTaskDone(2) {
+		t.Fatal("resubmitted result not pending")
+	}
+	if err := q.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if s := q.Status(); s.Pending != 0 || s.DeadLetters != 0 {
+		t.Fatalf("status after resubmit = %+v", s)
+	}
+}
+
+func TestCountResultRetryStopsWhenOffline(t *testing.T) {
+	q, fake, _ := newTestQueue(t)
+	ctx := context.Background()
+
+	for _, task := range []int{1, 2, 3} {
+		if _, err := q.SubmitCountResult(CountResult{TaskID: task, Lines: []api.CountLine{{ItemID: task, Counted: 1}}}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake.badItems[2] = true
+
+	// The connection drops during the one-at-a-time retry: the rest aren't
+	// tried, and nothing is dead-lettered on an unanswered request.
+	fake.failAt = 3
+	if err := q.flush(ctx); !errors.Is(err, errOffline) {
+		t.Fatalf("flush error = %v, want %v", err, errOffline)
+	}
+	checkRequests(t, fake, "results 1,2,3", "results 1", "results 2")
+	if q.CountTaskDone(1) || !q.CountTaskDone(2) || !q.CountTaskDone(3) {
+		t.Fatal("want the results of tasks 2 and 3 still pending")
+	}
+	if dead := q.DeadLetters(); len(dead) != 0 {
+		t.Fatalf("dead letters = %+v, want none", dead)
+	}
+
+	if err := q.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, fake, "results 1,2,3", "results 1", "results 2", "results 2,3", "results 2", "results 3")
+	if dead := q.DeadLetters(); len(dead) != 1 || dead[0].CountResult.TaskID != 2 {
+		t.Fatalf("dead letters = %+v, want the result of task 2", dead)
+	}
+}
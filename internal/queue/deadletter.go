@@ -0,0 +1,210 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/larkin1/wmsproject/internal/api"
+	"github.com/larkin1/wmsproject/internal/storage"
+)
+
+// DeadLetter is a commit the server rejected as invalid. It is kept out of
+// the pending queue until an operator fixes and resubmits it, or discards it.
+// A rejected location assignment or count result is kept the same way, in
+// Assignment or CountResult instead of Commit.
+type DeadLetter struct {
+	Commit      Commit       `json:"commit"`
+	Assignment  *Assignment  `json:"assignment,omitempty"`   // see assign.go
+	CountResult *CountResult `json:"count_result,omitempty"` // see count.go
+	Reason      string       `json:"reason"`
+	StatusCode  int          `json:"status_code,omitempty"`
+	Error       string       `json:"error,omitempty"` // raw PostgREST error body
+	FailedAt    time.Time    `json:"failed_at"`
+}
+
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+func newDeadLetter(commit Commit, err error) DeadLetter {
+	dl := DeadLetter{
+		Commit:   commit,
+		Reason:   err.Error(),
+		FailedAt: time.Now().UTC(),
+	}
+	var apiErr *api.APIError
+	if errors.As(err, &apiErr) {
+		dl.StatusCode = apiErr.StatusCode
+		dl.Error = apiErr.Body
+		if apiErr.Message != "" {
+			dl.Reason = apiErr.Message
+			if apiErr.Details != "" {
+				dl.Reason += ": " + apiErr.Details
+			}
+		}
+	}
+	return dl
+}
+
+// ID returns the ID of the rejected commit, assignment or count result.
+func (dl DeadLetter) ID() string {
+	switch {
+	case dl.Assignment != nil:
+		return dl.Assignment.ID
+	case dl.CountResult != nil:
+		return dl.CountResult.ID
+	}
+	return dl.Commit.ID
+}
+
+func (dl DeadLetter) isCommit() bool {
+	return dl.Assignment == nil && dl.CountResult == nil
+}
+
+// DeadLetters returns the rejected commits, assignments and count results,
+// oldest first.
+func (q *Queue) DeadLetters() []DeadLetter {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	out := make([]DeadLetter, len(q.deadLetters))
+	copy(out, q.deadLetters)
+	return out
+}
+
+// ResubmitDeadLetter moves a rejected commit back to the pending queue with
+// the given corrections. The commit keeps its ID, since the server never
+// stored it, and its transfer or document. The rest of that transfer or
+// document is requeued with it as it was, in its original order.
+func (q *Queue) ResubmitDeadLetter(id string, edited Commit) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	idx := q.deadLetterIndex(id)
+	if idx < 0 || !q.deadLetters[idx].isCommit() {
+		return ErrDeadLetterNotFound
+	}
+
+	orig := q.deadLetters[idx].Commit
+	edited.ID = orig.ID
+	edited.CapturedAt = orig.CapturedAt
+	if edited.DeviceID == "" {
+		edited.DeviceID = orig.DeviceID
+	}
+	edited.TransferID = orig.TransferID
+	edited.Document = orig.Document
+
+	idxs := append([]int{idx}, q.groupSiblings(idx)...)
+	sort.Ints(idxs)
+	var requeue []Commit
+	for _, i := range idxs {
+		if i == idx {
+			requeue = append(requeue, edited)
+		} else {
+			requeue = append(requeue, q.deadLetters[i].Commit)
+		}
+	}
+
+	err := q.db.Update(func(tx *storage.Tx) error {
+		for _, commit := range requeue {
+			if err := tx.Append(storage.ListPending, commit.ID, commit); err != nil {
+				return err
+			}
+			if err := tx.Remove(storage.ListDeadLetters, commit.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("requeue commit: %w", err)
+	}
+	q.pending = append(q.pending, requeue...)
+	q.removeDeadLetters(idxs...)
+	q.notifyLocked()
+
+	log.Printf("[Queue] Dead letter %s resubmitted: %+v\n", id, edited)
+	q.Flush()
+	return nil
+}
+
+// DiscardDeadLetter permanently drops a rejected commit, along with the rest
+// of its transfer or document, or a rejected assignment or count result.
+func (q *Queue) DiscardDeadLetter(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	idx := q.deadLetterIndex(id)
+	if idx < 0 {
+		return ErrDeadLetterNotFound
+	}
+	idxs := append([]int{idx}, q.groupSiblings(idx)...)
+	ids := make([]string, len(idxs))
+	for i, di := range idxs {
+		ids[i] = q.deadLetters[di].ID()
+	}
+	err := q.db.Update(func(tx *storage.Tx) error {
+		return tx.Remove(storage.ListDeadLetters, ids...)
+	})
+	if err != nil {
+		return err
+	}
+	q.removeDeadLetters(idxs...)
+	q.notifyLocked()
+
+	log.Printf("[Queue] Dead letter %s discarded\n", id)
+	return nil
+}
+
+func (q *Queue) deadLetterIndex(id string) int {
+	for i, dl := range q.deadLetters {
+		if dl.ID() == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// isolateRejected finds the offending commits in a chunk the server rejected
+// as a whole by resending it in halves. It returns the commits that went
+// through and the ones rejected permanently. A half that gets no answer stops
+// it with that error, so it and what follows stay pending in order.
+func (q *Queue) isolateRejected(ctx context.Context, chunk []api.CommitPayload, err error) (sent []api.CommitPayload, rejected []DeadLetter, netErr error) {
+	if len(chunk) == 1 {
+		return nil, []DeadLetter{newDeadLetter(q.commitByID(chunk[0].UUID), err)}, nil
+	}
+
+	mid := len(chunk) / 2
+	for _, half := range [][]api.CommitPayload{chunk[:mid], chunk[mid:]} {
+		// half is never larger than a chunk, so this is a single request.
+		res := q.api.SendCommits(ctx, half)[0]
+		switch {
+		case res.Err == nil:
+			sent = append(sent, half...)
+		case api.IsPermanent(res.Err):
+			s, r, err := q.isolateRejected(ctx, half, res.Err)
+			sent = append(sent, s...)
+			rejected = append(rejected, r...)
+			if err != nil {
+				return sent, rejected, err
+			}
+		default:
+			return sent, rejected, res.Err
+		}
+	}
+	return sent, rejected, nil
+}
+
+func (q *Queue) commitByID(id string) Commit {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	for _, commit := range q.pending {
+		if commit.ID == id {
+			return commit
+		}
+	}
+	return Commit{ID: id}
+}
@@ -0,0 +1,74 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestFlushIsolatesRejectedCommits(t *testing.T) {
+	q, fake, _ := newTestQueue(t)
+	ctx := context.Background()
+	fake.batchSize = 4
+	fake.badItems[3] = true
+	for id := 1; id <= 6; id++ {
+		submit(t, q, id, 1)
+	}
+
+	if err := q.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// The rejected first chunk is halved until the bad commit is alone, and
+	// only then is the chunk after it sent.
+	checkRequests(t, fake, "commits 1,2,3,4", "commits 1,2", "commits 3,4", "commits 3", "commits 4", "commits 5,6")
+	if got := items(fake.stored); got != "1,2,4,5,6" {
+		t.Fatalf("stored %s, want everything but item 3, in order", got)
+	}
+	if got := pendingItems(q); len(got) != 0 {
+		t.Fatalf("pending = %v, want none", got)
+	}
+	dead := q.DeadLetters()
+	if len(dead) != 1 || dead[0].Commit.ItemID != 3 || dead[0].StatusCode != 422 || dead[0].Reason != "unknown item 3" {
+		t.Fatalf("dead letters = %+v, want the commit for item 3", dead)
+	}
+}
+
+func TestIsolationStopsAtUnansweredHalf(t *testing.T) {
+	q, fake, _ := newTestQueue(t)
+	ctx := context.Background()
+	fake.batchSize = 4
+	fake.badItems[3] = true
+	for id := 1; id <= 4; id++ {
+		submit(t, q, id, 1)
+	}
+	if _, _, err := q.SubmitTransfer(Commit{Location: "A1", ItemID: 9, Delta: -1}, Commit{Location: "B1", ItemID: 9, Delta: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The half holding the bad commit gets no answer, so nothing in it is
+	// dead-lettered on a guess, and the transfer queued after it waits.
+	fake.failAt = 3
+	if err := q.flush(ctx); !errors.Is(err, errOffline) {
+		t.Fatalf("flush error = %v, want %v", err, errOffline)
+	}
+	checkRequests(t, fake, "commits 1,2,3,4", "commits 1,2", "commits 3,4")
+	if got := fmt.Sprint(pendingItems(q)); got != "[3 4 9 9]" {
+		t.Fatalf("pending = %s, want the unanswered half and the transfer", got)
+	}
+	if dead := q.DeadLetters(); len(dead) != 0 {
+		t.Fatalf("dead letters = %+v, want none", dead)
+	}
+
+	if err := q.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, fake, "commits 1,2,3,4", "commits 1,2", "commits 3,4",
+		"commits 3,4", "commits 3", "commits 4", "transfer 9,9")
+	if got := pendingItems(q); len(got) != 0 {
+		t.Fatalf("pending = %v, want none", got)
+	}
+	if dead := q.DeadLetters(); len(dead) != 1 || dead[0].Commit.ItemID != 3 {
+		t.Fatalf("dead letters = %+v, want the commit for item 3", dead)
+	}
+}
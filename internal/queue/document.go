@@ -0,0 +1,103 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/larkin1/wmsproject/internal/api"
+	"github.com/larkin1/wmsproject/internal/storage"
+)
+
+// Document is the header of a multi-line commit, such as a received pallet.
+// Every line carries it, so a line read back from the queue or the dead
+// letters always has what is needed to send its document again.
+type Document struct {
+	ID        string `json:"id"`
+	Reason    string `json:"reason,omitempty"`
+	Reference string `json:"reference,omitempty"` // e.g. a delivery note number
+}
+
+func (d *Document) id() string {
+	if d == nil {
+		return ""
+	}
+	return d.ID
+}
+
+var ErrEmptyDocument = errors.New("document has no lines")
+
+// SubmitDocument queues lines as one document. Each line gets its own ID
+// and the document's header and capture time, and all are stored in one
+// transaction; the queue then sends them in one request that the server
+// applies all or nothing.
+func (q *Queue) SubmitDocument(doc Document, lines []Commit) ([]Commit, error) {
+	return q.submitDocument(doc, lines, nil)
+}
+
+// submitDocument is SubmitDocument, running also in the transaction that
+// stores the lines, if set.
+func (q *Queue) submitDocument(doc Document, lines []Commit, also func(tx *storage.Tx) error) ([]Commit, error) {
+	if len(lines) == 0 {
+		return nil, ErrEmptyDocument
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	doc.ID = uuid.NewString()
+	capturedAt := time.Now().UTC()
+	queued := make([]Commit, len(lines))
+	for i, line := range lines {
+		line.ID = uuid.NewString()
+		line.CapturedAt = capturedAt
+		line.Document = &doc
+		if line.DeviceID == "" {
+			line.DeviceID = q.deviceID
+		}
+		queued[i] = line
+	}
+
+	err := q.db.Update(func(tx *storage.Tx) error {
+		for _, line := range queued {
+			if err := tx.Append(storage.ListPending, line.ID, line); err != nil {
+				return err
+			}
+		}
+		if also != nil {
+			return also(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[Queue] Failed to store document: %v\n", err)
+		return nil, err
+	}
+	q.pending = append(q.pending, queued...)
+	q.notifyLocked()
+
+	log.Printf("[Queue] Document %s queued with %d lines (reason %q, reference %q)\n", doc.ID, len(queued), doc.Reason, doc.Reference)
+	q.Flush()
+	return queued, nil
+}
+
+// sendDocument sends the lines of one document with its header, which comes
+// from the first line.
+func (q *Queue) sendDocument(ctx context.Context, lines []api.CommitPayload) error {
+	first := q.commitByID(lines[0].UUID)
+	doc := first.Document
+	if doc == nil {
+		doc = &Document{ID: lines[0].DocumentID}
+	}
+	return q.api.SendDocument(ctx, api.DocumentPayload{
+		UUID:       doc.ID,
+		CapturedAt: first.CapturedAt,
+		DeviceID:   first.DeviceID,
+		OperatorID: first.OperatorID,
+		Reason:     doc.Reason,
+		Reference:  doc.Reference,
+		Lines:      lines,
+	})
+}
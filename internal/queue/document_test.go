@@ -0,0 +1,105 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func submitDocument(t *testing.T, q *Queue, itemIDs ...int) []Commit {
+	t.Helper()
+	var lines []Commit
+	for _, id := range itemIDs {
+		lines = append(lines, Commit{Location: "A1", ItemID: id, Delta: 1})
+	}
+	queued, err := q.SubmitDocument(Document{Reason: "delivery", Reference: "PO-1"}, lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queued
+}
+
+func deadItems(q *Queue) string {
+	var ids []int
+	for _, dl := range q.DeadLetters() {
+		ids = append(ids, dl.Commit.ItemID)
+	}
+	return fmt.Sprint(ids)
+}
+
+func TestRejectedDocumentIsDeadLetteredWhole(t *testing.T) {
+	q, fake, db := newTestQueue(t)
+	ctx := context.Background()
+	fake.badItems[6] = true
+
+	lines := submitDocument(t, q, 5, 6, 7)
+	submit(t, q, 8, 1)
+	if err := q.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, fake, "document 5,6,7", "commits 8")
+	if got := items(fake.stored); got != "8" {
+		t.Fatalf("stored %s, want none of the document", got)
+	}
+	if got := deadItems(q); got != "[5 6 7]" {
+		t.Fatalf("dead letters = %s, want every line", got)
+	}
+	for _, dl := range q.DeadLetters() {
+		if dl.StatusCode != 422 || dl.Commit.Document == nil || dl.Commit.Document.ID != lines[0].Document.ID {
+			t.Fatalf("dead letter = %+v, want a line of the rejected document", dl)
+		}
+	}
+
+	// Fixing the bad line requeues the whole document, in its order.
+	fake.badItems[6] = false
+	if err := q.ResubmitDeadLetter(lines[1].ID, Commit{Location: "A1", ItemID: 9, Delta: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got := deadItems(q); got != "[]" {
+		t.Fatalf("dead letters after resubmit = %s, want none", got)
+	}
+	reopened, err := NewQueue(fake, db, "device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(pendingItems(reopened)); got != "[5 9 7]" {
+		t.Fatalf("pending after restart = %s, want the corrected document", got)
+	}
+	if err := reopened.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, fake, "document 5,6,7", "commits 8", "document 5,9,7")
+}
+
+func TestDiscardingDocumentLineDiscardsDocument(t *testing.T) {
+	q, fake, db := newTestQueue(t)
+	ctx := context.Background()
+	fake.badItems[6] = true
+
+	lines := submitDocument(t, q, 5, 6)
+	submitDocument(t, q, 6, 7)
+	if err := q.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := deadItems(q); got != "[5 6 6 7]" {
+		t.Fatalf("dead letters = %s, want both documents", got)
+	}
+
+	// Only the first document goes; the second is left to review.
+	if err := q.DiscardDeadLetter(lines[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := deadItems(q); got != "[6 7]" {
+		t.Fatalf("dead letters after discard = %s, want the second document", got)
+	}
+	reopened, err := NewQueue(fake, db, "device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := deadItems(reopened); got != "[6 7]" {
+		t.Fatalf("dead letters after restart = %s", got)
+	}
+	if err := q.DiscardDeadLetter(lines[1].ID); err != ErrDeadLetterNotFound {
+		t.Fatalf("discarding a discarded line = %v, want ErrDeadLetterNotFound", err)
+	}
+}
@@ -0,0 +1,142 @@
+package queue
+
+import (
+	"context"
+
+	"github.com/larkin1/wmsproject/internal/api"
+)
+
+// Transfers and documents are groups of commits that the server must store
+// all or nothing. They are queued like any commit, so PendingDelta and the
+// recent list see each one, but sent a group per request, and dead-lettered,
+// resubmitted and discarded as a group. They keep their place in the queue:
+// the commits queued before a group are sent before it, and those queued after
+// it wait until it got an answer.
+
+// group returns the ID shared by commits that must be sent together: the
+// transfer or document they belong to, or "" for a plain commit.
+func group(p api.CommitPayload) string {
+	if p.TransferID != "" {
+		return p.TransferID
+	}
+	return p.DocumentID
+}
+
+// batch is a run of plain commits sent in bulk, or the commits of one
+// transfer or document sent as one request.
+type batch struct {
+	commits []api.CommitPayload
+	grouped bool
+}
+
+// splitBatches cuts the queue into batches in the order it was queued: each
+// run of plain commits ends where a transfer or document starts. A group is
+// placed where its first commit was queued.
+func splitBatches(payloads []api.CommitPayload) []batch {
+	var batches []batch
+	index := make(map[string]int)
+	for _, p := range payloads {
+		id := group(p)
+		if id == "" {
+			if n := len(batches); n > 0 && !batches[n-1].grouped {
+				batches[n-1].commits = append(batches[n-1].commits, p)
+			} else {
+				batches = append(batches, batch{commits: []api.CommitPayload{p}})
+			}
+			continue
+		}
+		i, ok := index[id]
+		if !ok {
+			i = len(batches)
+			index[id] = i
+			batches = append(batches, batch{grouped: true})
+		}
+		batches[i].commits = append(batches[i].commits, p)
+	}
+	return batches
+}
+
+// sendGroup sends a transfer or document as one request. A group the server
+// rejects is dead-lettered whole; any other failure leaves it pending.
+func (q *Queue) sendGroup(ctx context.Context, commits []api.CommitPayload) (sent []api.CommitPayload, rejected []DeadLetter, err error) {
+	if commits[0].TransferID != "" {
+		err = q.api.SendTransfer(ctx, commits)
+	} else {
+		err = q.sendDocument(ctx, commits)
+	}
+	switch {
+	case err == nil:
+		return commits, nil, nil
+	case api.IsPermanent(err):
+		for _, p := range commits {
+			rejected = append(rejected, newDeadLetter(q.commitByID(p.UUID), err))
+		}
+		return nil, rejected, nil
+	default:
+		return nil, nil, err
+	}
+}
+
+// sendPlain sends a run of plain commits in bulk, in order. A chunk the
+// server rejected is resent in halves to find the bad commits before anything
+// after it is sent; any other failure leaves it and the rest pending, and is
+// returned.
+func (q *Queue) sendPlain(ctx context.Context, commits []api.CommitPayload) (sent []api.CommitPayload, rejected []DeadLetter, err error) {
+	for len(commits) > 0 {
+		var failed *api.ChunkResult
+		for _, res := range q.api.SendCommits(ctx, commits) {
+			if res.Err != nil {
+				failed = &res
+				break
+			}
+			sent = append(sent, res.Commits...)
+			commits = commits[len(res.Commits):]
+		}
+		if failed == nil {
+			break
+		}
+		if !api.IsPermanent(failed.Err) {
+			return sent, rejected, failed.Err
+		}
+
+		s, r, err := q.isolateRejected(ctx, failed.Commits, failed.Err)
+		sent = append(sent, s...)
+		rejected = append(rejected, r...)
+		if err != nil {
+			return sent, rejected, err
+		}
+		commits = commits[len(failed.Commits):]
+	}
+	return sent, rejected, nil
+}
+
+// groupSiblings returns the indexes of the other dead letters of the
+// transfer or document the dead letter at idx belongs to, if any.
+func (q *Queue) groupSiblings(idx int) []int {
+	id := group(q.deadLetters[idx].Commit.Payload())
+	if id == "" {
+		return nil
+	}
+	var siblings []int
+	for i, dl := range q.deadLetters {
+		if i != idx && group(dl.Commit.Payload()) == id {
+			siblings = append(siblings, i)
+		}
+	}
+	return siblings
+}
+
+// removeDeadLetters drops the dead letters at the given indexes from memory.
+func (q *Queue) removeDeadLetters(idxs ...int) {
+	drop := make(map[int]bool, len(idxs))
+	for _, i := range idxs {
+		drop[i] = true
+	}
+	remaining := q.deadLetters[:0]
+	for i, dl := range q.deadLetters {
+		if !drop[i] {
+			remaining = append(remaining, dl)
+		}
+	}
+	q.deadLetters = remaining
+}
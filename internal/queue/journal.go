@@ -0,0 +1,157 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/larkin1/wmsproject/internal/securefile"
+)
+
+// Before the queue moved into the database, older versions kept it in an
+// append-only journal. Each line is
+//
+//	<crc32c as 8 hex digits> <record>\n
+//
+// where the record is JSON, usually encrypted with the device key and base64
+// encoded. This file only reads such journals so they can be imported; a
+// torn or corrupted line only loses that one record, and is moved to a
+// .corrupt file next to the journal.
+
+const (
+	opPut    = "put"
+	opDelete = "del"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type journalRecord struct {
+	Op   string          `json:"op"`
+	ID   string          `json:"id"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type journalEntry struct {
+	ID   string
+	Data json.RawMessage
+}
+
+// readJournal replays a journal and returns the live entries in insertion
+// order. Lines that fail their checksum are quarantined to corruptPath.
+func readJournal(data []byte, unseal func([]byte) ([]byte, error), corruptPath string) ([]journalEntry, error) {
+	var order []string
+	live := make(map[string]json.RawMessage)
+	var corrupt [][]byte
+	readable, undecryptable := 0, 0
+
+	reader := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			rec, decErr := decodeRecord(line, unseal)
+			if decErr == securefile.ErrDecrypt {
+				undecryptable++
+			}
+			if decErr != nil {
+				corrupt = append(corrupt, line)
+			} else {
+				readable++
+				switch rec.Op {
+				case opPut:
+					if _, exists := live[rec.ID]; !exists {
+						order = append(order, rec.ID)
+					}
+					live[rec.ID] = rec.Data
+				case opDelete:
+					delete(live, rec.ID)
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if undecryptable > 0 && readable == 0 {
+		// Every record has a valid checksum but none decrypts: this is the
+		// wrong key, not damage. Leave the file alone.
+		return nil, securefile.ErrDecrypt
+	}
+
+	if len(corrupt) > 0 {
+		log.Printf("[Queue] %d corrupt journal record(s), quarantining to %s\n", len(corrupt), corruptPath)
+		if err := quarantine(corruptPath, corrupt); err != nil {
+			return nil, fmt.Errorf("quarantine corrupt journal records: %w", err)
+		}
+	}
+
+	entries := make([]journalEntry, 0, len(live))
+	for _, id := range order {
+		if data, ok := live[id]; ok {
+			entries = append(entries, journalEntry{ID: id, Data: data})
+			delete(live, id) // an ID put twice is only returned once
+		}
+	}
+	return entries, nil
+}
+
+var errBadRecord = errors.New("bad journal record")
+
+func decodeRecord(line []byte, unseal func([]byte) ([]byte, error)) (journalRecord, error) {
+	var rec journalRecord
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) < 10 || line[8] != ' ' {
+		return rec, errBadRecord
+	}
+	sum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	if err != nil {
+		return rec, errBadRecord
+	}
+	body := line[9:]
+	if crc32.Checksum(body, crcTable) != uint32(sum) {
+		return rec, errBadRecord
+	}
+
+	if body[0] != '{' {
+		sealed, err := base64.StdEncoding.DecodeString(string(body))
+		if err != nil {
+			return rec, errBadRecord
+		}
+		body, err = unseal(sealed)
+		if err != nil {
+			return rec, securefile.ErrDecrypt
+		}
+	}
+
+	if err := json.Unmarshal(body, &rec); err != nil || rec.ID == "" {
+		return rec, errBadRecord
+	}
+	return rec, nil
+}
+
+func quarantine(path string, lines [][]byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "# quarantined %s\n", time.Now().UTC().Format(time.RFC3339))
+	for _, line := range lines {
+		f.Write(bytes.TrimRight(line, "\n"))
+		f.Write([]byte("\n"))
+	}
+	return f.Sync()
+}
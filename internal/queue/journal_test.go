@@ -0,0 +1,151 @@
+package queue
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/larkin1/wmsproject/internal/securefile"
+)
+
+// journalLine encodes a record the way older versions wrote it, sealed if
+// seal is set.
+func journalLine(t *testing.T, rec journalRecord, seal func([]byte) []byte) string {
+	t.Helper()
+	body, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seal != nil {
+		body = []byte(base64.StdEncoding.EncodeToString(seal(body)))
+	}
+	return fmt.Sprintf("%08x %s\n", crc32.Checksum(body, crcTable), body)
+}
+
+func putRecord(id string, delta int) journalRecord {
+	return journalRecord{Op: opPut, ID: id, Data: json.RawMessage(fmt.Sprintf(`{"id":%q,"location":"A1","item_id":1,"delta":%d}`, id, delta))}
+}
+
+func TestReadJournalQuarantinesDamagedLines(t *testing.T) {
+	corruptPath := filepath.Join(t.TempDir(), "pending_commits.journal.corrupt")
+	noUnseal := func([]byte) ([]byte, error) { return nil, securefile.ErrDecrypt }
+
+	bad := journalLine(t, putRecord("c", 3), nil)
+	bad = strings.Replace(bad, `"delta":3`, `"delta":9`, 1) // checksum no longer matches
+	journal := journalLine(t, putRecord("a", 1), nil) +
+		journalLine(t, putRecord("b", 2), nil) +
+		bad +
+		journalLine(t, putRecord("a", 5), nil) + // a later put replaces the data but keeps the order
+		journalLine(t, journalRecord{Op: opDelete, ID: "b"}, nil) +
+		journalLine(t, putRecord("d", 4), nil) +
+		`1234abcd {"op":"put","id":"e"` // torn by a power cut
+
+	entries, err := readJournal([]byte(journal), noUnseal, corruptPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		var c Commit
+		if err := json.Unmarshal(e.Data, &c); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s:%d", e.ID, c.Delta))
+	}
+	if strings.Join(got, " ") != "a:5 d:4" {
+		t.Fatalf("entries = %v, want a:5 d:4", got)
+	}
+
+	quarantined, err := os.ReadFile(corruptPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(quarantined)), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "# quarantined ") ||
+		lines[1] != strings.TrimSpace(bad) || !strings.Contains(lines[2], `"id":"e"`) {
+		t.Fatalf("quarantine file:\n%s", quarantined)
+	}
+}
+
+func TestReadJournalWithWrongKeyLeavesItAlone(t *testing.T) {
+	dir := t.TempDir()
+	files, err := securefile.Open(filepath.Join(dir, "device.key"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := securefile.Open(filepath.Join(dir, "other.key"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal := journalLine(t, putRecord("a", 1), files.Seal) + journalLine(t, putRecord("b", 2), files.Seal)
+	corruptPath := filepath.Join(dir, "pending_commits.journal.corrupt")
+
+	if _, err := readJournal([]byte(journal), other.Unseal, corruptPath); !errors.Is(err, securefile.ErrDecrypt) {
+		t.Fatalf("readJournal error = %v, want %v", err, securefile.ErrDecrypt)
+	}
+	if _, err := os.Stat(corruptPath); !os.IsNotExist(err) {
+		t.Fatalf("quarantine file exists after a wrong key: %v", err)
+	}
+
+	entries, err := readJournal([]byte(journal), files.Unseal, corruptPath)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("readJournal with the right key = %v, %v", entries, err)
+	}
+}
+
+func TestNewQueueImportsLegacyJournals(t *testing.T) {
+	fake := newFakeBackend()
+	db := openTestDB(t)
+	files, err := securefile.Open(db.Path("device.key"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending := journalLine(t, putRecord("a", 1), files.Seal) +
+		"garbage\n" +
+		journalLine(t, putRecord("b", 2), files.Seal)
+	dead, err := json.Marshal(DeadLetter{Commit: Commit{ID: "x", Location: "A1", ItemID: 9, Delta: 1}, Reason: "unknown item 9"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLetters := journalLine(t, journalRecord{Op: opPut, ID: "x", Data: dead}, files.Seal)
+	for name, data := range map[string]string{"pending_commits.journal": pending, "dead_letter.journal": deadLetters} {
+		if err := os.WriteFile(db.Path(name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q, err := NewQueue(fake, db, "device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(pendingItems(q)); got != "[1 1]" || q.PendingDelta("A1", 1) != 3 {
+		t.Fatalf("pending items = %s, delta %d; want both commits", got, q.PendingDelta("A1", 1))
+	}
+	if d := q.DeadLetters(); len(d) != 1 || d[0].ID() != "x" {
+		t.Fatalf("dead letters = %+v", d)
+	}
+	for _, name := range []string{"pending_commits.journal", "dead_letter.journal"} {
+		if _, err := os.Stat(db.Path(name)); !os.IsNotExist(err) {
+			t.Fatalf("%s still exists after import: %v", name, err)
+		}
+	}
+	if data, err := os.ReadFile(db.Path("pending_commits.journal.corrupt")); err != nil || !strings.Contains(string(data), "garbage") {
+		t.Fatalf("quarantine file = %q, %v", data, err)
+	}
+
+	// Importing twice would queue the commits twice.
+	reopened, err := NewQueue(fake, db, "device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(pendingItems(reopened)); got != 2 {
+		t.Fatalf("pending after reopen = %d, want 2", got)
+	}
+}
@@ -1,40 +1,175 @@
 package queue
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net"
+	"log"
+	"math/rand"
 	"os"
-	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/larkin1/wmsproject/internal/api"
+	"github.com/larkin1/wmsproject/internal/storage"
 )
 
+// Commit is a single stock movement waiting to be sent. ID and CapturedAt are
+// assigned once when the commit is submitted and never change on retry.
 type Commit struct {
-	DeviceID string `json:"device_id"`
-	Location string `json:"location"`
-	Delta    int    `json:"delta"`
-	ItemID   int    `json:"item_id"`
+	ID         string    `json:"id"`
+	CapturedAt time.Time `json:"captured_at"`
+	DeviceID   string    `json:"device_id"`
+	OperatorID int       `json:"operator_id,omitempty"`
+	Location   string    `json:"location"`
+	Delta      int       `json:"delta"`
+	ItemID     int       `json:"item_id"`
+	Overrides  []string  `json:"overrides,omitempty"` // checks the operator chose to bypass
+	// SupervisorID is set when an override needed a supervisor's PIN.
+	SupervisorID int `json:"supervisor_id,omitempty"`
+	// TransferID is shared by the two legs of a transfer; see transfer.go.
+	TransferID string `json:"transfer_id,omitempty"`
+	// Kind is KindCountAdjustment for counts, whose Delta is CountedQty
+	// minus the quantity the device expected. CountTaskID is set for counts
+	// made for a count task; see count.go.
+	Kind        string `json:"kind,omitempty"`
+	CountedQty  *int   `json:"counted_qty,omitempty"`
+	CountTaskID int    `json:"count_task_id,omitempty"`
+	// VoidOf is the commit a KindVoid commit reverses, for VoidReason.
+	VoidOf     string `json:"void_of,omitempty"`
+	VoidReason string `json:"void_reason,omitempty"`
+	// Document is the header of the document the commit is a line of.
+	Document *Document `json:"document,omitempty"`
+	// ReceiptRef is the purchase order or ASN the stock was received against.
+	ReceiptRef string `json:"receipt_ref,omitempty"`
+}
+
+// Commit kinds other than plain movements.
+const (
+	KindCountAdjustment = "count_adjustment" // corrects stock to a physical count
+	KindVoid            = "void"             // reverses an earlier commit; see recent.go
+)
+
+// Overrides recorded on a commit.
+const (
+	OverrideNegativeStockConfirmed = "negative_stock_confirmed"
+	OverrideNegativeStockAllowed   = "negative_stock_allowed"
+	OverrideStockUnknownConfirmed  = "stock_unknown_confirmed"  // removal made before the stock was ever fetched
+	OverrideUnassignedItem         = "unassigned_item_approved" // scanned item not assigned to the location
+	OverrideCountVarianceApproved  = "count_variance_approved"  // count task variance above the campaign threshold
+	OverrideOverReceiptConfirmed   = "over_receipt_confirmed"   // received more than the receipt expects
+)
+
+// Payload converts the commit into the API representation.
+func (c Commit) Payload() api.CommitPayload {
+	return api.CommitPayload{
+		UUID:         c.ID,
+		CapturedAt:   c.CapturedAt,
+		DeviceID:     c.DeviceID,
+		OperatorID:   c.OperatorID,
+		Location:     c.Location,
+		Delta:        c.Delta,
+		ItemID:       c.ItemID,
+		Overrides:    c.Overrides,
+		SupervisorID: c.SupervisorID,
+		TransferID:   c.TransferID,
+		Kind:         c.Kind,
+		CountedQty:   c.CountedQty,
+		CountTaskID:  c.CountTaskID,
+		VoidOf:       c.VoidOf,
+		VoidReason:   c.VoidReason,
+		DocumentID:   c.Document.id(),
+		ReceiptRef:   c.ReceiptRef,
+	}
 }
 
 type Queue struct {
-	api           *api.Client
-	filePath      string
+	api           api.Backend
+	deviceID      string
+	db            *storage.DB
 	checkInterval time.Duration
+	maxBackoff    time.Duration
+	pending       []Commit
+	assignments   []Assignment  // see assign.go
+	countResults  []CountResult // see count.go
+	deadLetters   []DeadLetter
+	kick          chan struct{}
 	stopChan      chan struct{}
+	ctx           context.Context // cancelled by Stop to abort requests in flight
+	cancel        context.CancelFunc
 	wg            sync.WaitGroup
 	mu            sync.RWMutex
+
+	// Sync state reported by Status; see status.go.
+	syncing     bool
+	online      bool
+	lastSync    time.Time
+	lastAttempt time.Time
+	lastError   string
+	subscribers map[int]chan Status
+	nextSubID   int
 }
 
-func NewQueue(apiClient *api.Client, basePath string) *Queue {
-	return &Queue{
+// NewQueue loads the pending commits and dead letters left in db by a
+// previous run. The queue files older versions kept next to the executable
+// are imported first and then deleted. Commits submitted without a device ID
+// are stamped with deviceID.
+func NewQueue(apiClient api.Backend, db *storage.DB, deviceID string) (*Queue, error) {
+	q := &Queue{
 		api:           apiClient,
-		filePath:      filepath.Join(basePath, "pending_commits.json"),
+		deviceID:      deviceID,
+		db:            db,
 		checkInterval: 5 * time.Second,
+		maxBackoff:    5 * time.Minute,
+		kick:          make(chan struct{}, 1),
 		stopChan:      make(chan struct{}),
+		subscribers:   make(map[int]chan Status),
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+
+	if err := q.importLegacy(); err != nil {
+		return nil, err
+	}
+
+	err := db.View(func(tx *storage.Tx) error {
+		pending, err := tx.Records(storage.ListPending)
+		if err != nil {
+			return err
+		}
+		for _, rec := range pending {
+			var commit Commit
+			if err := json.Unmarshal(rec.Data, &commit); err != nil {
+				log.Printf("[Queue] Skipping unreadable commit %s: %v\n", rec.ID, err)
+				continue
+			}
+			q.pending = append(q.pending, commit)
+		}
+
+		dead, err := tx.Records(storage.ListDeadLetters)
+		if err != nil {
+			return err
+		}
+		for _, rec := range dead {
+			var dl DeadLetter
+			if err := json.Unmarshal(rec.Data, &dl); err != nil {
+				log.Printf("[Queue] Skipping unreadable dead letter %s: %v\n", rec.ID, err)
+				continue
+			}
+			q.deadLetters = append(q.deadLetters, dl)
+		}
+		if err := q.loadAssignments(tx); err != nil {
+			return err
+		}
+		return q.loadCountResults(tx)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("load queue: %w", err)
 	}
+
+	log.Printf("[Queue] Recovered %d pending commits, %d dead letters, %d assignments, %d count results\n", len(q.pending), len(q.deadLetters), len(q.assignments), len(q.countResults))
+	return q, nil
 }
 
 func (q *Queue) Start() {
@@ -43,97 +178,348 @@ func (q *Queue) Start() {
 }
 
 func (q *Queue) Stop() {
+	q.cancel()
 	close(q.stopChan)
 	q.wg.Wait()
 }
 
-func (q *Queue) SubmitCommit(deviceID, location string, delta, itemID int) {
+// SubmitCommit assigns the commit its ID and capture time and queues it. It
+// returns only after the commit is committed to the database.
+func (q *Queue) SubmitCommit(commit Commit) (Commit, error) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
-	commit := Commit{
-		DeviceID: deviceID,
-		Location: location,
-		Delta:    delta,
-		ItemID:   itemID,
+	commit.ID = uuid.NewString()
+	commit.CapturedAt = time.Now().UTC()
+	if commit.DeviceID == "" {
+		commit.DeviceID = q.deviceID
+	}
+
+	err := q.db.Update(func(tx *storage.Tx) error {
+		return tx.Append(storage.ListPending, commit.ID, commit)
+	})
+	if err != nil {
+		log.Printf("[Queue] Failed to store commit: %v\n", err)
+		return commit, err
 	}
+	q.pending = append(q.pending, commit)
+	q.notifyLocked()
 
-	queue := q.loadQueue()
-	queue = append(queue, commit)
-	q.saveQueue(queue)
+	log.Printf("[Queue] Commit queued: %+v\n", commit)
+	q.Flush()
+	return commit, nil
+}
 
-	fmt.Printf("Commit queued: %+v\n", commit)
+// Flush asks the worker to try sending pending commits now instead of waiting
+// for the next tick or backoff delay. It never blocks.
+func (q *Queue) Flush() {
+	select {
+	case q.kick <- struct{}{}:
+	default:
+	}
 }
 
 func (q *Queue) worker() {
 	defer q.wg.Done()
 
-	ticker := time.NewTicker(q.checkInterval)
-	defer ticker.Stop()
+	timer := time.NewTimer(q.checkInterval)
+	defer timer.Stop()
+	failures := 0
 
 	for {
 		select {
 		case <-q.stopChan:
 			return
-		case <-ticker.C:
-			if q.internetAvailable() {
-				q.processQueue()
+		case <-q.kick:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
 			}
+		case <-timer.C:
 		}
+
+		if err := q.flush(q.ctx); err != nil {
+			failures++
+			log.Printf("[Queue] Flush failed (%d in a row): %v\n", failures, err)
+		} else {
+			failures = 0
+		}
+		timer.Reset(q.nextDelay(failures))
 	}
 }
 
-func (q *Queue) internetAvailable() bool {
-	// Try to connect to a reliable host
-	conn, err := net.DialTimeout("tcp", "8.8.8.8:443", 2*time.Second)
-	if err != nil {
-		return false
+// nextDelay returns how long to wait before the next flush. After failures it
+// backs off exponentially up to maxBackoff, with full jitter in the upper half
+// so a fleet of devices coming back online doesn't retry in lockstep.
+func (q *Queue) nextDelay(failures int) time.Duration {
+	if failures == 0 {
+		return q.checkInterval
+	}
+	d := q.maxBackoff
+	if failures < 16 {
+		d = q.checkInterval << uint(failures-1)
 	}
-	conn.Close()
-	return true
+	if d > q.maxBackoff {
+		d = q.maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// flush sends pending assignments, commits and count results if the API host
+// is reachable.
+func (q *Queue) flush(ctx context.Context) error {
+	q.mu.RLock()
+	empty := len(q.pending) == 0 && len(q.assignments) == 0 && len(q.countResults) == 0
+	q.mu.RUnlock()
+	if empty {
+		return nil
+	}
+
+	q.setSyncing(true)
+	if !q.api.Reachable(ctx) {
+		err := errors.New("API unreachable")
+		q.recordFlush(false, err)
+		return err
+	}
+	err := errors.Join(q.processAssignments(ctx), q.processQueue(ctx), q.processCountResults(ctx))
+	q.recordFlush(true, err)
+	return err
 }
 
-func (q *Queue) processQueue() {
+// processQueue sends a snapshot of the pending commits in queue order: runs
+// of plain commits in bulk, and each transfer and document in a request of
+// its own. The lock is only held to take the snapshot and to record the
+// results, so SubmitCommit never waits on the network.
+func (q *Queue) processQueue(ctx context.Context) error {
+	q.mu.RLock()
+	payloads := make([]api.CommitPayload, len(q.pending))
+	for i, commit := range q.pending {
+		payloads[i] = commit.Payload()
+	}
+	q.mu.RUnlock()
+
+	if len(payloads) == 0 {
+		return nil
+	}
+
+	log.Printf("[Queue] Processing %d pending commits...\n", len(payloads))
+
+	// Batches go in queue order, and sending stops at the first one that
+	// didn't get an answer, so nothing overtakes a commit queued before it:
+	// a count adjustment is checked against a total that includes every
+	// earlier commit, and a void never arrives before what it reverses.
+	var sent []api.CommitPayload
+	var rejected []DeadLetter
+	var lastErr error
+	for _, b := range splitBatches(payloads) {
+		send := q.sendPlain
+		if b.grouped {
+			send = q.sendGroup
+		}
+		s, r, err := send(ctx, b.commits)
+		sent = append(sent, s...)
+		rejected = append(rejected, r...)
+		if err != nil {
+			lastErr = err
+			break
+		}
+	}
+
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
-	queue := q.loadQueue()
-	if len(queue) == 0 {
-		return
+	done := make(map[string]bool)
+	for _, dl := range rejected {
+		log.Printf("[Queue] Commit %s rejected, moving to dead letters: %s\n", dl.Commit.ID, dl.Reason)
+		done[dl.Commit.ID] = true
+	}
+	isSent := make(map[string]bool, len(sent))
+	for _, p := range sent {
+		done[p.UUID] = true
+		isSent[p.UUID] = true
+	}
+	var recent []RecentCommit
+	syncedAt := time.Now().UTC()
+	for _, commit := range q.pending {
+		if isSent[commit.ID] {
+			recent = append(recent, RecentCommit{Commit: commit, Synced: true, SyncedAt: syncedAt})
+		}
 	}
 
-	fmt.Printf("Processing %d pending commits...\n", len(queue))
+	// One transaction, so a rejected commit is never in both lists or
+	// neither.
+	err := q.db.Update(func(tx *storage.Tx) error {
+		for _, dl := range rejected {
+			if err := tx.Append(storage.ListDeadLetters, dl.Commit.ID, dl); err != nil {
+				return err
+			}
+		}
+		if err := addRecent(tx, recent...); err != nil {
+			return err
+		}
+		ids := make([]string, 0, len(done))
+		for id := range done {
+			ids = append(ids, id)
+		}
+		return tx.Remove(storage.ListPending, ids...)
+	})
+	if err != nil {
+		// Everything stays pending and is resent on the next flush; the
+		// server ignores the duplicates and rejects the bad ones again.
+		log.Printf("[Queue] Failed to record sent commits: %v\n", err)
+		return errors.Join(lastErr, err)
+	}
+	q.deadLetters = append(q.deadLetters, rejected...)
+
+	remaining := q.pending[:0]
+	for _, commit := range q.pending {
+		if !done[commit.ID] {
+			remaining = append(remaining, commit)
+		}
+	}
+	q.pending = remaining
+	log.Printf("[Queue] Sent %d, rejected %d, %d still pending\n", len(sent), len(rejected), len(q.pending))
+	return lastErr
+}
 
-	var newQueue []Commit
-	for _, commit := range queue {
-		_, err := q.api.SendCommit(commit.DeviceID, commit.Location, commit.Delta, commit.ItemID)
+// importLegacy moves the queue files of older versions into the database:
+// the pending and dead letter journals, and the pending_commits.json that
+// came before them.
+func (q *Queue) importLegacy() error {
+	journals := []struct{ name, list string }{
+		{"pending_commits.journal", storage.ListPending},
+		{"dead_letter.journal", storage.ListDeadLetters},
+	}
+	for _, j := range journals {
+		list := j.list
+		corruptPath := q.db.Path(j.name + ".corrupt")
+		err := q.db.ImportFile(j.name, func(data []byte) error {
+			entries, err := readJournal(data, q.db.Unseal, corruptPath)
+			if err != nil {
+				return err
+			}
+			return q.db.Update(func(tx *storage.Tx) error {
+				for _, e := range entries {
+					if err := tx.Append(list, e.ID, e.Data); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		})
 		if err != nil {
-			fmt.Printf("Failed to send commit: %v\n", err)
-			newQueue = append(newQueue, commit)
-		} else {
-			fmt.Printf("Committed: %s@%s delta=%d\n", commit.Location, commit.DeviceID, commit.Delta)
+			return err
 		}
 	}
 
-	q.saveQueue(newQueue)
+	modTime := legacyModTime(q.db.Path("pending_commits.json"))
+	return q.db.ImportFile("pending_commits.json", func(data []byte) error {
+		var commits []Commit
+		if err := json.Unmarshal(data, &commits); err != nil {
+			return err
+		}
+		migrateCommits(commits, modTime)
+
+		return q.db.Update(func(tx *storage.Tx) error {
+			for _, commit := range commits {
+				if err := tx.Append(storage.ListPending, commit.ID, commit); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
 }
 
-func (q *Queue) loadQueue() []Commit {
-	if _, err := os.Stat(q.filePath); os.IsNotExist(err) {
-		return []Commit{}
+// migrateCommits assigns an ID to commits queued by older versions, which had
+// none. Their capture time is unknown, so the queue file's mtime is used as the
+// closest upper bound.
+func migrateCommits(commits []Commit, fallback time.Time) {
+	for i := range commits {
+		if commits[i].ID == "" {
+			commits[i].ID = uuid.NewString()
+		}
+		if commits[i].CapturedAt.IsZero() {
+			commits[i].CapturedAt = fallback
+		}
 	}
+}
 
-	data, err := os.ReadFile(q.filePath)
+func legacyModTime(path string) time.Time {
+	info, err := os.Stat(path)
 	if err != nil {
-		return []Commit{}
+		return time.Now().UTC()
 	}
+	return info.ModTime().UTC()
+}
+
+// PendingDelta returns the sum of the not yet synced deltas for an item at a
+// location, so callers can show a quantity that includes offline work.
+func (q *Queue) PendingDelta(location string, itemID int) int {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	total := 0
+	for _, commit := range q.pending {
+		if commit.Location == location && commit.ItemID == itemID {
+			total += commit.Delta
+		}
+	}
+	return total
+}
+
+// DeltaSince returns what a server figure for an item at a location fetched
+// at since doesn't include yet: pending, the deltas not synced, and synced,
+// the deltas synced after since. Adding both keeps the figure right after a
+// flush, without waiting for it to be fetched again.
+func (q *Queue) DeltaSince(location string, itemID int, since time.Time) (pending, synced int) {
+	return q.deltaSince(since, func(c Commit) bool {
+		return c.Location == location && c.ItemID == itemID
+	})
+}
 
-	var commits []Commit
-	json.Unmarshal(data, &commits)
-	return commits
+// ReceivedSince returns the quantity of an item received against a receipt
+// that a server figure fetched at since doesn't include yet, pending or
+// synced after since.
+func (q *Queue) ReceivedSince(receiptRef string, itemID int, since time.Time) int {
+	pending, synced := q.deltaSince(since, func(c Commit) bool {
+		return c.ReceiptRef == receiptRef && c.ItemID == itemID
+	})
+	return pending + synced
 }
 
-func (q *Queue) saveQueue(commits []Commit) {
-	data, _ := json.MarshalIndent(commits, "", "  ")
-	os.WriteFile(q.filePath, data, 0644)
+// deltaSince sums the deltas of the commits matching match that are pending
+// or were synced after since. Synced commits come from the recent list, so
+// only the last recentSize count.
+func (q *Queue) deltaSince(since time.Time, match func(Commit) bool) (pending, synced int) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	for _, commit := range q.pending {
+		if match(commit) {
+			pending += commit.Delta
+		}
+	}
+	err := q.db.View(func(tx *storage.Tx) error {
+		records, err := tx.Records(storage.ListRecent)
+		if err != nil {
+			return err
+		}
+		for _, rec := range records {
+			var rc RecentCommit
+			if err := json.Unmarshal(rec.Data, &rc); err != nil {
+				continue
+			}
+			if rc.Synced && rc.SyncedAt.After(since) && match(rc.Commit) {
+				synced += rc.Commit.Delta
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[Queue] Failed to read recent commits: %v\n", err)
+	}
+	return pending, synced
 }
@@ -0,0 +1,306 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/larkin1/wmsproject/internal/api"
+	"github.com/larkin1/wmsproject/internal/securefile"
+	"github.com/larkin1/wmsproject/internal/storage"
+)
+
+var errOffline = errors.New("connection refused")
+
+// fakeBackend stands in for the server. It records every request in the
+// order it was made and rejects commits by item ID, the way a server rejects
+// a row it can never accept.
+type fakeBackend struct {
+	api.Backend // anything the tests don't use panics
+
+	mu        sync.Mutex
+	batchSize int
+	offline   bool         // requests fail without reaching the server
+	failAt    int          // the request with this number fails, if > 0
+	failErr   error        // the error request failAt fails with, errOffline if nil
+	badItems  map[int]bool // commits for these items are rejected with a 422
+	requests  []string
+	stored    []api.CommitPayload
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{batchSize: api.DefaultBatchSize, badItems: make(map[int]bool)}
+}
+
+// request records a request and returns the error it fails with, if any.
+// Unless it fails, commits are stored; checked are only checked for bad items.
+func (f *fakeBackend) request(desc string, commits []api.CommitPayload, checked ...api.CommitPayload) error {
+	f.requests = append(f.requests, desc)
+	if len(f.requests) == f.failAt && f.failErr != nil {
+		return f.failErr
+	}
+	if f.offline || len(f.requests) == f.failAt {
+		return errOffline
+	}
+	for _, p := range append(checked, commits...) {
+		if f.badItems[p.ItemID] {
+			return &api.APIError{StatusCode: 422, Message: fmt.Sprintf("unknown item %d", p.ItemID)}
+		}
+	}
+	f.stored = append(f.stored, commits...)
+	return nil
+}
+
+func (f *fakeBackend) Reachable(ctx context.Context) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !f.offline
+}
+
+func (f *fakeBackend) SendCommits(ctx context.Context, payloads []api.CommitPayload) []api.ChunkResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var results []api.ChunkResult
+	var failed bool
+	for start := 0; start < len(payloads); start += f.batchSize {
+		chunk := payloads[start:min(start+f.batchSize, len(payloads))]
+		if failed {
+			results = append(results, api.ChunkResult{Commits: chunk, Err: api.ErrNotAttempted})
+			continue
+		}
+		err := f.request("commits "+items(chunk), chunk)
+		failed = err != nil
+		results = append(results, api.ChunkResult{Commits: chunk, Err: err})
+	}
+	return results
+}
+
+func (f *fakeBackend) SendTransfer(ctx context.Context, legs []api.CommitPayload) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.request("transfer "+items(legs), legs)
+}
+
+func (f *fakeBackend) SendDocument(ctx context.Context, doc api.DocumentPayload) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.request("document "+items(doc.Lines), doc.Lines)
+}
+
+func (f *fakeBackend) SendAssignments(ctx context.Context, assignments []api.AssignmentPayload) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	commits := make([]api.CommitPayload, len(assignments))
+	for i, a := range assignments {
+		commits[i] = api.CommitPayload{UUID: a.UUID, Location: a.Location, ItemID: a.ItemID}
+	}
+	return f.request("assign "+items(commits), nil, commits...)
+}
+
+// SendCountResults rejects a result if it has a line for a bad item.
+func (f *fakeBackend) SendCountResults(ctx context.Context, results []api.CountResultPayload) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var desc []string
+	var lines []api.CommitPayload
+	for _, r := range results {
+		desc = append(desc, fmt.Sprint(r.TaskID))
+		for _, line := range r.Lines {
+			lines = append(lines, api.CommitPayload{ItemID: line.ItemID})
+		}
+	}
+	return f.request("results "+strings.Join(desc, ","), nil, lines...)
+}
+
+func (f *fakeBackend) requestLog() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+// items describes commits by their item IDs, e.g. "1,2,3".
+func items(commits []api.CommitPayload) string {
+	ids := make([]string, len(commits))
+	for i, p := range commits {
+		ids[i] = fmt.Sprint(p.ItemID)
+	}
+	return strings.Join(ids, ",")
+}
+
+// openTestDB opens an empty database in a temporary directory.
+func openTestDB(t *testing.T) *storage.DB {
+	t.Helper()
+	dir := t.TempDir()
+	files, err := securefile.Open(filepath.Join(dir, "device.key"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := storage.Open(filepath.Join(dir, "wms.db"), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestQueue returns a queue on a fresh database whose worker isn't
+// running, so tests decide when it flushes.
+func newTestQueue(t *testing.T) (*Queue, *fakeBackend, *storage.DB) {
+	t.Helper()
+	fake := newFakeBackend()
+	db := openTestDB(t)
+	q, err := NewQueue(fake, db, "device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q, fake, db
+}
+
+func submit(t *testing.T, q *Queue, itemID, delta int) Commit {
+	t.Helper()
+	c, err := q.SubmitCommit(Commit{Location: "A1", ItemID: itemID, Delta: delta})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func pendingItems(q *Queue) []int {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	var ids []int
+	for _, c := range q.pending {
+		ids = append(ids, c.ItemID)
+	}
+	return ids
+}
+
+func checkRequests(t *testing.T, fake *fakeBackend, want ...string) {
+	t.Helper()
+	got := fake.requestLog()
+	if strings.Join(got, "; ") != strings.Join(want, "; ") {
+		t.Fatalf("requests:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestFlushSendsInQueueOrder(t *testing.T) {
+	q, fake, _ := newTestQueue(t)
+	ctx := context.Background()
+
+	submit(t, q, 1, 5)
+	submit(t, q, 2, 5)
+	if _, _, err := q.SubmitTransfer(Commit{Location: "A1", ItemID: 3, Delta: -1}, Commit{Location: "B1", ItemID: 3, Delta: 1}); err != nil {
+		t.Fatal(err)
+	}
+	submit(t, q, 4, 5)
+	if _, err := q.SubmitDocument(Document{Reason: "delivery"}, []Commit{{Location: "A1", ItemID: 5, Delta: 1}, {Location: "A1", ItemID: 6, Delta: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	submit(t, q, 7, 5)
+
+	if err := q.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, fake, "commits 1,2", "transfer 3,3", "commits 4", "document 5,6", "commits 7")
+	if got := pendingItems(q); len(got) != 0 {
+		t.Fatalf("pending = %v, want none", got)
+	}
+}
+
+func TestFlushStopsAtUnansweredBatch(t *testing.T) {
+	q, fake, _ := newTestQueue(t)
+	ctx := context.Background()
+
+	submit(t, q, 1, 5)
+	if _, _, err := q.SubmitTransfer(Commit{Location: "A1", ItemID: 2, Delta: -1}, Commit{Location: "B1", ItemID: 2, Delta: 1}); err != nil {
+		t.Fatal(err)
+	}
+	submit(t, q, 3, 5)
+
+	// The transfer gets no answer, so the commit queued after it waits.
+	fake.failAt = 2
+	if err := q.flush(ctx); !errors.Is(err, errOffline) {
+		t.Fatalf("flush error = %v, want %v", err, errOffline)
+	}
+	checkRequests(t, fake, "commits 1", "transfer 2,2")
+	if got := fmt.Sprint(pendingItems(q)); got != "[2 2 3]" {
+		t.Fatalf("pending = %s, want the transfer and what follows it", got)
+	}
+
+	if err := q.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, fake, "commits 1", "transfer 2,2", "transfer 2,2", "commits 3")
+}
+
+func TestFlushStopsAtRetryableChunkError(t *testing.T) {
+	q, fake, _ := newTestQueue(t)
+	ctx := context.Background()
+	fake.batchSize = 2
+	for id := 1; id <= 4; id++ {
+		submit(t, q, id, 1)
+	}
+
+	// The first chunk gets a 503, so the second must not be stored ahead
+	// of it.
+	unavailable := &api.APIError{StatusCode: 503, Message: "unavailable"}
+	fake.failAt, fake.failErr = 1, unavailable
+	if err := q.flush(ctx); !errors.Is(err, unavailable) {
+		t.Fatalf("flush error = %v, want %v", err, unavailable)
+	}
+	checkRequests(t, fake, "commits 1,2")
+	if got := fmt.Sprint(pendingItems(q)); got != "[1 2 3 4]" || len(fake.stored) != 0 {
+		t.Fatalf("pending = %s, stored %s; want everything pending", got, items(fake.stored))
+	}
+	if dead := q.DeadLetters(); len(dead) != 0 {
+		t.Fatalf("dead letters = %+v, want none", dead)
+	}
+
+	if err := q.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, fake, "commits 1,2", "commits 1,2", "commits 3,4")
+	if got := items(fake.stored); got != "1,2,3,4" {
+		t.Fatalf("stored %s, want 1,2,3,4", got)
+	}
+}
+
+func TestDeltaSinceFoldsInCommitsSyncedAfterFetch(t *testing.T) {
+	q, _, _ := newTestQueue(t)
+	ctx := context.Background()
+
+	submit(t, q, 1, 5)
+	if err := q.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	fetchedAt := time.Now().UTC()
+	time.Sleep(time.Millisecond)
+
+	submit(t, q, 1, -2)
+	if _, err := q.SubmitCommit(Commit{Location: "A1", ItemID: 1, Delta: 4, ReceiptRef: "PO-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if pending, synced := q.DeltaSince("A1", 1, fetchedAt); pending != 2 || synced != 0 {
+		t.Fatalf("before flush: pending %d, synced %d, want 2 and 0", pending, synced)
+	}
+
+	if err := q.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// The first commit was synced before the fetch, so the server total
+	// already has it; the two after it are folded in.
+	if pending, synced := q.DeltaSince("A1", 1, fetchedAt); pending != 0 || synced != 2 {
+		t.Fatalf("after flush: pending %d, synced %d, want 0 and 2", pending, synced)
+	}
+	if got := q.ReceivedSince("PO-1", 1, fetchedAt); got != 4 {
+		t.Fatalf("ReceivedSince = %d, want 4", got)
+	}
+	if _, synced := q.DeltaSince("A1", 1, time.Now().UTC()); synced != 0 {
+		t.Fatalf("synced since now = %d, want 0", synced)
+	}
+}
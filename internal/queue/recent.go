@@ -0,0 +1,247 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/larkin1/wmsproject/internal/storage"
+)
+
+// recentSize is how many sent or cancelled commits the device remembers for
+// the recent commits list.
+const recentSize = 200
+
+// RecentCommit is a commit made on this device. Synced commits are on the
+// server since SyncedAt. Cancelled ones were voided before they were sent, so
+// neither they nor their void ever reach it. Voided is set once a void has
+// been made.
+type RecentCommit struct {
+	Commit    Commit    `json:"commit"`
+	Synced    bool      `json:"synced,omitempty"`
+	SyncedAt  time.Time `json:"synced_at,omitempty"`
+	Cancelled bool      `json:"cancelled,omitempty"`
+	Voided    bool      `json:"-"`
+}
+
+var (
+	ErrCommitNotFound = errors.New("commit not found on this device")
+	ErrAlreadyVoided  = errors.New("commit is already voided")
+	ErrVoidOfVoid     = errors.New("a void cannot be voided")
+)
+
+// addRecent records commits in the recent list, dropping the oldest beyond
+// recentSize.
+func addRecent(tx *storage.Tx, commits ...RecentCommit) error {
+	if len(commits) == 0 {
+		return nil
+	}
+	for _, rc := range commits {
+		if err := tx.Append(storage.ListRecent, rc.Commit.ID, rc); err != nil {
+			return err
+		}
+	}
+	records, err := tx.Records(storage.ListRecent)
+	if err != nil {
+		return err
+	}
+	if len(records) <= recentSize {
+		return nil
+	}
+	var old []string
+	for _, rec := range records[:len(records)-recentSize] {
+		old = append(old, rec.ID)
+	}
+	return tx.Remove(storage.ListRecent, old...)
+}
+
+// recentLocked returns the pending commits and the recent list together,
+// oldest first. Callers must hold q.mu.
+func (q *Queue) recentLocked() ([]RecentCommit, error) {
+	var all []RecentCommit
+	err := q.db.View(func(tx *storage.Tx) error {
+		records, err := tx.Records(storage.ListRecent)
+		if err != nil {
+			return err
+		}
+		for _, rec := range records {
+			var rc RecentCommit
+			if err := json.Unmarshal(rec.Data, &rc); err != nil {
+				log.Printf("[Queue] Skipping unreadable recent commit %s: %v\n", rec.ID, err)
+				continue
+			}
+			all = append(all, rc)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, commit := range q.pending {
+		all = append(all, RecentCommit{Commit: commit})
+	}
+
+	voided := make(map[string]bool)
+	for _, rc := range all {
+		if rc.Commit.VoidOf != "" {
+			voided[rc.Commit.VoidOf] = true
+		}
+	}
+	for i := range all {
+		all[i].Voided = voided[all[i].Commit.ID]
+	}
+	return all, nil
+}
+
+// RecentCommits returns up to limit commits made on this device, pending and
+// sent, newest first.
+func (q *Queue) RecentCommits(limit int) ([]RecentCommit, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	all, err := q.recentLocked()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Commit.CapturedAt.After(all[j].Commit.CapturedAt)
+	})
+	if len(all) > limit {
+		all = all[:limit]
+	}
+	return all, nil
+}
+
+// Void reverses a commit with a compensating commit that references it and
+// gives the reason. Both legs of a transfer are voided together. If the
+// commit hasn't been sent yet (and no flush is under way that could be
+// sending it), it and its void cancel out: both are recorded as cancelled
+// and neither is sent. A document line is never cancelled, since that would
+// send the rest of its document without it; its void follows the document.
+func (q *Queue) Void(id, reason string, operatorID int) ([]Commit, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	all, err := q.recentLocked()
+	if err != nil {
+		return nil, err
+	}
+	var orig *RecentCommit
+	for i := range all {
+		if all[i].Commit.ID == id {
+			orig = &all[i]
+		}
+	}
+	switch {
+	case orig == nil:
+		return nil, ErrCommitNotFound
+	case orig.Commit.Kind == KindVoid:
+		return nil, ErrVoidOfVoid
+	case orig.Voided || orig.Cancelled:
+		return nil, ErrAlreadyVoided
+	}
+
+	legs := []RecentCommit{*orig}
+	if orig.Commit.TransferID != "" {
+		legs = nil
+		for _, rc := range all {
+			if rc.Commit.TransferID == orig.Commit.TransferID {
+				legs = append(legs, rc)
+			}
+		}
+		if len(legs) != 2 {
+			return nil, fmt.Errorf("the other leg of transfer %s is not on this device", orig.Commit.TransferID)
+		}
+	}
+
+	capturedAt := time.Now().UTC()
+	transferID := ""
+	if orig.Commit.TransferID != "" {
+		transferID = uuid.NewString()
+	}
+	cancel := !q.syncing && orig.Commit.Document == nil
+	var voids []Commit
+	for _, leg := range legs {
+		cancel = cancel && !leg.Synced
+		voids = append(voids, Commit{
+			ID:         uuid.NewString(),
+			CapturedAt: capturedAt,
+			DeviceID:   q.deviceID,
+			OperatorID: operatorID,
+			Location:   leg.Commit.Location,
+			Delta:      -leg.Commit.Delta,
+			ItemID:     leg.Commit.ItemID,
+			TransferID: transferID,
+			Kind:       KindVoid,
+			VoidOf:     leg.Commit.ID,
+			VoidReason: reason,
+			ReceiptRef: leg.Commit.ReceiptRef,
+		})
+	}
+
+	if cancel {
+		err = q.cancelLocked(legs, voids)
+	} else {
+		err = q.db.Update(func(tx *storage.Tx) error {
+			for _, v := range voids {
+				if err := tx.Append(storage.ListPending, v.ID, v); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err == nil {
+			q.pending = append(q.pending, voids...)
+		}
+	}
+	if err != nil {
+		log.Printf("[Queue] Failed to void commit %s: %v\n", id, err)
+		return nil, err
+	}
+	q.notifyLocked()
+
+	log.Printf("[Queue] Commit %s voided (cancelled locally: %v): %s\n", id, cancel, reason)
+	if !cancel {
+		q.Flush()
+	}
+	return voids, nil
+}
+
+// cancelLocked takes unsent commits out of the queue and records them and
+// their voids as cancelled. Callers must hold q.mu.
+func (q *Queue) cancelLocked(legs []RecentCommit, voids []Commit) error {
+	drop := make(map[string]bool, len(legs))
+	var ids []string
+	var recent []RecentCommit
+	for _, leg := range legs {
+		drop[leg.Commit.ID] = true
+		ids = append(ids, leg.Commit.ID)
+		recent = append(recent, RecentCommit{Commit: leg.Commit, Cancelled: true})
+	}
+	for _, v := range voids {
+		recent = append(recent, RecentCommit{Commit: v, Cancelled: true})
+	}
+
+	err := q.db.Update(func(tx *storage.Tx) error {
+		if err := tx.Remove(storage.ListPending, ids...); err != nil {
+			return err
+		}
+		return addRecent(tx, recent...)
+	})
+	if err != nil {
+		return err
+	}
+
+	remaining := q.pending[:0]
+	for _, commit := range q.pending {
+		if !drop[commit.ID] {
+			remaining = append(remaining, commit)
+		}
+	}
+	q.pending = remaining
+	return nil
+}
@@ -0,0 +1,147 @@
+package queue
+
+import (
+	"context"
+	"testing"
+)
+
+// recent returns the recent commit with the given ID.
+func recent(t *testing.T, q *Queue, id string) RecentCommit {
+	t.Helper()
+	all, err := q.RecentCommits(recentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rc := range all {
+		if rc.Commit.ID == id {
+			return rc
+		}
+	}
+	t.Fatalf("commit %s is not in the recent list", id)
+	return RecentCommit{}
+}
+
+func TestVoidOfUnsentCommitCancelsIt(t *testing.T) {
+	q, fake, _ := newTestQueue(t)
+	ctx := context.Background()
+
+	c := submit(t, q, 1, 5)
+	voids, err := q.Void(c.ID, "wrong bin", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(voids) != 1 || voids[0].Delta != -5 || voids[0].VoidOf != c.ID || voids[0].OperatorID != 7 {
+		t.Fatalf("voids = %+v", voids)
+	}
+	if got := pendingItems(q); len(got) != 0 {
+		t.Fatalf("pending = %v, want the commit and its void cancelled out", got)
+	}
+	if rc := recent(t, q, c.ID); !rc.Cancelled || !rc.Voided {
+		t.Fatalf("original = %+v, want cancelled and voided", rc)
+	}
+	if rc := recent(t, q, voids[0].ID); !rc.Cancelled {
+		t.Fatalf("void = %+v, want cancelled", rc)
+	}
+
+	if _, err := q.Void(c.ID, "again", 7); err != ErrAlreadyVoided {
+		t.Fatalf("second void = %v, want ErrAlreadyVoided", err)
+	}
+	if _, err := q.Void(voids[0].ID, "undo", 7); err != ErrVoidOfVoid {
+		t.Fatalf("void of the void = %v, want ErrVoidOfVoid", err)
+	}
+	if _, err := q.Void("no-such-commit", "typo", 7); err != ErrCommitNotFound {
+		t.Fatalf("void of an unknown commit = %v, want ErrCommitNotFound", err)
+	}
+
+	if err := q.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, fake)
+}
+
+func TestVoidDuringFlushIsSent(t *testing.T) {
+	q, fake, _ := newTestQueue(t)
+	ctx := context.Background()
+
+	// A flush under way may already be sending the commit, so it can't be
+	// cancelled; the void goes out after it instead.
+	c := submit(t, q, 1, 5)
+	q.mu.Lock()
+	q.syncing = true
+	q.mu.Unlock()
+	if _, err := q.Void(c.ID, "wrong bin", 7); err != nil {
+		t.Fatal(err)
+	}
+	q.mu.Lock()
+	q.syncing = false
+	q.mu.Unlock()
+
+	if got := len(pendingItems(q)); got != 2 {
+		t.Fatalf("pending %d commits, want the commit and its void", got)
+	}
+	if err := q.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, fake, "commits 1,1")
+	if q.PendingDelta("A1", 1) != 0 {
+		t.Fatalf("pending delta = %d, want 0", q.PendingDelta("A1", 1))
+	}
+}
+
+func TestVoidOfSyncedTransferVoidsBothLegs(t *testing.T) {
+	q, fake, _ := newTestQueue(t)
+	ctx := context.Background()
+
+	out, in, err := q.SubmitTransfer(Commit{Location: "A1", ItemID: 1, Delta: -3}, Commit{Location: "B1", ItemID: 1, Delta: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	voids, err := q.Void(in.ID, "scanned the wrong pallet", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(voids) != 2 || voids[0].TransferID == "" || voids[0].TransferID != voids[1].TransferID || voids[0].TransferID == out.TransferID {
+		t.Fatalf("voids = %+v, want a new transfer of two legs", voids)
+	}
+	for _, v := range voids {
+		if v.Location == "A1" && (v.Delta != 3 || v.VoidOf != out.ID) || v.Location == "B1" && (v.Delta != -3 || v.VoidOf != in.ID) {
+			t.Fatalf("void %+v doesn't reverse its leg", v)
+		}
+	}
+	if rc := recent(t, q, out.ID); !rc.Voided || rc.Cancelled {
+		t.Fatalf("other leg = %+v, want voided but not cancelled", rc)
+	}
+
+	if err := q.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, fake, "transfer 1,1", "transfer 1,1")
+	if _, err := q.Void(out.ID, "again", 7); err != ErrAlreadyVoided {
+		t.Fatalf("second void = %v, want ErrAlreadyVoided", err)
+	}
+}
+
+func TestVoidOfUnsentDocumentLineFollowsDocument(t *testing.T) {
+	q, fake, _ := newTestQueue(t)
+	ctx := context.Background()
+
+	lines, err := q.SubmitDocument(Document{Reason: "delivery"}, []Commit{{Location: "A1", ItemID: 5, Delta: 1}, {Location: "A1", ItemID: 6, Delta: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Void(lines[0].ID, "damaged", 7); err != nil {
+		t.Fatal(err)
+	}
+	if rc := recent(t, q, lines[0].ID); rc.Cancelled || !rc.Voided {
+		t.Fatalf("line = %+v, want voided but not cancelled", rc)
+	}
+
+	if err := q.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, fake, "document 5,6", "commits 5")
+}
@@ -0,0 +1,103 @@
+package queue
+
+import "time"
+
+// Status is a point-in-time snapshot of the queue for display.
+type Status struct {
+	Pending     int // commits, location assignments and count results not yet sent
+	DeadLetters int
+	Syncing     bool
+	Online      bool      // last probe reached the API
+	LastSync    time.Time // last flush that sent everything it attempted
+	LastAttempt time.Time
+	LastError   string
+}
+
+// Status returns the current queue status.
+func (q *Queue) Status() Status {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.statusLocked()
+}
+
+func (q *Queue) statusLocked() Status {
+	return Status{
+		Pending:     len(q.pending) + len(q.assignments) + len(q.countResults),
+		DeadLetters: len(q.deadLetters),
+		Syncing:     q.syncing,
+		Online:      q.online,
+		LastSync:    q.lastSync,
+		LastAttempt: q.lastAttempt,
+		LastError:   q.lastError,
+	}
+}
+
+// Subscribe returns a channel that receives the current status immediately
+// and again after every change, and a function to stop the subscription.
+// Slow readers only ever see the latest status; intermediate ones are dropped.
+func (q *Queue) Subscribe() (<-chan Status, func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ch := make(chan Status, 1)
+	id := q.nextSubID
+	q.nextSubID++
+	q.subscribers[id] = ch
+	ch <- q.statusLocked()
+
+	return ch, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if _, ok := q.subscribers[id]; ok {
+			delete(q.subscribers, id)
+			close(ch)
+		}
+	}
+}
+
+// notifyLocked publishes the current status. Callers must hold q.mu.
+func (q *Queue) notifyLocked() {
+	s := q.statusLocked()
+	for _, ch := range q.subscribers {
+		select {
+		case ch <- s:
+		default:
+			// Replace the unread status with the newer one.
+			select {
+			case <-ch:
+			default:
+			}
+			select {
+			case ch <- s:
+			default:
+			}
+		}
+	}
+}
+
+func (q *Queue) setSyncing(syncing bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.syncing = syncing
+	if syncing {
+		q.lastAttempt = time.Now()
+	}
+	q.notifyLocked()
+}
+
+// recordFlush stores the outcome of a flush attempt.
+func (q *Queue) recordFlush(online bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.syncing = false
+	q.online = online
+	if err != nil {
+		q.lastError = err.Error()
+	} else {
+		q.lastError = ""
+		q.lastSync = time.Now()
+	}
+	q.notifyLocked()
+}
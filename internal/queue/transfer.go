@@ -0,0 +1,50 @@
+package queue
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/larkin1/wmsproject/internal/storage"
+)
+
+// SubmitTransfer queues the two legs of a stock transfer, out taking the
+// quantity from the source location and in adding it to the destination.
+// Both get the same transfer ID and capture time and are stored in one
+// transaction; the queue then only ever sends them together, so the server
+// never sees stock leave one location without arriving at the other.
+func (q *Queue) SubmitTransfer(out, in Commit) (Commit, Commit, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	transferID := uuid.NewString()
+	capturedAt := time.Now().UTC()
+	legs := []*Commit{&out, &in}
+	for _, leg := range legs {
+		leg.ID = uuid.NewString()
+		leg.CapturedAt = capturedAt
+		leg.TransferID = transferID
+		if leg.DeviceID == "" {
+			leg.DeviceID = q.deviceID
+		}
+	}
+
+	err := q.db.Update(func(tx *storage.Tx) error {
+		for _, leg := range legs {
+			if err := tx.Append(storage.ListPending, leg.ID, *leg); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[Queue] Failed to store transfer: %v\n", err)
+		return out, in, err
+	}
+	q.pending = append(q.pending, out, in)
+	q.notifyLocked()
+
+	log.Printf("[Queue] Transfer %s queued: %d of item %d from %s to %s\n", transferID, in.Delta, in.ItemID, out.Location, in.Location)
+	q.Flush()
+	return out, in, nil
+}
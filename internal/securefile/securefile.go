@@ -0,0 +1,149 @@
+// Package securefile encrypts files at rest with AES-256-GCM.
+//
+// The key is derived with scrypt from a random device secret, kept in
+// device.key next to the data, plus an optional admin passphrase. Without a
+// passphrase this keeps casual readers (and anything that copies files off
+// the device) away from the data; with one, a lost handheld's files are
+// unreadable without it.
+package securefile
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// magic prefixes every sealed blob, so plaintext files from older versions
+// can be told apart and migrated.
+var magic = []byte("WMSENC1\x00")
+
+const (
+	secretSize = 32
+	saltSize   = 16
+)
+
+var ErrDecrypt = errors.New("cannot decrypt file: wrong device key or passphrase, or file damaged")
+
+// Store seals and opens data with the device key.
+type Store struct {
+	aead cipher.AEAD
+}
+
+// Open loads the device secret from keyPath, creating it on first run, and
+// derives the encryption key from it and passphrase.
+func Open(keyPath, passphrase string) (*Store, error) {
+	secret, salt, err := loadOrCreateSecret(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("device key: %w", err)
+	}
+
+	key, err := scrypt.Key(append(secret, passphrase...), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{aead: aead}, nil
+}
+
+func loadOrCreateSecret(path string) (secret, salt []byte, err error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if len(data) != secretSize+saltSize {
+			return nil, nil, fmt.Errorf("%s is %d bytes, want %d", path, len(data), secretSize+saltSize)
+		}
+		return data[:secretSize], data[secretSize:], nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	data = make([]byte, secretSize+saltSize)
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		return nil, nil, err
+	}
+	if err := writeAtomic(path, data); err != nil {
+		return nil, nil, err
+	}
+	log.Printf("[SecureFile] Created device key %s\n", path)
+	return data[:secretSize], data[secretSize:], nil
+}
+
+// IsSealed reports whether data was produced by Seal.
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, magic)
+}
+
+// Seal encrypts plain.
+func (s *Store) Seal(plain []byte) []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		// crypto/rand failing means the platform is broken; there is no
+		// safe way to continue.
+		panic("securefile: reading random nonce: " + err.Error())
+	}
+	out := make([]byte, 0, len(magic)+len(nonce)+len(plain)+s.aead.Overhead())
+	out = append(out, magic...)
+	out = append(out, nonce...)
+	return s.aead.Seal(out, nonce, plain, magic)
+}
+
+// Unseal decrypts data produced by Seal.
+func (s *Store) Unseal(data []byte) ([]byte, error) {
+	if !IsSealed(data) {
+		return nil, errors.New("data is not sealed")
+	}
+	data = data[len(magic):]
+	n := s.aead.NonceSize()
+	if len(data) < n {
+		return nil, ErrDecrypt
+	}
+	plain, err := s.aead.Open(nil, data[:n], data[n:], magic)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
+
+func writeAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	if err := tmp.Chmod(0600); err != nil {
+		// Not supported everywhere (e.g. Windows); CreateTemp already uses 0600.
+		log.Printf("[SecureFile] chmod %s: %v\n", tmpPath, err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
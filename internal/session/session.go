@@ -0,0 +1,113 @@
+package session
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/larkin1/wmsproject/internal/api"
+)
+
+// Manager tracks the signed-in operator and signs them out after a period
+// without activity, so a device left on a shelf can't be used under someone
+// else's name.
+type Manager struct {
+	mu          sync.Mutex
+	operator    *api.Operator
+	lastActive  time.Time
+	idleTimeout time.Duration
+	onExpire    func()
+	stopChan    chan struct{}
+	wg          sync.WaitGroup
+}
+
+// NewManager creates a session manager. onExpire is called from a background
+// goroutine when an idle session is signed out.
+func NewManager(idleTimeout time.Duration, onExpire func()) *Manager {
+	return &Manager{
+		idleTimeout: idleTimeout,
+		onExpire:    onExpire,
+		stopChan:    make(chan struct{}),
+	}
+}
+
+func (m *Manager) Start() {
+	m.wg.Add(1)
+	go m.watch()
+}
+
+func (m *Manager) Stop() {
+	close(m.stopChan)
+	m.wg.Wait()
+}
+
+func (m *Manager) SignIn(op api.Operator) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.operator = &op
+	m.lastActive = time.Now()
+	log.Printf("[Session] %s (ID %d) signed in\n", op.Name, op.ID)
+}
+
+func (m *Manager) SignOut() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.operator != nil {
+		log.Printf("[Session] %s signed out\n", m.operator.Name)
+	}
+	m.operator = nil
+}
+
+// Current returns the signed-in operator. ok is false when nobody is signed
+// in or the session has gone idle.
+func (m *Manager) Current() (op api.Operator, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.operator == nil || m.expiredLocked() {
+		return api.Operator{}, false
+	}
+	return *m.operator, true
+}
+
+// Touch records operator activity, pushing back the idle timeout.
+func (m *Manager) Touch() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.operator != nil && !m.expiredLocked() {
+		m.lastActive = time.Now()
+	}
+}
+
+func (m *Manager) expiredLocked() bool {
+	return m.idleTimeout > 0 && time.Since(m.lastActive) > m.idleTimeout
+}
+
+func (m *Manager) watch() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stopChan:
+			return
+		case <-ticker.C:
+			m.mu.Lock()
+			expired := m.operator != nil && m.expiredLocked()
+			if expired {
+				log.Printf("[Session] %s idle for %s, signing out\n", m.operator.Name, m.idleTimeout)
+				m.operator = nil
+			}
+			m.mu.Unlock()
+
+			if expired && m.onExpire != nil {
+				m.onExpire()
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+)
+
+// A list keeps records in the order they were first added, which is the order
+// the commit queue sends them in. It is two buckets: <list> maps a sequence
+// number to the sealed record, and <list>_ids maps a record's ID to its
+// sequence number so records can be replaced and removed by ID.
+
+type listRecord struct {
+	ID   string          `json:"id"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Record is one entry of a list.
+type Record struct {
+	ID   string
+	Data json.RawMessage
+}
+
+func listIDs(list string) string {
+	return list + "_ids"
+}
+
+// Append adds v to the end of list under id. If id is already in the list,
+// its record is replaced in place.
+func (tx *Tx) Append(list, id string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b, err := tx.bucket(list)
+	if err != nil {
+		return err
+	}
+	ids, err := tx.bucket(listIDs(list))
+	if err != nil {
+		return err
+	}
+
+	seq := ids.Get([]byte(id))
+	if seq == nil {
+		n, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		seq = make([]byte, 8)
+		binary.BigEndian.PutUint64(seq, n)
+		if err := ids.Put([]byte(id), seq); err != nil {
+			return err
+		}
+	}
+	return tx.PutSealed(list, seq, listRecord{ID: id, Data: data})
+}
+
+// Remove deletes the records with the given IDs from list. IDs not in the
+// list are ignored.
+func (tx *Tx) Remove(list string, ids ...string) error {
+	b, err := tx.bucket(list)
+	if err != nil {
+		return err
+	}
+	idx, err := tx.bucket(listIDs(list))
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		seq := idx.Get([]byte(id))
+		if seq == nil {
+			continue
+		}
+		if err := b.Delete(seq); err != nil {
+			return err
+		}
+		if err := idx.Delete([]byte(id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Records returns the records of list in order.
+func (tx *Tx) Records(list string) ([]Record, error) {
+	var out []Record
+	err := tx.ForEach(list, func(_, value []byte) error {
+		plain, err := tx.files.Unseal(value)
+		if err != nil {
+			return err
+		}
+		var rec listRecord
+		if err := json.Unmarshal(plain, &rec); err != nil {
+			return err
+		}
+		out = append(out, Record{ID: rec.ID, Data: rec.Data})
+		return nil
+	})
+	return out, err
+}
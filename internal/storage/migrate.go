@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Schema changes are migrations, applied in order when the database is
+// opened. Each runs in its own transaction together with the version bump,
+// so a crash leaves the database at the previous version, never in between.
+// Append new migrations; never edit or reorder released ones.
+
+type migration struct {
+	name string
+	up   func(tx *bolt.Tx) error
+}
+
+var migrations = []migration{
+	{"create buckets", createBuckets(
+		BucketSettings,
+		BucketItems, BucketItemsByName,
+		BucketLocations, BucketItemLocations,
+		BucketStock, BucketOperators, BucketSync,
+		ListPending, listIDs(ListPending),
+		ListDeadLetters, listIDs(ListDeadLetters),
+	)},
+	{"location assignments queue", createBuckets(
+		ListAssignments, listIDs(ListAssignments),
+	)},
+	// Items cached before barcodes existed were stored without them; dropping
+	// the items sync state makes the next sync a full one that fills them in.
+	{"item barcodes", steps(
+		createBuckets(BucketItemsByCode),
+		deleteKeys(BucketSync, "state:items"),
+	)},
+	{"count tasks", createBuckets(
+		BucketCountTasks,
+		ListCountResults, listIDs(ListCountResults),
+	)},
+	{"recent commits", createBuckets(
+		ListRecent, listIDs(ListRecent),
+	)},
+	{"expected receipts", createBuckets(BucketReceipts)},
+	// Cached operators carried the server's unsalted PIN hashes. PINs are now
+	// checked by the server, so drop them; the list is fetched again, without
+	// hashes, by the sign-in screen.
+	{"pin verifiers", steps(
+		createBuckets(BucketPINs),
+		deleteKeys(BucketOperators, "operators"),
+	)},
+	{"carts", createBuckets(BucketCarts)},
+}
+
+var schemaVersionKey = []byte("schema_version")
+
+func createBuckets(names ...string) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		for _, name := range names {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return fmt.Errorf("create bucket %s: %w", name, err)
+			}
+		}
+		return nil
+	}
+}
+
+func deleteKeys(bucket string, keys ...string) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		for _, key := range keys {
+			if err := b.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func steps(fns ...func(tx *bolt.Tx) error) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		for _, fn := range fns {
+			if err := fn(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// SchemaVersion returns the number of migrations applied.
+func (db *DB) SchemaVersion() (int, error) {
+	version := 0
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		version = schemaVersion(tx)
+		return nil
+	})
+	return version, err
+}
+
+func schemaVersion(tx *bolt.Tx) int {
+	meta := tx.Bucket([]byte(BucketMeta))
+	if meta == nil {
+		return 0
+	}
+	v := meta.Get(schemaVersionKey)
+	if len(v) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(v))
+}
+
+func (db *DB) migrate() error {
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this app supports (%d)", current, len(migrations))
+	}
+
+	for v := current; v < len(migrations); v++ {
+		m := migrations[v]
+		err := db.bolt.Update(func(tx *bolt.Tx) error {
+			if err := m.up(tx); err != nil {
+				return err
+			}
+			meta, err := tx.CreateBucketIfNotExists([]byte(BucketMeta))
+			if err != nil {
+				return err
+			}
+			version := make([]byte, 8)
+			binary.BigEndian.PutUint64(version, uint64(v+1))
+			return meta.Put(schemaVersionKey, version)
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", v+1, m.name, err)
+		}
+		log.Printf("[Storage] Applied migration %d: %s\n", v+1, m.name)
+	}
+	return nil
+}
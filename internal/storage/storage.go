@@ -0,0 +1,310 @@
+// Package storage is the device's local database: a single bbolt file holding
+// the catalog, the commit queue, sync metadata and settings.
+//
+// Every change happens in a transaction, so related updates (a commit leaving
+// the queue and entering the dead letters, a catalog merge and its sync high
+// water mark) land together or not at all. Records are JSON; the queue and
+// anything holding credentials are sealed with the device key.
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/larkin1/wmsproject/internal/securefile"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets. Index buckets map a lookup key to the primary key of a row.
+const (
+	BucketMeta          = "meta"           // schema_version
+	BucketSettings      = "settings"       // settings, credentials, auth session
+	BucketItems         = "items"          // IntKey(item ID) -> item
+	BucketItemsByName   = "items_by_name"  // lower-cased name -> IntKey(item ID)
+	BucketItemsByCode   = "items_by_code"  // BarcodeKey(barcode) -> IntKey(item ID)
+	BucketLocations     = "locations"      // location -> location
+	BucketItemLocations = "item_locations" // IntKey(item ID) + location -> location
+	BucketStock         = "stock"          // location -> stock levels
+	BucketOperators     = "operators"      // sealed operator list
+	BucketSync          = "sync"           // catalog sync state and history
+	BucketCountTasks    = "count_tasks"    // IntKey(task ID) -> count task assigned to the device
+	BucketReceipts      = "receipts"       // IntKey(receipt ID) -> open expected receipt
+	BucketPINs          = "pin_verifiers"  // IntKey(operator ID) -> sealed bcrypt hash of a PIN the server accepted
+	BucketCarts         = "carts"          // IntKey(operator ID) -> sealed cart lines not yet submitted
+)
+
+// Lists are insertion-ordered collections of sealed records; see list.go.
+const (
+	ListPending      = "pending"
+	ListDeadLetters  = "dead_letters"
+	ListAssignments  = "assignments"   // location assignments waiting to be sent
+	ListCountResults = "count_results" // completed count tasks waiting to be sent
+	ListRecent       = "recent"        // sent and cancelled commits, for the recent commits list
+)
+
+var ErrNoBucket = errors.New("bucket does not exist")
+
+// DB is the open database.
+type DB struct {
+	bolt  *bolt.DB
+	files *securefile.Store
+	dir   string
+}
+
+// Open opens or creates the database at path and brings its schema up to
+// date. files seals the records that must not be stored in the clear.
+func Open(path string, files *securefile.Store) (*DB, error) {
+	b, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	db := &DB{bolt: b, files: files, dir: filepath.Dir(path)}
+	if err := db.migrate(); err != nil {
+		b.Close()
+		return nil, err
+	}
+	log.Printf("[Storage] Opened %s\n", path)
+	return db, nil
+}
+
+func (db *DB) Close() error {
+	return db.bolt.Close()
+}
+
+// View runs fn in a read-only transaction.
+func (db *DB) View(fn func(tx *Tx) error) error {
+	return db.bolt.View(func(btx *bolt.Tx) error {
+		return fn(&Tx{tx: btx, files: db.files})
+	})
+}
+
+// Update runs fn in a read-write transaction, committed (and fsynced) if fn
+// returns nil and rolled back otherwise.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	return db.bolt.Update(func(btx *bolt.Tx) error {
+		return fn(&Tx{tx: btx, files: db.files})
+	})
+}
+
+// ImportFile feeds the file name, from the database's directory, to fn and
+// deletes it once fn succeeds. It is how the files older versions kept state
+// in are moved into the database. Sealed files are decrypted first. A missing
+// file is not an error.
+func (db *DB) ImportFile(name string, fn func(data []byte) error) error {
+	path := filepath.Join(db.dir, name)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if securefile.IsSealed(data) {
+		if data, err = db.files.Unseal(data); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	if err := fn(data); err != nil {
+		return fmt.Errorf("import %s: %w", name, err)
+	}
+	log.Printf("[Storage] Imported %s\n", path)
+	return os.Remove(path)
+}
+
+// Path returns the path of a file next to the database.
+func (db *DB) Path(name string) string {
+	return filepath.Join(db.dir, name)
+}
+
+// Unseal decrypts data sealed with the device key.
+func (db *DB) Unseal(data []byte) ([]byte, error) {
+	return db.files.Unseal(data)
+}
+
+// Tx is a transaction. It must not be used after the function it was passed
+// to returns.
+type Tx struct {
+	tx    *bolt.Tx
+	files *securefile.Store
+}
+
+func (tx *Tx) bucket(name string) (*bolt.Bucket, error) {
+	b := tx.tx.Bucket([]byte(name))
+	if b == nil {
+		return nil, fmt.Errorf("%s: %w", name, ErrNoBucket)
+	}
+	return b, nil
+}
+
+// Get decodes the record at key into v. It reports false if there is none.
+func (tx *Tx) Get(bucket string, key []byte, v interface{}) (bool, error) {
+	b, err := tx.bucket(bucket)
+	if err != nil {
+		return false, err
+	}
+	data := b.Get(key)
+	if data == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+// Put stores v at key as JSON.
+func (tx *Tx) Put(bucket string, key []byte, v interface{}) error {
+	b, err := tx.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+// GetSealed is Get for records written with PutSealed.
+func (tx *Tx) GetSealed(bucket string, key []byte, v interface{}) (bool, error) {
+	b, err := tx.bucket(bucket)
+	if err != nil {
+		return false, err
+	}
+	data := b.Get(key)
+	if data == nil {
+		return false, nil
+	}
+	plain, err := tx.files.Unseal(data)
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(plain, v)
+}
+
+// PutSealed stores v at key as encrypted JSON.
+func (tx *Tx) PutSealed(bucket string, key []byte, v interface{}) error {
+	b, err := tx.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, tx.files.Seal(data))
+}
+
+// GetRaw returns the bytes stored at key, or nil. They are only valid for
+// the life of the transaction.
+func (tx *Tx) GetRaw(bucket string, key []byte) ([]byte, error) {
+	b, err := tx.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return b.Get(key), nil
+}
+
+// PutRaw stores value at key as is.
+func (tx *Tx) PutRaw(bucket string, key, value []byte) error {
+	b, err := tx.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, value)
+}
+
+func (tx *Tx) Delete(bucket string, key []byte) error {
+	b, err := tx.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return b.Delete(key)
+}
+
+// ForEach calls fn for every record in key order. The slices are only valid
+// during the call.
+func (tx *Tx) ForEach(bucket string, fn func(key, value []byte) error) error {
+	b, err := tx.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return b.ForEach(fn)
+}
+
+// ForEachPrefix calls fn for every record whose key starts with prefix, in
+// key order.
+func (tx *Tx) ForEachPrefix(bucket string, prefix []byte, fn func(key, value []byte) error) error {
+	b, err := tx.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && hasPrefix(k, prefix); k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Count returns the number of records in bucket.
+func (tx *Tx) Count(bucket string) (int, error) {
+	b, err := tx.bucket(bucket)
+	if err != nil {
+		return 0, err
+	}
+	return b.Stats().KeyN, nil
+}
+
+// Clear deletes every record in bucket.
+func (tx *Tx) Clear(bucket string) error {
+	if err := tx.tx.DeleteBucket([]byte(bucket)); err != nil {
+		return fmt.Errorf("clear %s: %w", bucket, err)
+	}
+	_, err := tx.tx.CreateBucket([]byte(bucket))
+	return err
+}
+
+func hasPrefix(b, prefix []byte) bool {
+	return len(b) >= len(prefix) && string(b[:len(prefix)]) == string(prefix)
+}
+
+// IntKey encodes n so that keys sort numerically.
+func IntKey(n int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(n))
+	return key
+}
+
+// KeyInt decodes a key made by IntKey.
+func KeyInt(key []byte) int {
+	if len(key) < 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(key[:8]))
+}
+
+// NameKey is the key names are indexed under, so lookups ignore case.
+func NameKey(name string) []byte {
+	return []byte(strings.ToLower(strings.TrimSpace(name)))
+}
+
+// BarcodeKey is the key barcodes are indexed under. Numeric codes of GTIN
+// length (EAN-8, UPC-A, EAN-13, GTIN-14) are padded to 14 digits, so a UPC
+// printed on the box finds the item stored under its GTIN and vice versa.
+func BarcodeKey(code string) []byte {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	switch len(code) {
+	case 8, 12, 13, 14:
+		if strings.Trim(code, "0123456789") == "" {
+			code = strings.Repeat("0", 14-len(code)) + code
+		}
+	}
+	return []byte(code)
+}
@@ -0,0 +1,267 @@
+package ui
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"github.com/larkin1/wmsproject/internal/queue"
+)
+
+// The cart collects ADD and SUB lines to submit together as one document,
+// which the server applies all or nothing. It is saved under the operator on
+// every change (see queue.SaveCart), so leaving the screen or being signed
+// out for idling doesn't lose it.
+
+// loadCart restores the signed-in operator's saved cart.
+func (c *CommitUI) loadCart() {
+	if op, ok := c.session.Current(); ok {
+		cart, err := c.queue.Cart(op.ID)
+		if err != nil {
+			log.Printf("[CommitUI] Failed to load cart: %v\n", err)
+			c.setError(fmt.Sprintf("Could not load cart: %v", err))
+		}
+		c.cart = cart
+	}
+	c.updateCartButton()
+}
+
+// saveCart stores the cart under the signed-in operator.
+func (c *CommitUI) saveCart() {
+	op, ok := c.session.Current()
+	if !ok {
+		c.setError("Session expired - cart not saved")
+		return
+	}
+	if err := c.queue.SaveCart(op.ID, c.cart); err != nil {
+		log.Printf("[CommitUI] Failed to save cart: %v\n", err)
+		c.setError(fmt.Sprintf("Could not save cart: %v", err))
+	}
+}
+
+// addToCart adds the entered quantity for the current location and item to
+// the cart, applying the same checks as a commit.
+func (c *CommitUI) addToCart() {
+	if c.mode != "ADD" && c.mode != "SUB" {
+		c.setError("Only ADD and SUB lines can go in the cart")
+		return
+	}
+	qty, ok := c.enteredQty()
+	if !ok {
+		return
+	}
+	if c.mode == "SUB" {
+		qty = -qty
+	}
+
+	c.checkStock(qty, func(overrides []string) {
+		c.cart = append(c.cart, queue.Commit{
+			Location:     c.location,
+			Delta:        qty,
+			ItemID:       c.itemID,
+			Overrides:    append(append([]string(nil), c.itemOverrides...), overrides...),
+			SupervisorID: c.supervisorID,
+		})
+		log.Printf("[CommitUI] Added to cart: location=%s, itemID=%d, qty=%d (%d lines)\n", c.location, c.itemID, qty, len(c.cart))
+		c.deltaInput.SetText("")
+		c.updateCartButton()
+		c.updateLocationLabel()
+		c.setError(fmt.Sprintf("Added %+d to cart", qty))
+		c.saveCart()
+	})
+}
+
+// cartDelta is the total change the cart makes to an item at a location.
+func (c *CommitUI) cartDelta(location string, itemID int) int {
+	total := 0
+	for _, line := range c.cart {
+		if line.Location == location && line.ItemID == itemID {
+			total += line.Delta
+		}
+	}
+	return total
+}
+
+func (c *CommitUI) updateCartButton() {
+	c.cartBtn.SetText(fmt.Sprintf("Cart (%d)", len(c.cart)))
+}
+
+// showCart lists the cart for review. Tapping a line edits or removes it;
+// Submit queues the cart as one document with the reason and reference.
+func (c *CommitUI) showCart() {
+	if len(c.cart) == 0 {
+		dialog.ShowInformation("Cart", "The cart is empty. Enter a quantity and tap Add to Cart.", c.window)
+		return
+	}
+
+	reasonInput := widget.NewEntry()
+	reasonInput.SetPlaceHolder("e.g. Goods received")
+	referenceInput := widget.NewEntry()
+	referenceInput.SetPlaceHolder("e.g. delivery note number")
+
+	var dlg dialog.Dialog
+	list := widget.NewList(
+		func() int {
+			return len(c.cart)
+		},
+		func() fyne.CanvasObject {
+			return widget.NewLabel("")
+		},
+		func(id widget.ListItemID, obj fyne.CanvasObject) {
+			line := c.cart[id]
+			obj.(*widget.Label).SetText(fmt.Sprintf("%s  %s  %+d", line.Location, c.catalog.ItemName(line.ItemID), line.Delta))
+		},
+	)
+	list.OnSelected = func(id widget.ListItemID) {
+		list.UnselectAll()
+		c.editCartLine(id, func() {
+			if len(c.cart) == 0 {
+				dlg.Hide()
+				return
+			}
+			list.Refresh()
+		})
+	}
+
+	submitBtn := widget.NewButton("Submit", func() {
+		if c.submitCart(strings.TrimSpace(reasonInput.Text), strings.TrimSpace(referenceInput.Text)) {
+			dlg.Hide()
+		}
+	})
+	submitBtn.Importance = widget.HighImportance
+
+	clearBtn := widget.NewButton("Clear", func() {
+		dialog.ShowConfirm("Clear cart", fmt.Sprintf("Remove all %d lines from the cart?", len(c.cart)), func(ok bool) {
+			if !ok {
+				return
+			}
+			c.cart = nil
+			c.saveCart()
+			c.updateCartButton()
+			c.updateLocationLabel()
+			dlg.Hide()
+		}, c.window)
+	})
+	clearBtn.Importance = widget.DangerImportance
+
+	header := container.NewVBox(
+		widget.NewLabel("Reason:"),
+		reasonInput,
+		widget.NewLabel("Reference:"),
+		referenceInput,
+	)
+	content := container.NewBorder(header, container.NewHBox(submitBtn, clearBtn), nil, nil, list)
+	dlg = dialog.NewCustom("Cart", "Close", content, c.window)
+	dlg.Resize(fyne.NewSize(500, 600))
+	dlg.Show()
+}
+
+// editCartLine changes the quantity of a cart line or removes it. onChanged
+// is called after either. A new quantity goes through the same stock check
+// as adding the line, and replaces the overrides that check recorded.
+func (c *CommitUI) editCartLine(index int, onChanged func()) {
+	line := c.cart[index]
+	deltaInput := widget.NewEntry()
+	deltaInput.SetText(strconv.Itoa(line.Delta))
+	deltaInput.Validator = func(s string) error {
+		delta, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return errors.New("invalid number")
+		}
+		if delta == 0 {
+			return errors.New("quantity change cannot be zero")
+		}
+		return nil
+	}
+
+	var dlg dialog.Dialog
+	saveBtn := widget.NewButton("Save", func() {
+		if deltaInput.Validate() != nil {
+			return
+		}
+		delta, _ := strconv.Atoi(strings.TrimSpace(deltaInput.Text))
+
+		stock := c.stock
+		if line.Location != c.location {
+			stock, _ = c.api.LocalStock(line.Location)
+		}
+		// The cart total still has the line's old quantity; swap in the new.
+		projected, ok := c.projectedAt(line.Location, line.ItemID, stock, delta-line.Delta)
+		c.applyStockPolicy(line.Location, delta, projected, ok, func(overrides []string) {
+			c.cart[index].Delta = delta
+			c.cart[index].Overrides = append(withoutStockOverrides(line.Overrides), overrides...)
+			c.saveCart()
+			dlg.Hide()
+			c.updateLocationLabel()
+			onChanged()
+		})
+	})
+	saveBtn.Importance = widget.HighImportance
+
+	removeBtn := widget.NewButton("Remove", func() {
+		c.cart = append(c.cart[:index], c.cart[index+1:]...)
+		c.saveCart()
+		dlg.Hide()
+		c.updateCartButton()
+		c.updateLocationLabel()
+		onChanged()
+	})
+	removeBtn.Importance = widget.DangerImportance
+
+	content := container.NewVBox(
+		widget.NewLabel(fmt.Sprintf("%s  %s", line.Location, c.catalog.ItemName(line.ItemID))),
+		widget.NewLabel("Quantity change (negative to remove):"),
+		deltaInput,
+		container.NewHBox(saveBtn, removeBtn),
+	)
+	dlg = dialog.NewCustom("Cart Line", "Close", content, c.window)
+	dlg.Show()
+}
+
+// withoutStockOverrides drops the overrides checkStock records from
+// overrides, keeping the rest (such as an approved unassigned item).
+func withoutStockOverrides(overrides []string) []string {
+	var kept []string
+	for _, o := range overrides {
+		switch o {
+		case queue.OverrideNegativeStockConfirmed, queue.OverrideNegativeStockAllowed, queue.OverrideStockUnknownConfirmed:
+		default:
+			kept = append(kept, o)
+		}
+	}
+	return kept
+}
+
+// submitCart queues the cart as one document and empties it. It reports
+// whether the document was saved.
+func (c *CommitUI) submitCart(reason, reference string) bool {
+	op, ok := c.session.Current()
+	if !ok {
+		c.setError("Session expired - sign in again")
+		return false
+	}
+	c.session.Touch()
+
+	lines := make([]queue.Commit, len(c.cart))
+	for i, line := range c.cart {
+		line.DeviceID = c.deviceID
+		line.OperatorID = op.ID
+		lines[i] = line
+	}
+	log.Printf("[CommitUI] Submitting cart: %d lines, reason=%q, reference=%q\n", len(lines), reason, reference)
+	if _, err := c.queue.SubmitCart(queue.Document{Reason: reason, Reference: reference}, op.ID, lines); err != nil {
+		dialog.ShowError(fmt.Errorf("could not save document: %w", err), c.window)
+		return false
+	}
+	c.cart = nil
+	c.updateCartButton()
+	c.updateLocationLabel()
+	c.setError(fmt.Sprintf("Document of %d lines queued", len(lines)))
+	return true
+}
@@ -1,12 +1,10 @@
 package ui
 
 import (
-	"encoding/csv"
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"os"
-	"path/filepath"
-	"sort"
 	"strconv"
 	"strings"
 
@@ -15,7 +13,10 @@ import (
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/widget"
 	"github.com/larkin1/wmsproject/internal/api"
+	"github.com/larkin1/wmsproject/internal/catalog"
+	"github.com/larkin1/wmsproject/internal/config"
 	"github.com/larkin1/wmsproject/internal/queue"
+	"github.com/larkin1/wmsproject/internal/session"
 )
 
 type CommitUI struct {
@@ -27,215 +28,758 @@ type CommitUI struct {
 	toggleBtn     *widget.Button
 	commitBtn     *widget.Button
 	changeItemBtn *widget.Button
+	recentBtn     *widget.Button
+	cartBtn       *widget.Button
 	error         *widget.RichText
-
-	mode      string
-	location  string
-	itemID    int
-	locations map[string][]int
-	items     map[string]int
-	items_r   map[int]string
-
-	api       *api.Client
-	queue     *queue.Queue
-	basePath  string
-	window    fyne.Window // Store the window for dialogs
+	loading       *widget.ProgressBarInfinite
+	staleLabel    *widget.Label
+
+	mode     string
+	location string
+	itemID   int
+	stock    *api.LocationStock // overview totals for the scanned location
+
+	// In TRANSFER mode location is the source and destination is scanned
+	// after the item is chosen. Once set, the next location scan starts a
+	// new transfer.
+	destination string
+
+	cart []queue.Commit // lines to submit as one document; see cart.go
+
+	// With confirmItemScan set, the item must be scanned after the location
+	// before committing. An item scanned at a location it isn't assigned to
+	// needs a supervisor, whose approval is recorded on the commit.
+	confirmItemScan bool
+	itemConfirmed   bool
+	supervisorID    int
+	itemOverrides   []string
+
+	// Network refreshes run in the background under ctx, which is cancelled
+	// when the screen goes away. scanCancel aborts the refresh for the
+	// previous scan when a new one comes in.
+	ctx        context.Context
+	cancel     context.CancelFunc
+	scanCancel context.CancelFunc
+	refreshing int // background refreshes in flight; touched on the UI thread only
+
+	api         api.Backend
+	catalog     *catalog.Catalog
+	queue       *queue.Queue
+	deviceID    string
+	window      fyne.Window // Store the window for dialogs
+	stockPolicy config.NegativeStockPolicy
+	session     *session.Manager
 }
 
-func NewCommitUI(apiClient *api.Client, commitQueue *queue.Queue, basePath string) *CommitUI {
+func NewCommitUI(apiClient api.Backend, commitQueue *queue.Queue, deviceID string) *CommitUI {
 	c := &CommitUI{
-		api:       apiClient,
-		queue:     commitQueue,
-		basePath:  basePath,
-		mode:      "ADD",
-		items:     make(map[string]int),
-		items_r:   make(map[int]string),
-		locations: make(map[string][]int),
+		deviceID:    deviceID,
+		api:         apiClient,
+		catalog:     catalog.New(apiClient),
+		queue:       commitQueue,
+		mode:        "ADD",
+		stockPolicy: config.NegativeStockWarn,
 	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
 
 	return c
 }
 
-func (c *CommitUI) loadItems() {
-	log.Println("[CommitUI] loadItems() called")
-	// Clear old data
-	c.items = make(map[string]int)
-	c.items_r = make(map[int]string)
+// refreshCatalog syncs items and locations in the background. Lookups keep
+// answering from the local copy meanwhile, so the screen is usable at once.
+func (c *CommitUI) refreshCatalog() {
+	ctx := c.ctx
+	c.startLoading()
 
-	itemsCSV := filepath.Join(c.basePath, "items.csv")
-	log.Printf("[CommitUI] Loading items from CSV: %s\n", itemsCSV)
+	go func() {
+		if err := c.catalog.Sync(ctx); err != nil {
+			log.Printf("[CommitUI] Catalog sync error: %v\n", err)
+		}
 
-	// Always try to fetch fresh data from API
-	err := c.api.ExportItemsToCSV(itemsCSV)
-	if err != nil {
-		log.Printf("[CommitUI] ExportItemsToCSV error: %v (will use cached JSON)\n", err)
-		// Try to load from cache instead
-		c.loadItemsFromCache()
+		fyne.Do(func() {
+			defer c.stopLoading()
+			if ctx.Err() != nil {
+				return
+			}
+			c.updateStaleWarning()
+		})
+	}()
+}
+
+// updateStaleWarning shows how old the catalog is once it is old enough that
+// new items or locations may be missing.
+func (c *CommitUI) updateStaleWarning() {
+	if warning := c.catalog.StaleWarning(); warning != "" {
+		c.staleLabel.SetText(warning)
+		c.staleLabel.Show()
+	} else {
+		c.staleLabel.Hide()
+	}
+}
+
+func (c *CommitUI) onScanned(text string) {
+	log.Printf("[CommitUI] onScanned: '%s'\n", text)
+	c.session.Touch()
+	defer c.updateScanPrompt()
+
+	code := strings.TrimSpace(text)
+	if item, ok := c.scannedItem(code); ok {
+		c.onItemScanned(item)
+		return
+	}
+	if c.mode == "TRANSFER" && c.location != "" && c.itemID != 0 && c.destination == "" {
+		c.setDestination(code)
 		return
 	}
 
-	log.Println("[CommitUI] ExportItemsToCSV succeeded")
+	c.location = code
+	c.destination = ""
+	c.loadStock()
+	c.refreshScan()
+
+	if itemIDs, ok := c.locationItems(c.location); ok {
+		log.Printf("[CommitUI] Location found with items: %v\n", itemIDs)
+		// Location exists
+		if len(itemIDs) == 0 {
+			c.setError("Location has no items")
+			return
+		}
 
-	// Load from CSV (fresh from API)
-	if !c.loadItemsFromCSV(itemsCSV) {
-		log.Println("[CommitUI] CSV load failed, trying cache")
-		c.loadItemsFromCache()
+		if len(itemIDs) > 1 {
+			log.Println("[CommitUI] Multiple items, showing dialog")
+			c.showItemSelectDialog(itemIDs)
+			return
+		} else if len(itemIDs) == 1 {
+			c.setItem(itemIDs[0])
+			log.Printf("[CommitUI] Single item, auto-selected: %d\n", c.itemID)
+		}
+	} else {
+		// Location doesn't exist - automatically show item picker
+		log.Printf("[CommitUI] Location '%s' not found, showing item picker\n", c.location)
+		c.setError(fmt.Sprintf("New location '%s' - select an item below:", c.location))
+		c.setItem(0)
+		c.showItemSearch()
+		return
 	}
+
+	c.updateLocationLabel()
 }
 
-func (c *CommitUI) loadItemsFromCSV(itemsCSV string) bool {
-	file, err := os.Open(itemsCSV)
-	if err != nil {
-		log.Printf("[CommitUI] Cannot open items.csv: %v\n", err)
-		return false
+// scannedItem returns the item whose barcode was scanned. Once a location is
+// scanned, a code that is an item barcode and not a location picks the item.
+func (c *CommitUI) scannedItem(code string) (api.Item, bool) {
+	if c.location == "" {
+		return api.Item{}, false
 	}
-	defer file.Close()
+	if _, isLocation := c.locationItems(code); isLocation {
+		return api.Item{}, false
+	}
+	return c.catalog.ItemByBarcode(code)
+}
 
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
-	if err != nil {
-		log.Printf("[CommitUI] CSV read error: %v\n", err)
-		return false
+// onItemScanned selects a scanned item if it belongs at the location, and
+// otherwise asks for a supervisor to allow it.
+func (c *CommitUI) onItemScanned(item api.Item) {
+	log.Printf("[CommitUI] Item scanned: %s (ID: %d)\n", item.Name, item.ID)
+	itemIDs, _ := c.locationItems(c.location)
+	if containsInt(itemIDs, item.ID) {
+		c.confirmItem(item.ID, 0, nil)
+		return
 	}
 
-	log.Printf("[CommitUI] CSV has %d records (including header)\n", len(records))
+	c.setError(fmt.Sprintf("%s is not assigned to %s", item.Name, c.location))
+	location := c.location
+	reason := fmt.Sprintf("%s is not assigned to %s.\nA supervisor can allow it.", item.Name, location)
+	showSupervisorApproval(c.window, c.api, reason, func(sup api.Operator) {
+		if c.location != location {
+			return
+		}
+		c.confirmItem(item.ID, sup.ID, []string{queue.OverrideUnassignedItem})
+		c.updateScanPrompt()
+	})
+}
 
-	if len(records) == 0 {
-		log.Println("[CommitUI] CSV is empty")
-		return false
+// setItem selects an item without confirming it.
+func (c *CommitUI) setItem(id int) {
+	c.itemID = id
+	c.itemConfirmed = false
+	c.supervisorID = 0
+	c.itemOverrides = nil
+}
+
+// confirmItem selects an item the operator scanned, with the supervisor and
+// overrides that allowed it, if any.
+func (c *CommitUI) confirmItem(id, supervisorID int, overrides []string) {
+	c.itemID = id
+	c.itemConfirmed = true
+	c.supervisorID = supervisorID
+	c.itemOverrides = overrides
+	c.updateLocationLabel()
+}
+
+// setDestination sets where a transfer goes.
+func (c *CommitUI) setDestination(code string) {
+	if code == c.location {
+		c.setError("Destination must be a different location")
+		return
 	}
+	c.destination = code
+	c.updateLocationLabel()
+}
 
-	for i, record := range records {
-		if i == 0 {
-			log.Printf("[CommitUI] Header: %v\n", record)
-			continue // skip header
-		}
-		if len(record) < 2 {
-			log.Printf("[CommitUI] Record %d has %d fields, skipping\n", i, len(record))
-			continue
-		}
-		id, err := strconv.Atoi(strings.TrimSpace(record[0]))
-		if err != nil {
-			log.Printf("[CommitUI] Cannot parse ID '%s': %v\n", record[0], err)
-			continue
+// updateScanPrompt tells the operator what to scan next.
+func (c *CommitUI) updateScanPrompt() {
+	switch {
+	case c.confirmItemScan && c.location != "" && !c.itemConfirmed:
+		c.scannerInput.SetPlaceHolder("Scan item to confirm (or a new location)...")
+	case c.mode == "TRANSFER" && c.location == "":
+		c.scannerInput.SetPlaceHolder("Scan source location...")
+	case c.mode == "TRANSFER" && c.itemID != 0 && c.destination == "":
+		c.scannerInput.SetPlaceHolder("Scan destination location...")
+	default:
+		c.scannerInput.SetPlaceHolder("Scan location code...")
+	}
+}
+
+// locationItems returns the items at location: those in the catalog plus any
+// assigned on this device and not yet synced. ok is false for a location
+// neither knows.
+func (c *CommitUI) locationItems(location string) (itemIDs []int, ok bool) {
+	loc, ok := c.catalog.Location(location)
+	itemIDs = append(itemIDs, loc.Items...)
+	for _, id := range c.queue.PendingItems(location) {
+		if !containsInt(itemIDs, id) {
+			itemIDs = append(itemIDs, id)
 		}
-		name := strings.TrimSpace(record[1])
-		if name != "" {
-			c.items[name] = id
-			c.items_r[id] = name
-			log.Printf("[CommitUI] Loaded item: %s (ID: %d)\n", name, id)
+		ok = true
+	}
+	return itemIDs, ok
+}
+
+func containsInt(ids []int, id int) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
 		}
 	}
+	return false
+}
 
-	log.Printf("[CommitUI] Total items loaded from CSV: %d\n", len(c.items))
-	return len(c.items) > 0
+// offerAssignment asks whether to record an item at a location when it
+// isn't assigned there yet, creating the location if it is new. Nothing is
+// written without the operator's confirmation.
+func (c *CommitUI) offerAssignment(location string, itemID int) {
+	if location == "" || itemID == 0 {
+		return
+	}
+	itemIDs, known := c.locationItems(location)
+	if containsInt(itemIDs, itemID) {
+		return
+	}
+
+	itemName := c.catalog.ItemName(itemID)
+	title, msg := "Assign Item", fmt.Sprintf("%s is not assigned to %s.\nAssign it?", itemName, location)
+	if !known {
+		title, msg = "Create Location", fmt.Sprintf("%s is not a known location.\nCreate it with %s?", location, itemName)
+	}
+	dialog.ShowConfirm(title, msg, func(confirmed bool) {
+		if confirmed {
+			c.assign(location, itemID)
+		}
+	}, c.window)
 }
 
-func (c *CommitUI) loadItemsFromCache() {
-	log.Println("[CommitUI] loadItemsFromCache() called")
-	cachePath := filepath.Join(c.basePath, "items.cache.json")
+// assign queues the assignment of an item to a location. It is sent with the
+// commits, and shows up in locationItems straight away.
+func (c *CommitUI) assign(location string, itemID int) {
+	op, ok := c.session.Current()
+	if !ok {
+		c.setError("Session expired - sign in again")
+		return
+	}
+	c.session.Touch()
 
-	data, err := os.ReadFile(cachePath)
+	_, err := c.queue.SubmitAssignment(queue.Assignment{
+		DeviceID:   c.deviceID,
+		OperatorID: op.ID,
+		Location:   location,
+		ItemID:     itemID,
+	})
 	if err != nil {
-		log.Printf("[CommitUI] Cache not found: %v\n", err)
+		c.setError(fmt.Sprintf("Could not save assignment: %v", err))
 		return
 	}
-
-	// Minimal parsing of cache JSON
-	// Instead of full unmarshal, we'll use the API method that already handles this
-	log.Printf("[CommitUI] Cache file exists (%d bytes), will reload items from API\n", len(data))
+	c.setError(fmt.Sprintf("%s assigned to %s", c.catalog.ItemName(itemID), location))
 }
 
-func (c *CommitUI) loadLocations() {
-	log.Println("[CommitUI] loadLocations() called")
-	locationsData, err := c.api.FetchLocations()
+// loadStock shows the cached stock for the scanned location straight away;
+// refreshScan replaces it with the server's figure.
+func (c *CommitUI) loadStock() {
+	c.stock = nil
+	stock, err := c.api.LocalStock(c.location)
 	if err != nil {
-		log.Printf("[CommitUI] FetchLocations error: %v\n", err)
+		log.Printf("[CommitUI] No cached stock: %v\n", err)
 		return
 	}
+	c.stock = stock
+}
 
-	c.locations = make(map[string][]int)
-	for _, loc := range locationsData {
-		c.locations[loc.LocationName] = loc.Items
-		log.Printf("[CommitUI] Loaded location: %s with items %v\n", loc.LocationName, loc.Items)
+// refreshScan fetches the scanned location's items and stock in the
+// background. A newer scan cancels it, and its result is dropped if the
+// operator has moved on.
+func (c *CommitUI) refreshScan() {
+	if c.scanCancel != nil {
+		c.scanCancel()
 	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.scanCancel = cancel
+	location := c.location
+	c.startLoading()
+
+	go func() {
+		if err := c.catalog.Sync(ctx); err != nil {
+			log.Printf("[CommitUI] Catalog sync error: %v\n", err)
+		}
+		stock, err := c.api.FetchStock(ctx, location)
+		if err != nil {
+			log.Printf("[CommitUI] FetchStock error: %v\n", err)
+		}
 
-	log.Printf("[CommitUI] Total locations loaded: %d\n", len(c.locations))
+		fyne.Do(func() {
+			defer c.stopLoading()
+			if ctx.Err() != nil || c.location != location {
+				return
+			}
+			c.updateStaleWarning()
+			if stock != nil {
+				c.stock = stock
+			}
+			if c.itemID != 0 {
+				c.updateLocationLabel()
+			}
+		})
+	}()
 }
 
-func (c *CommitUI) onScanned(text string) {
-	log.Printf("[CommitUI] onScanned: '%s'\n", text)
-	c.location = strings.TrimSpace(text)
-	c.loadLocations()
+func (c *CommitUI) startLoading() {
+	c.refreshing++
+	if c.loading != nil {
+		c.loading.Show()
+	}
+}
 
-	if itemIDs, ok := c.locations[c.location]; ok {
-		log.Printf("[CommitUI] Location found with items: %v\n", itemIDs)
-		// Location exists
-		if len(itemIDs) == 0 {
-			c.setError("Location has no items")
-			return
-		}
+func (c *CommitUI) stopLoading() {
+	c.refreshing--
+	if c.refreshing <= 0 && c.loading != nil {
+		c.refreshing = 0
+		c.loading.Hide()
+	}
+}
 
-		if len(itemIDs) > 1 {
-			log.Println("[CommitUI] Multiple items, showing dialog")
-			c.showItemSelectDialog(itemIDs)
-			return
-		} else if len(itemIDs) == 1 {
-			c.itemID = itemIDs[0]
-			log.Printf("[CommitUI] Single item, auto-selected: %d\n", c.itemID)
+// onHandText describes the quantity at the current location: the server total
+// from the overview view plus whatever this device still has queued. The
+// server total includes what this device synced since it was fetched.
+func (c *CommitUI) onHandText() string {
+	if c.stock == nil {
+		if pending := c.queue.PendingDelta(c.location, c.itemID); pending != 0 {
+			return fmt.Sprintf("On hand: unknown (%+d pending)", pending)
 		}
-	} else {
-		// Location doesn't exist - automatically show item picker
-		log.Printf("[CommitUI] Location '%s' not found, showing item picker\n", c.location)
-		c.setError(fmt.Sprintf("New location '%s' - select an item below:", c.location))
-		c.itemID = 0
-		c.showItemSearch()
-		return
+		return "On hand: unknown (offline)"
 	}
 
-	c.updateLocationLabel()
+	pending, synced := c.queue.DeltaSince(c.location, c.itemID, c.stock.FetchedAt)
+	server := c.stock.Qty(c.itemID) + synced
+	text := fmt.Sprintf("On hand: %d", server+pending)
+	if pending != 0 {
+		text += fmt.Sprintf(" (server %d, %+d pending)", server, pending)
+	}
+	if c.stock.Cached {
+		status := "Offline"
+		if c.refreshing > 0 {
+			status = "Updating"
+		}
+		text += fmt.Sprintf("\n%s - server count as of %s", status, c.stock.FetchedAt.Local().Format("Jan 2 15:04"))
+	}
+	return text
 }
 
 func (c *CommitUI) updateLocationLabel() {
 	if c.location != "" {
-		itemName := c.items_r[c.itemID]
-		if itemName == "" {
-			itemName = fmt.Sprintf("ID: %d", c.itemID)
+		text := fmt.Sprintf("Location: %s\nItem: %s", c.location, c.catalog.ItemName(c.itemID))
+		if c.mode == "TRANSFER" {
+			to := c.destination
+			if to == "" {
+				to = "(scan destination)"
+			}
+			text = fmt.Sprintf("From: %s\nTo: %s\nItem: %s", c.location, to, c.catalog.ItemName(c.itemID))
+		}
+		if c.confirmItemScan && c.itemID != 0 && !c.itemConfirmed {
+			text += " (scan to confirm)"
 		}
-		c.locationLabel.SetText(fmt.Sprintf("Location: %s\nItem: %s", c.location, itemName))
+		if c.itemID != 0 {
+			text += "\n" + c.onHandText()
+		}
+		c.locationLabel.SetText(text)
 		c.setError("")
 	}
 }
 
 func (c *CommitUI) toggleMode() {
-	if c.mode == "ADD" {
+	switch c.mode {
+	case "ADD":
 		c.mode = "SUB"
-	} else {
+	case "SUB":
+		c.mode = "TRANSFER"
+	case "TRANSFER":
+		c.mode = "COUNT"
+	default:
 		c.mode = "ADD"
 	}
+	c.destination = ""
 	c.toggleBtn.SetText("Mode: " + c.mode)
+	if c.mode == "COUNT" {
+		c.deltaInput.SetPlaceHolder("Enter counted quantity")
+	} else {
+		c.deltaInput.SetPlaceHolder("Enter quantity")
+	}
+	c.updateLocationLabel()
+	c.updateScanPrompt()
 }
 
-func (c *CommitUI) commit() {
+// enteredQty checks that a location and item are selected (and confirmed,
+// if required) and returns the quantity entered.
+func (c *CommitUI) enteredQty() (int, bool) {
 	if c.location == "" || c.itemID == 0 {
 		c.setError("No location or item selected")
-		return
+		return 0, false
+	}
+	if c.confirmItemScan && !c.itemConfirmed {
+		c.setError("Scan the item to confirm it")
+		return 0, false
 	}
 
 	qty, err := strconv.Atoi(c.deltaInput.Text)
 	if err != nil {
 		c.setError("Invalid number")
+		return 0, false
+	}
+	return qty, true
+}
+
+func (c *CommitUI) commit() {
+	qty, ok := c.enteredQty()
+	if !ok {
 		return
 	}
 
-	if c.mode == "SUB" {
+	switch c.mode {
+	case "SUB":
 		qty = -qty
+	case "TRANSFER":
+		if c.destination == "" {
+			c.setError("Scan the destination location")
+			return
+		}
+		if qty <= 0 {
+			c.setError("Transfer quantity must be positive")
+			return
+		}
+		// The source is the scanned location, so the usual check covers it.
+		c.checkStock(-qty, func(overrides []string) {
+			c.submitTransfer(qty, overrides)
+		})
+		return
+	case "COUNT":
+		c.submitCount(qty)
+		return
+	}
+
+	c.checkStock(qty, func(overrides []string) {
+		c.submit(queue.Commit{Delta: qty}, overrides)
+	})
+}
+
+// submit queues commit for the current location and item. It reports whether
+// the commit was saved.
+func (c *CommitUI) submit(commit queue.Commit, overrides []string) bool {
+	op, ok := c.session.Current()
+	if !ok {
+		c.setError("Session expired - sign in again")
+		return false
+	}
+	c.session.Touch()
+
+	commit.DeviceID = c.deviceID
+	commit.OperatorID = op.ID
+	commit.Location = c.location
+	commit.ItemID = c.itemID
+	commit.Overrides = append(append([]string(nil), c.itemOverrides...), overrides...)
+	commit.SupervisorID = c.supervisorID
+	log.Printf("[CommitUI] Submitting commit: location=%s, itemID=%d, qty=%d, kind=%q, overrides=%v\n", c.location, c.itemID, commit.Delta, commit.Kind, commit.Overrides)
+	if _, err := c.queue.SubmitCommit(commit); err != nil {
+		c.setError(fmt.Sprintf("Could not save commit: %v", err))
+		return false
+	}
+	c.deltaInput.SetText("")
+	c.updateLocationLabel()
+	return true
+}
+
+// submitCount turns a physical count into the delta that brings the expected
+// quantity (server total plus pending commits) to it. The commit carries the
+// count, so the server can refuse it if its total has moved since.
+func (c *CommitUI) submitCount(counted int) {
+	if counted < 0 {
+		c.setError("Counted quantity cannot be negative")
+		return
+	}
+	// The cart isn't sent yet, so the count doesn't reckon with it; the
+	// server checks counted_qty - delta against its own total.
+	expected, ok := c.onHandAt(c.location, c.itemID, c.stock)
+	if !ok {
+		c.setError("On hand unknown - connect to the server before counting")
+		return
+	}
+
+	delta := counted - expected
+	saved := c.submit(queue.Commit{
+		Delta:      delta,
+		Kind:       queue.KindCountAdjustment,
+		CountedQty: &counted,
+	}, nil)
+	if !saved {
+		return
 	}
+	if delta == 0 {
+		c.setError(fmt.Sprintf("Count of %d matches", counted))
+	} else {
+		c.setError(fmt.Sprintf("Count of %d recorded, adjusted by %+d", counted, delta))
+	}
+}
 
-	log.Printf("[CommitUI] Submitting commit: location=%s, itemID=%d, qty=%d\n", c.location, c.itemID, qty)
-	c.queue.SubmitCommit("TOUGHPAD01", c.location, qty, c.itemID)
+// submitTransfer queues the move of qty from the scanned location to the
+// destination as a linked pair of commits. Overrides and approvals apply to
+// the source, where the stock is taken from.
+func (c *CommitUI) submitTransfer(qty int, overrides []string) {
+	op, ok := c.session.Current()
+	if !ok {
+		c.setError("Session expired - sign in again")
+		return
+	}
+	c.session.Touch()
+
+	overrides = append(append([]string(nil), c.itemOverrides...), overrides...)
+	log.Printf("[CommitUI] Submitting transfer: from=%s, to=%s, itemID=%d, qty=%d, overrides=%v\n", c.location, c.destination, c.itemID, qty, overrides)
+	_, _, err := c.queue.SubmitTransfer(queue.Commit{
+		DeviceID:     c.deviceID,
+		OperatorID:   op.ID,
+		Location:     c.location,
+		Delta:        -qty,
+		ItemID:       c.itemID,
+		Overrides:    overrides,
+		SupervisorID: c.supervisorID,
+	}, queue.Commit{
+		DeviceID:   c.deviceID,
+		OperatorID: op.ID,
+		Location:   c.destination,
+		Delta:      qty,
+		ItemID:     c.itemID,
+	})
+	if err != nil {
+		c.setError(fmt.Sprintf("Could not save transfer: %v", err))
+		return
+	}
 	c.deltaInput.SetText("")
-	c.setError("")
+	c.updateLocationLabel()
+	c.setError(fmt.Sprintf("Moved %d to %s", qty, c.destination))
+	c.offerAssignment(c.destination, c.itemID)
+}
+
+// projectedOnHand returns what the quantity at the current location would be
+// after delta: server total plus local commits it doesn't include yet and cart
+// lines plus delta. ok is false when the server total has never been fetched
+// for this location.
+func (c *CommitUI) projectedOnHand(delta int) (projected int, ok bool) {
+	return c.projectedAt(c.location, c.itemID, c.stock, delta)
+}
+
+// projectedAt is projectedOnHand for any location, given its server total,
+// nil if never fetched.
+func (c *CommitUI) projectedAt(location string, itemID int, stock *api.LocationStock, delta int) (projected int, ok bool) {
+	onHand, ok := c.onHandAt(location, itemID, stock)
+	if !ok {
+		return 0, false
+	}
+	return onHand + c.cartDelta(location, itemID) + delta, true
+}
+
+// onHandAt returns the server total at location plus the queued commits it
+// doesn't include yet, leaving out the cart. ok is false if stock is nil.
+func (c *CommitUI) onHandAt(location string, itemID int, stock *api.LocationStock) (onHand int, ok bool) {
+	if stock == nil {
+		return 0, false
+	}
+	pending, synced := c.queue.DeltaSince(location, itemID, stock.FetchedAt)
+	return stock.Qty(itemID) + pending + synced, true
+}
+
+// checkStock applies the negative stock policy to a removal and calls submit
+// with the override to record, if any. Without a known server total there is
+// nothing to check against: under block the operator must confirm the removal
+// blind, and the commit records it; otherwise it goes through unchanged.
+func (c *CommitUI) checkStock(delta int, submit func(overrides []string)) {
+	projected, ok := c.projectedOnHand(delta)
+	c.applyStockPolicy(c.location, delta, projected, ok, submit)
+}
+
+// applyStockPolicy is checkStock for a removal of delta at location that
+// leaves projected, if ok.
+func (c *CommitUI) applyStockPolicy(location string, delta, projected int, ok bool, submit func(overrides []string)) {
+	if delta >= 0 || (ok && projected >= 0) {
+		submit(nil)
+		return
+	}
+
+	if !ok {
+		if c.stockPolicy != config.NegativeStockBlock {
+			submit(nil)
+			return
+		}
+		log.Printf("[CommitUI] Removal of %d with unknown stock at %s\n", -delta, location)
+		msg := fmt.Sprintf("The stock at %s has never been fetched, so removing %d can't be checked.\nCommit anyway?", location, -delta)
+		dialog.ShowConfirm("Stock unknown", msg, func(confirmed bool) {
+			if confirmed {
+				submit([]string{queue.OverrideStockUnknownConfirmed})
+			} else {
+				c.setError("Commit cancelled")
+			}
+		}, c.window)
+		return
+	}
+
+	onHand := projected - delta
+	log.Printf("[CommitUI] Removal of %d would leave %d (policy %s)\n", -delta, projected, c.stockPolicy)
+	switch c.stockPolicy {
+	case config.NegativeStockBlock:
+		c.setError(fmt.Sprintf("Cannot remove %d: only %d on hand", -delta, onHand))
+	case config.NegativeStockAllow:
+		submit([]string{queue.OverrideNegativeStockAllowed})
+	default:
+		msg := fmt.Sprintf("Only %d on hand. Removing %d leaves %d.\nCommit anyway?", onHand, -delta, projected)
+		dialog.ShowConfirm("Not enough stock", msg, func(confirmed bool) {
+			if confirmed {
+				submit([]string{queue.OverrideNegativeStockConfirmed})
+			} else {
+				c.setError("Commit cancelled")
+			}
+		}, c.window)
+	}
+}
+
+// showRecent lists the commits made on this device, pending and synced,
+// newest first. Tapping one offers to void it.
+func (c *CommitUI) showRecent() {
+	recent, err := c.queue.RecentCommits(recentLimit)
+	if err != nil {
+		c.setError(fmt.Sprintf("Could not read recent commits: %v", err))
+		return
+	}
+	if len(recent) == 0 {
+		dialog.ShowInformation("Recent Commits", "No commits made on this device yet.", c.window)
+		return
+	}
+
+	var dlg dialog.Dialog
+	list := widget.NewList(
+		func() int {
+			return len(recent)
+		},
+		func() fyne.CanvasObject {
+			return widget.NewLabel("")
+		},
+		func(id widget.ListItemID, obj fyne.CanvasObject) {
+			obj.(*widget.Label).SetText(c.recentText(recent[id]))
+		},
+	)
+	list.OnSelected = func(id widget.ListItemID) {
+		list.UnselectAll()
+		rc := recent[id]
+		switch {
+		case rc.Commit.Kind == queue.KindVoid:
+			c.setError("A void cannot be voided")
+		case rc.Voided || rc.Cancelled:
+			c.setError("Commit is already voided")
+		default:
+			c.showVoid(rc, dlg.Hide)
+		}
+	}
+
+	dlg = dialog.NewCustom("Recent Commits", "Close", list, c.window)
+	dlg.Resize(fyne.NewSize(500, 600))
+	dlg.Show()
+}
+
+// recentLimit is how many commits the recent commits list shows.
+const recentLimit = 50
+
+func (c *CommitUI) recentText(rc queue.RecentCommit) string {
+	commit := rc.Commit
+	text := fmt.Sprintf("%s  %s  %s  %+d", commit.CapturedAt.Local().Format("Jan 2 15:04"), commit.Location, c.catalog.ItemName(commit.ItemID), commit.Delta)
+	if commit.Kind == queue.KindVoid {
+		text = "VOID " + text + " - " + commit.VoidReason
+	}
+	switch {
+	case rc.Cancelled:
+		text += " (cancelled)"
+	case rc.Voided:
+		text += " (voided)"
+	case rc.Synced:
+		text += " (synced)"
+	default:
+		text += " (pending)"
+	}
+	return text
+}
+
+// showVoid asks for the reason to void a commit and voids it. onVoided is
+// called once it is.
+func (c *CommitUI) showVoid(rc queue.RecentCommit, onVoided func()) {
+	reasonInput := widget.NewEntry()
+	reasonInput.SetPlaceHolder("Why is this commit wrong?")
+	reasonInput.Validator = func(s string) error {
+		if strings.TrimSpace(s) == "" {
+			return errors.New("a reason is required")
+		}
+		return nil
+	}
+
+	msg := fmt.Sprintf("Reverse %+d of %s at %s?", rc.Commit.Delta, c.catalog.ItemName(rc.Commit.ItemID), rc.Commit.Location)
+	if rc.Commit.TransferID != "" {
+		msg = "This commit is part of a transfer. Both legs will be reversed."
+	}
+	items := []*widget.FormItem{
+		widget.NewFormItem("", widget.NewLabel(msg)),
+		widget.NewFormItem("Reason", reasonInput),
+	}
+	dialog.ShowForm("Void Commit", "Void", "Cancel", items, func(confirmed bool) {
+		if !confirmed {
+			return
+		}
+		op, ok := c.session.Current()
+		if !ok {
+			c.setError("Session expired - sign in again")
+			return
+		}
+		c.session.Touch()
+
+		if _, err := c.queue.Void(rc.Commit.ID, strings.TrimSpace(reasonInput.Text), op.ID); err != nil {
+			dialog.ShowError(err, c.window)
+			return
+		}
+		onVoided()
+		c.updateLocationLabel()
+		c.setError("Commit voided")
+	}, c.window)
 }
 
 func (c *CommitUI) setError(msg string) {
@@ -278,10 +822,7 @@ func (c *CommitUI) showItemSelectDialog(itemIDs []int) {
 	itemMap := make(map[string]int)
 
 	for i, id := range itemIDs {
-		name := c.items_r[id]
-		if name == "" {
-			name = fmt.Sprintf("ID: %d", id)
-		}
+		name := c.catalog.ItemName(id)
 		options[i] = name
 		itemMap[name] = id
 		log.Printf("[CommitUI] Dialog option %d: %s (ID: %d)\n", i, name, id)
@@ -291,14 +832,14 @@ func (c *CommitUI) showItemSelectDialog(itemIDs []int) {
 	selectWidget := widget.NewSelect(options, func(value string) {
 		log.Printf("[CommitUI] Item selected from dialog: %s\n", value)
 		if id, ok := itemMap[value]; ok {
-			c.itemID = id
+			c.setItem(id)
 			c.updateLocationLabel() // Update label after selection
 		}
 	})
 	selectWidget.PlaceHolder = "Select item..."
 	if len(options) > 0 {
 		selectWidget.SetSelected(options[0])
-		c.itemID = itemMap[options[0]]
+		c.setItem(itemMap[options[0]])
 	}
 
 	// Create form
@@ -319,21 +860,24 @@ func (c *CommitUI) showItemSelectDialog(itemIDs []int) {
 
 func (c *CommitUI) showItemSearch() {
 	log.Println("[CommitUI] showItemSearch called")
-	// Ensure items are loaded
-	c.loadItems()
 
 	// Build sorted list of item names
 	var itemNames []string
-	for name := range c.items {
-		itemNames = append(itemNames, name)
+	itemIDs := make(map[string]int)
+	for _, item := range c.catalog.Items() {
+		itemNames = append(itemNames, item.Name)
+		itemIDs[item.Name] = item.ID
 	}
-	sort.Strings(itemNames)
 
 	log.Printf("[CommitUI] showItemSearch: found %d items\n", len(itemNames))
 
 	if len(itemNames) == 0 {
 		log.Println("[CommitUI] No items loaded!")
-		c.setError("No items loaded from database")
+		if c.refreshing > 0 {
+			c.setError("Still loading items - try again in a moment")
+		} else {
+			c.setError("No items loaded from database")
+		}
 		return
 	}
 
@@ -344,8 +888,8 @@ func (c *CommitUI) showItemSearch() {
 	// Create select widget (will be filtered)
 	selectWidget := widget.NewSelect(itemNames, func(value string) {
 		log.Printf("[CommitUI] Item selected from search: %s\n", value)
-		if id, ok := c.items[value]; ok {
-			c.itemID = id
+		if id, ok := itemIDs[value]; ok {
+			c.setItem(id)
 			log.Printf("[CommitUI] Item ID set to: %d\n", c.itemID)
 			c.updateLocationLabel()
 		}
@@ -379,6 +923,7 @@ func (c *CommitUI) showItemSearch() {
 	dlg.SetOnClosed(func() {
 		log.Println("[CommitUI] Item search dialog closed")
 		c.updateLocationLabel() // Update label when dialog closes
+		c.offerAssignment(c.location, c.itemID)
 	})
 	dlg.Show()
 	log.Println("[CommitUI] Item search dialog shown")
@@ -386,9 +931,13 @@ func (c *CommitUI) showItemSearch() {
 
 func (c *CommitUI) CreateRenderer() fyne.WidgetRenderer {
 	log.Println("[CommitUI] CreateRenderer called")
-	// Load data when renderer is created
-	c.loadItems()
-	c.loadLocations()
+	c.loading = widget.NewProgressBarInfinite()
+	c.loading.Hide()
+
+	c.staleLabel = widget.NewLabel("")
+	c.staleLabel.Importance = widget.WarningImportance
+	c.staleLabel.Hide()
+	c.updateStaleWarning()
 
 	c.scannerInput = widget.NewEntry()
 	c.scannerInput.SetPlaceHolder("Scan location code...")
@@ -415,24 +964,74 @@ func (c *CommitUI) CreateRenderer() fyne.WidgetRenderer {
 		c.showItemSearch()
 	})
 
+	c.recentBtn = widget.NewButton("Recent", func() {
+		c.showRecent()
+	})
+
+	addToCartBtn := widget.NewButton("Add to Cart", func() {
+		c.addToCart()
+	})
+	c.cartBtn = widget.NewButton("", func() {
+		c.showCart()
+	})
+
 	c.error = widget.NewRichTextFromMarkdown("")
+	c.loadCart()
 
 	buttons := container.NewHBox(
 		c.toggleBtn,
 		c.commitBtn,
 		c.changeItemBtn,
+		c.recentBtn,
+	)
+	cartButtons := container.NewHBox(
+		addToCartBtn,
+		c.cartBtn,
 	)
 
 	vbox := container.NewVBox(
+		NewSyncBadge(c.queue),
+		c.staleLabel,
 		c.scannerInput,
+		c.loading,
 		c.locationLabel,
 		c.deltaInput,
 		buttons,
+		cartButtons,
 		c.error,
 	)
 
+	// Show the local catalog at once and refresh it without blocking input
+	c.refreshCatalog()
+
 	log.Println("[CommitUI] Renderer created successfully")
-	return widget.NewSimpleRenderer(vbox)
+	return &cancelRenderer{WidgetRenderer: widget.NewSimpleRenderer(vbox), cancel: c.cancel}
+}
+
+// cancelRenderer cancels background work when the widget is destroyed.
+type cancelRenderer struct {
+	fyne.WidgetRenderer
+	cancel context.CancelFunc
+}
+
+func (r *cancelRenderer) Destroy() {
+	r.cancel()
+	r.WidgetRenderer.Destroy()
+}
+
+// SetStockPolicy sets how removals that would go below zero are handled.
+func (c *CommitUI) SetStockPolicy(policy config.NegativeStockPolicy) {
+	c.stockPolicy = policy
+}
+
+// SetItemScanConfirm turns on the scan-item-to-confirm step.
+func (c *CommitUI) SetItemScanConfirm(confirm bool) {
+	c.confirmItemScan = confirm
+}
+
+// SetSession sets the operator session that commits are attributed to.
+func (c *CommitUI) SetSession(s *session.Manager) {
+	c.session = s
 }
 
 // SetWindow allows main to pass the window reference
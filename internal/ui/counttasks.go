@@ -0,0 +1,460 @@
+package ui
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"github.com/larkin1/wmsproject/internal/api"
+	"github.com/larkin1/wmsproject/internal/catalog"
+	"github.com/larkin1/wmsproject/internal/queue"
+	"github.com/larkin1/wmsproject/internal/session"
+)
+
+// CountTasksUI lists the count tasks assigned to this device and walks the
+// operator through one: scan the location, count each item there, then
+// review and finish. Finishing queues a count commit per variance and a
+// result that closes the task.
+type CountTasksUI struct {
+	widget.BaseWidget
+
+	content *fyne.Container // the task list, or the step of a count in progress
+	list    *widget.List
+	status  *widget.Label
+	tasks   []api.CountTask
+	run     *countRun // count in progress, if any
+
+	ctx    context.Context // cancelled when the screen goes away
+	cancel context.CancelFunc
+
+	api      api.Backend
+	catalog  *catalog.Catalog
+	queue    *queue.Queue
+	deviceID string
+	window   fyne.Window
+	session  *session.Manager
+	onBack   func()
+}
+
+// countRun is a task being counted. lines holds one entry per item counted
+// so far, in the order of items.
+type countRun struct {
+	task  api.CountTask
+	items []int
+	stock *api.LocationStock
+	lines []api.CountLine
+}
+
+func NewCountTasksUI(apiClient api.Backend, commitQueue *queue.Queue, deviceID string, onBack func()) *CountTasksUI {
+	t := &CountTasksUI{
+		api:      apiClient,
+		catalog:  catalog.New(apiClient),
+		queue:    commitQueue,
+		deviceID: deviceID,
+		onBack:   onBack,
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	t.ExtendBaseWidget(t)
+	return t
+}
+
+// SetWindow allows main to pass the window reference
+func (t *CountTasksUI) SetWindow(w fyne.Window) {
+	t.window = w
+}
+
+// SetSession sets the operator session that counts are attributed to.
+func (t *CountTasksUI) SetSession(s *session.Manager) {
+	t.session = s
+}
+
+// setTasks shows tasks, leaving out those already counted on this device and
+// waiting to be sent.
+func (t *CountTasksUI) setTasks(tasks []api.CountTask) {
+	t.tasks = t.tasks[:0]
+	for _, task := range tasks {
+		if !t.queue.CountTaskDone(task.ID) {
+			t.tasks = append(t.tasks, task)
+		}
+	}
+	log.Printf("[CountUI] %d open count tasks\n", len(t.tasks))
+	if len(t.tasks) == 0 {
+		t.status.SetText("No count tasks assigned to this device")
+	} else {
+		t.status.SetText(fmt.Sprintf("%d location(s) to count - tap one to start", len(t.tasks)))
+	}
+	t.list.UnselectAll()
+	t.list.Refresh()
+}
+
+// refreshTasks shows the cached tasks and fetches the current ones in the
+// background.
+func (t *CountTasksUI) refreshTasks() {
+	tasks, err := t.api.LocalCountTasks()
+	if err != nil {
+		log.Printf("[CountUI] No cached count tasks: %v\n", err)
+	}
+	t.setTasks(tasks)
+
+	ctx := t.ctx
+	go func() {
+		tasks, err := t.api.FetchCountTasks(ctx, t.deviceID)
+		if err != nil {
+			log.Printf("[CountUI] FetchCountTasks error: %v\n", err)
+			return
+		}
+		fyne.Do(func() {
+			if ctx.Err() != nil || t.run != nil {
+				return
+			}
+			t.setTasks(tasks)
+		})
+	}()
+}
+
+// show replaces the screen's content, keeping the title and Back button.
+func (t *CountTasksUI) show(objects ...fyne.CanvasObject) {
+	t.content.Objects = []fyne.CanvasObject{container.NewVBox(objects...)}
+	t.content.Refresh()
+}
+
+func (t *CountTasksUI) showTasks() {
+	t.run = nil
+	t.content.Objects = []fyne.CanvasObject{container.NewBorder(t.status, nil, nil, nil, t.list)}
+	t.content.Refresh()
+	t.refreshTasks()
+}
+
+func taskTitle(task api.CountTask) string {
+	title := fmt.Sprintf("%s - %s", task.Location, task.Campaign.Name)
+	if !task.Campaign.DueAt.IsZero() {
+		title += ", due " + task.Campaign.DueAt.Local().Format("Jan 2 15:04")
+	}
+	if task.Campaign.Blind {
+		title += " (blind)"
+	}
+	return title
+}
+
+// startTask asks the operator to go to the task's location and scan it.
+func (t *CountTasksUI) startTask(task api.CountTask) {
+	log.Printf("[CountUI] Starting task %d at %s\n", task.ID, task.Location)
+	t.run = &countRun{task: task}
+
+	msg := widget.NewLabel("")
+	scanner := widget.NewEntry()
+	scanner.SetPlaceHolder("Scan location " + task.Location + "...")
+	scanner.OnSubmitted = func(s string) {
+		scanner.SetText("")
+		t.session.Touch()
+		code := strings.TrimSpace(s)
+		if code != task.Location {
+			msg.SetText(fmt.Sprintf("That is %s, not %s", code, task.Location))
+			return
+		}
+		t.beginCount()
+	}
+
+	t.show(
+		widget.NewLabelWithStyle(taskTitle(task), fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
+		widget.NewLabel("Go to "+task.Location+" and scan it to start counting."),
+		scanner,
+		msg,
+	)
+	t.window.Canvas().Focus(scanner)
+}
+
+// beginCount collects the items to count at the location: those assigned to
+// it, those assigned on this device and not yet synced, and any the server
+// has stock of there. The stock is refreshed in the background.
+func (t *CountTasksUI) beginCount() {
+	run := t.run
+	location := run.task.Location
+
+	loc, _ := t.catalog.Location(location)
+	run.items = append(run.items, loc.Items...)
+	for _, id := range t.queue.PendingItems(location) {
+		if !containsInt(run.items, id) {
+			run.items = append(run.items, id)
+		}
+	}
+	stock, err := t.api.LocalStock(location)
+	if err != nil {
+		log.Printf("[CountUI] No cached stock: %v\n", err)
+	}
+	run.stock = stock
+	t.addStockedItems(run)
+
+	ctx := t.ctx
+	go func() {
+		stock, err := t.api.FetchStock(ctx, location)
+		if err != nil {
+			log.Printf("[CountUI] FetchStock error: %v\n", err)
+			return
+		}
+		fyne.Do(func() {
+			if ctx.Err() != nil || t.run != run {
+				return
+			}
+			run.stock = stock
+			t.addStockedItems(run)
+		})
+	}()
+
+	t.next()
+}
+
+func (t *CountTasksUI) addStockedItems(run *countRun) {
+	if run.stock == nil {
+		return
+	}
+	for _, level := range run.stock.Levels {
+		if level.Qty != 0 && !containsInt(run.items, level.ItemID) {
+			run.items = append(run.items, level.ItemID)
+		}
+	}
+}
+
+// expected is the quantity the device expects of an item at the run's
+// location, the same figure COUNT mode on the stock screen uses.
+func (t *CountTasksUI) expected(run *countRun, itemID int) (int, bool) {
+	if run.stock == nil {
+		return 0, false
+	}
+	pending, synced := t.queue.DeltaSince(run.task.Location, itemID, run.stock.FetchedAt)
+	return run.stock.Qty(itemID) + pending + synced, true
+}
+
+// next shows the next item to count, or the summary once all are counted.
+func (t *CountTasksUI) next() {
+	run := t.run
+	if len(run.lines) >= len(run.items) {
+		t.showSummary()
+		return
+	}
+	itemID := run.items[len(run.lines)]
+
+	expectedLabel := widget.NewLabel("")
+	if !run.task.Campaign.Blind {
+		if qty, ok := t.expected(run, itemID); ok {
+			expectedLabel.SetText(fmt.Sprintf("Expected: %d", qty))
+		} else {
+			expectedLabel.SetText("Expected: unknown (offline)")
+		}
+	}
+	msg := widget.NewLabel("")
+
+	countInput := widget.NewEntry()
+	countInput.SetPlaceHolder("Enter counted quantity")
+	submit := func() {
+		t.session.Touch()
+		counted, err := strconv.Atoi(strings.TrimSpace(countInput.Text))
+		if err != nil || counted < 0 {
+			msg.SetText("Enter the quantity counted")
+			return
+		}
+		t.record(itemID, counted, msg)
+	}
+	countInput.OnSubmitted = func(string) { submit() }
+
+	nextBtn := widget.NewButton("Next", submit)
+	nextBtn.Importance = widget.HighImportance
+
+	t.show(
+		widget.NewLabelWithStyle(taskTitle(run.task), fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
+		widget.NewLabel(fmt.Sprintf("Item %d of %d: %s", len(run.lines)+1, len(run.items), t.catalog.ItemName(itemID))),
+		expectedLabel,
+		countInput,
+		nextBtn,
+		msg,
+	)
+	t.window.Canvas().Focus(countInput)
+}
+
+// record adds the count of an item. A variance above the campaign's
+// threshold needs a supervisor; without one the line is held, so the stock
+// is left as it is until the auditors review it.
+func (t *CountTasksUI) record(itemID, counted int, msg *widget.Label) {
+	run := t.run
+	expected, ok := t.expected(run, itemID)
+	if !ok {
+		msg.SetText("On hand unknown - connect to the server before counting")
+		return
+	}
+	line := api.CountLine{ItemID: itemID, Expected: expected, Counted: counted}
+	add := func(line api.CountLine) {
+		if t.run != run {
+			return
+		}
+		run.lines = append(run.lines, line)
+		t.next()
+	}
+
+	variance := counted - expected
+	threshold := run.task.Campaign.VarianceThreshold
+	if variance <= threshold && -variance <= threshold {
+		add(line)
+		return
+	}
+
+	itemName := t.catalog.ItemName(itemID)
+	reason := fmt.Sprintf("Counted %d %s, expected %d (%+d).\nA supervisor must approve the adjustment.", counted, itemName, expected, variance)
+	if run.task.Campaign.Blind {
+		reason = fmt.Sprintf("The count of %s is off by more than %d.\nA supervisor must approve the adjustment.", itemName, threshold)
+	}
+	log.Printf("[CountUI] Variance %+d for item %d exceeds %d\n", variance, itemID, threshold)
+
+	confirm := dialog.NewConfirm("Variance Needs Approval", reason+"\n\nHold it for review instead?", func(hold bool) {
+		if hold {
+			line.Held = true
+			add(line)
+			return
+		}
+		showSupervisorApproval(t.window, t.api, reason, func(sup api.Operator) {
+			line.SupervisorID = sup.ID
+			add(line)
+		})
+	}, t.window)
+	confirm.SetConfirmText("Hold")
+	confirm.SetDismissText("Get Approval")
+	confirm.Show()
+}
+
+// showSummary lists what was counted before the operator finishes the task.
+func (t *CountTasksUI) showSummary() {
+	run := t.run
+	blind := run.task.Campaign.Blind
+
+	summary := widget.NewLabel("")
+	var text []string
+	for _, line := range run.lines {
+		s := fmt.Sprintf("%s: %d", t.catalog.ItemName(line.ItemID), line.Counted)
+		if !blind && line.Counted != line.Expected {
+			s += fmt.Sprintf(" (expected %d, %+d)", line.Expected, line.Counted-line.Expected)
+		}
+		if line.Held {
+			s += " - held for review"
+		}
+		text = append(text, s)
+	}
+	if len(text) == 0 {
+		text = append(text, "No items at this location.")
+	}
+	summary.SetText(strings.Join(text, "\n"))
+
+	finishBtn := widget.NewButton("Finish", t.finish)
+	finishBtn.Importance = widget.HighImportance
+	recountBtn := widget.NewButton("Recount", func() {
+		run.lines = nil
+		t.next()
+	})
+
+	t.show(
+		widget.NewLabelWithStyle(taskTitle(run.task), fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
+		summary,
+		container.NewHBox(finishBtn, recountBtn),
+	)
+}
+
+// finish queues the result that closes the task together with a count
+// commit for each variance that wasn't held.
+func (t *CountTasksUI) finish() {
+	run := t.run
+	op, ok := t.session.Current()
+	if !ok {
+		dialog.ShowInformation("Session Expired", "Sign in again to finish the count.", t.window)
+		return
+	}
+	t.session.Touch()
+
+	var adjustments []queue.Commit
+	for _, line := range run.lines {
+		delta := line.Counted - line.Expected
+		if delta == 0 || line.Held {
+			continue
+		}
+		counted := line.Counted
+		commit := queue.Commit{
+			DeviceID:     t.deviceID,
+			OperatorID:   op.ID,
+			Location:     run.task.Location,
+			Delta:        delta,
+			ItemID:       line.ItemID,
+			Kind:         queue.KindCountAdjustment,
+			CountedQty:   &counted,
+			CountTaskID:  run.task.ID,
+			SupervisorID: line.SupervisorID,
+		}
+		if line.SupervisorID != 0 {
+			commit.Overrides = []string{queue.OverrideCountVarianceApproved}
+		}
+		adjustments = append(adjustments, commit)
+	}
+
+	_, err := t.queue.SubmitCountResult(queue.CountResult{
+		DeviceID:   t.deviceID,
+		OperatorID: op.ID,
+		TaskID:     run.task.ID,
+		Lines:      run.lines,
+	}, adjustments)
+	if err != nil {
+		dialog.ShowError(fmt.Errorf("could not save count: %w", err), t.window)
+		return
+	}
+	log.Printf("[CountUI] Task %d at %s finished\n", run.task.ID, run.task.Location)
+	t.showTasks()
+	t.status.SetText(fmt.Sprintf("Count of %s complete. %s", run.task.Location, t.status.Text))
+}
+
+func (t *CountTasksUI) back() {
+	if t.run == nil {
+		t.onBack()
+		return
+	}
+	dialog.ShowConfirm("Abandon Count", "Stop counting "+t.run.task.Location+"? Nothing counted so far is kept.", func(ok bool) {
+		if ok {
+			t.showTasks()
+		}
+	}, t.window)
+}
+
+func (t *CountTasksUI) CreateRenderer() fyne.WidgetRenderer {
+	t.status = widget.NewLabel("")
+
+	t.list = widget.NewList(
+		func() int {
+			return len(t.tasks)
+		},
+		func() fyne.CanvasObject {
+			return widget.NewLabel("")
+		},
+		func(id widget.ListItemID, obj fyne.CanvasObject) {
+			obj.(*widget.Label).SetText(taskTitle(t.tasks[id]))
+		},
+	)
+	t.list.OnSelected = func(id widget.ListItemID) {
+		if id < len(t.tasks) {
+			t.startTask(t.tasks[id])
+		}
+	}
+
+	backBtn := widget.NewButton("Back", t.back)
+
+	t.content = container.NewStack()
+	t.showTasks()
+
+	top := container.NewVBox(
+		container.NewCenter(widget.NewLabel("Count Tasks")),
+		NewSyncBadge(t.queue),
+	)
+	return &cancelRenderer{
+		WidgetRenderer: widget.NewSimpleRenderer(container.NewBorder(top, backBtn, nil, nil, t.content)),
+		cancel:         t.cancel,
+	}
+}
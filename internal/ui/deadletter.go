@@ -0,0 +1,393 @@
+package ui
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"github.com/larkin1/wmsproject/internal/api"
+	"github.com/larkin1/wmsproject/internal/queue"
+)
+
+// DeadLetterUI lists commits, location assignments and count results the
+// server rejected and lets the operator fix and resubmit or discard them.
+type DeadLetterUI struct {
+	widget.BaseWidget
+
+	list    *widget.List
+	status  *widget.Label
+	letters []queue.DeadLetter
+	api     api.Backend
+	queue   *queue.Queue
+	window  fyne.Window
+	onBack  func()
+
+	ctx    context.Context // cancelled when the screen goes away
+	cancel context.CancelFunc
+}
+
+func NewDeadLetterUI(apiClient api.Backend, commitQueue *queue.Queue, onBack func()) *DeadLetterUI {
+	d := &DeadLetterUI{
+		api:    apiClient,
+		queue:  commitQueue,
+		onBack: onBack,
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	d.ExtendBaseWidget(d)
+	return d
+}
+
+// SetWindow allows main to pass the window reference
+func (d *DeadLetterUI) SetWindow(w fyne.Window) {
+	d.window = w
+}
+
+func (d *DeadLetterUI) refresh() {
+	d.letters = d.queue.DeadLetters()
+	log.Printf("[DeadLetterUI] %d dead letters\n", len(d.letters))
+	if len(d.letters) == 0 {
+		d.status.SetText("No failed commits")
+	} else {
+		d.status.SetText(fmt.Sprintf("%d failed commit(s) - tap one to fix or discard", len(d.letters)))
+	}
+	d.list.UnselectAll()
+	d.list.Refresh()
+}
+
+func (d *DeadLetterUI) showEditDialog(dl queue.DeadLetter) {
+	if dl.Assignment != nil {
+		d.showAssignmentDialog(dl)
+		return
+	}
+	if dl.CountResult != nil {
+		d.showCountResultDialog(dl)
+		return
+	}
+	if dl.Commit.Kind == queue.KindCountAdjustment && dl.Commit.CountedQty != nil {
+		d.showCountDialog(dl)
+		return
+	}
+
+	locationInput := widget.NewEntry()
+	locationInput.SetText(dl.Commit.Location)
+
+	itemInput := widget.NewEntry()
+	itemInput.SetText(strconv.Itoa(dl.Commit.ItemID))
+
+	deltaInput := widget.NewEntry()
+	deltaInput.SetText(strconv.Itoa(dl.Commit.Delta))
+
+	reason := widget.NewLabel(fmt.Sprintf("Rejected (%d): %s", dl.StatusCode, dl.Reason))
+	reason.Wrapping = fyne.TextWrapWord
+
+	form := container.NewVBox(
+		reason,
+		widget.NewLabel(fmt.Sprintf("Captured: %s", dl.Commit.CapturedAt.Local().Format("2006-01-02 15:04"))),
+		widget.NewLabel("Location:"),
+		locationInput,
+		widget.NewLabel("Item ID:"),
+		itemInput,
+		widget.NewLabel("Quantity change (negative to remove):"),
+		deltaInput,
+	)
+	discardMsg := "This commit will never be sent. Discard it?"
+	if dl.Commit.TransferID != "" {
+		form.Add(widget.NewLabel("Part of a transfer - the other leg is resubmitted or discarded with it."))
+		discardMsg = "Neither leg of this transfer will be sent. Discard it?"
+	}
+	if doc := dl.Commit.Document; doc != nil {
+		form.Add(widget.NewLabel(fmt.Sprintf("Line of document %s (%s) - its other lines are resubmitted or discarded with it.", doc.Reference, doc.Reason)))
+		discardMsg = "No line of this document will be sent. Discard it?"
+	}
+
+	var dlg dialog.Dialog
+	resubmitBtn := widget.NewButton("Resubmit", func() {
+		itemID, err := strconv.Atoi(strings.TrimSpace(itemInput.Text))
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("invalid item ID"), d.window)
+			return
+		}
+		delta, err := strconv.Atoi(strings.TrimSpace(deltaInput.Text))
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("invalid quantity"), d.window)
+			return
+		}
+
+		edited := dl.Commit
+		edited.Location = strings.TrimSpace(locationInput.Text)
+		edited.ItemID = itemID
+		edited.Delta = delta
+
+		if err := d.queue.ResubmitDeadLetter(dl.Commit.ID, edited); err != nil {
+			dialog.ShowError(err, d.window)
+			return
+		}
+		dlg.Hide()
+		d.refresh()
+	})
+	resubmitBtn.Importance = widget.HighImportance
+
+	discardBtn := d.discardButton(dl, discardMsg, &dlg)
+
+	content := container.NewVBox(form, container.NewHBox(resubmitBtn, discardBtn))
+	dlg = dialog.NewCustom("Failed Commit", "Close", content, d.window)
+	dlg.SetOnClosed(func() {
+		d.list.UnselectAll()
+	})
+	dlg.Show()
+}
+
+// showCountDialog handles a count the server rejected because its total had
+// moved. The adjustment is worked out again from the counted quantity and the
+// server's current total, fetched when the dialog opens, and shown before it
+// can be resubmitted. The server checks it again like any count.
+func (d *DeadLetterUI) showCountDialog(dl queue.DeadLetter) {
+	orig := dl.Commit
+
+	countedInput := widget.NewEntry()
+	countedInput.SetText(strconv.Itoa(*orig.CountedQty))
+
+	reason := widget.NewLabel(fmt.Sprintf("Rejected (%d): %s", dl.StatusCode, dl.Reason))
+	reason.Wrapping = fyne.TextWrapWord
+	adjustment := widget.NewLabel("Fetching the current stock...")
+	adjustment.Wrapping = fyne.TextWrapWord
+
+	// expected is what the device expects once the commits queued before
+	// the count are in: the server total plus what it doesn't include yet.
+	var expected int
+	var known bool
+	var resubmitBtn *widget.Button
+	update := func() {
+		if !known {
+			return
+		}
+		counted, err := strconv.Atoi(strings.TrimSpace(countedInput.Text))
+		if err != nil || counted < 0 {
+			adjustment.SetText(fmt.Sprintf("Stock expected now: %d. Enter the quantity counted.", expected))
+			resubmitBtn.Disable()
+			return
+		}
+		adjustment.SetText(fmt.Sprintf("Stock expected now: %d, so the adjustment becomes %+d (was %+d).", expected, counted-expected, orig.Delta))
+		resubmitBtn.Enable()
+	}
+	countedInput.OnChanged = func(string) { update() }
+
+	form := container.NewVBox(
+		reason,
+		widget.NewLabel(fmt.Sprintf("Count of item %d at %s, captured %s", orig.ItemID, orig.Location, orig.CapturedAt.Local().Format("2006-01-02 15:04"))),
+		widget.NewLabel("Quantity counted:"),
+		countedInput,
+		adjustment,
+	)
+
+	var dlg dialog.Dialog
+	resubmitBtn = widget.NewButton("Resubmit", func() {
+		counted, err := strconv.Atoi(strings.TrimSpace(countedInput.Text))
+		if err != nil || !known {
+			return
+		}
+		edited := orig
+		edited.CountedQty = &counted
+		edited.Delta = counted - expected
+		log.Printf("[DeadLetterUI] Count %s resubmitted: counted %d, expected %d\n", orig.ID, counted, expected)
+		if err := d.queue.ResubmitDeadLetter(orig.ID, edited); err != nil {
+			dialog.ShowError(err, d.window)
+			return
+		}
+		dlg.Hide()
+		d.refresh()
+	})
+	resubmitBtn.Importance = widget.HighImportance
+	resubmitBtn.Disable()
+
+	discardBtn := d.discardButton(dl, "The count will not be applied. Discard it and count again?", &dlg)
+
+	ctx := d.ctx
+	go func() {
+		stock, err := d.api.FetchStock(ctx, orig.Location)
+		fyne.Do(func() {
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil || stock.Cached {
+				adjustment.SetText("Could not fetch the current stock. Resubmitting needs it - connect and open this count again.")
+				return
+			}
+			pending, synced := d.queue.DeltaSince(orig.Location, orig.ItemID, stock.FetchedAt)
+			expected = stock.Qty(orig.ItemID) + pending + synced
+			known = true
+			update()
+		})
+	}()
+
+	content := container.NewVBox(form, container.NewHBox(resubmitBtn, discardBtn))
+	dlg = dialog.NewCustom("Failed Count", "Close", content, d.window)
+	dlg.SetOnClosed(func() {
+		d.list.UnselectAll()
+	})
+	dlg.Show()
+}
+
+// showAssignmentDialog lets the operator correct the location or item of a
+// rejected assignment and resubmit it, or discard it.
+func (d *DeadLetterUI) showAssignmentDialog(dl queue.DeadLetter) {
+	a := *dl.Assignment
+
+	locationInput := widget.NewEntry()
+	locationInput.SetText(a.Location)
+
+	itemInput := widget.NewEntry()
+	itemInput.SetText(strconv.Itoa(a.ItemID))
+
+	reason := widget.NewLabel(fmt.Sprintf("Rejected (%d): %s", dl.StatusCode, dl.Reason))
+	reason.Wrapping = fyne.TextWrapWord
+
+	form := container.NewVBox(
+		reason,
+		widget.NewLabel(fmt.Sprintf("Assignment captured: %s", a.CapturedAt.Local().Format("2006-01-02 15:04"))),
+		widget.NewLabel("Location:"),
+		locationInput,
+		widget.NewLabel("Item ID:"),
+		itemInput,
+	)
+
+	var dlg dialog.Dialog
+	resubmitBtn := widget.NewButton("Resubmit", func() {
+		itemID, err := strconv.Atoi(strings.TrimSpace(itemInput.Text))
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("invalid item ID"), d.window)
+			return
+		}
+		a.Location = strings.TrimSpace(locationInput.Text)
+		a.ItemID = itemID
+		if err := d.queue.ResubmitAssignment(dl.ID(), a); err != nil {
+			dialog.ShowError(err, d.window)
+			return
+		}
+		dlg.Hide()
+		d.refresh()
+	})
+	resubmitBtn.Importance = widget.HighImportance
+
+	discardBtn := d.discardButton(dl, "The item will not be assigned to the location. Discard it?", &dlg)
+
+	content := container.NewVBox(form, container.NewHBox(resubmitBtn, discardBtn))
+	dlg = dialog.NewCustom("Failed Assignment", "Close", content, d.window)
+	dlg.SetOnClosed(func() {
+		d.list.UnselectAll()
+	})
+	dlg.Show()
+}
+
+// showCountResultDialog shows what a rejected count result recorded. It can
+// only be resubmitted as it was: its adjustments went as commits of their own.
+func (d *DeadLetterUI) showCountResultDialog(dl queue.DeadLetter) {
+	r := dl.CountResult
+
+	reason := widget.NewLabel(fmt.Sprintf("Rejected (%d): %s", dl.StatusCode, dl.Reason))
+	reason.Wrapping = fyne.TextWrapWord
+
+	form := container.NewVBox(
+		reason,
+		widget.NewLabel(fmt.Sprintf("Count task %d, finished %s", r.TaskID, r.CapturedAt.Local().Format("2006-01-02 15:04"))),
+	)
+	for _, line := range r.Lines {
+		s := fmt.Sprintf("Item %d: counted %d, expected %d", line.ItemID, line.Counted, line.Expected)
+		if line.Held {
+			s += " - held for review"
+		}
+		form.Add(widget.NewLabel(s))
+	}
+
+	var dlg dialog.Dialog
+	resubmitBtn := widget.NewButton("Resubmit", func() {
+		if err := d.queue.ResubmitCountResult(dl.ID()); err != nil {
+			dialog.ShowError(err, d.window)
+			return
+		}
+		dlg.Hide()
+		d.refresh()
+	})
+	resubmitBtn.Importance = widget.HighImportance
+
+	discardBtn := d.discardButton(dl, "The task stays open on the server until it is counted again. Discard the result?", &dlg)
+
+	content := container.NewVBox(form, container.NewHBox(resubmitBtn, discardBtn))
+	dlg = dialog.NewCustom("Failed Count Result", "Close", content, d.window)
+	dlg.SetOnClosed(func() {
+		d.list.UnselectAll()
+	})
+	dlg.Show()
+}
+
+// discardButton drops the dead letter once the operator confirms msg, and
+// closes its dialog.
+func (d *DeadLetterUI) discardButton(dl queue.DeadLetter, msg string, dlg *dialog.Dialog) *widget.Button {
+	btn := widget.NewButton("Discard", func() {
+		dialog.ShowConfirm("Discard", msg, func(ok bool) {
+			if !ok {
+				return
+			}
+			if err := d.queue.DiscardDeadLetter(dl.ID()); err != nil {
+				dialog.ShowError(err, d.window)
+				return
+			}
+			(*dlg).Hide()
+			d.refresh()
+		}, d.window)
+	})
+	btn.Importance = widget.DangerImportance
+	return btn
+}
+
+func (d *DeadLetterUI) CreateRenderer() fyne.WidgetRenderer {
+	d.status = widget.NewLabel("")
+
+	d.list = widget.NewList(
+		func() int {
+			return len(d.letters)
+		},
+		func() fyne.CanvasObject {
+			return widget.NewLabel("")
+		},
+		func(id widget.ListItemID, obj fyne.CanvasObject) {
+			dl := d.letters[id]
+			if a := dl.Assignment; a != nil {
+				obj.(*widget.Label).SetText(fmt.Sprintf("%s  item %d  assign - %s", a.Location, a.ItemID, dl.Reason))
+				return
+			}
+			if r := dl.CountResult; r != nil {
+				obj.(*widget.Label).SetText(fmt.Sprintf("count task %d - %s", r.TaskID, dl.Reason))
+				return
+			}
+			obj.(*widget.Label).SetText(fmt.Sprintf("%s  item %d  %+d - %s",
+				dl.Commit.Location, dl.Commit.ItemID, dl.Commit.Delta, dl.Reason))
+		},
+	)
+	d.list.OnSelected = func(id widget.ListItemID) {
+		if id < len(d.letters) {
+			d.showEditDialog(d.letters[id])
+		}
+	}
+
+	backBtn := widget.NewButton("Back", func() {
+		d.onBack()
+	})
+
+	d.refresh()
+
+	top := container.NewVBox(
+		container.NewCenter(widget.NewLabel("Failed Commits")),
+		d.status,
+	)
+	return &cancelRenderer{
+		WidgetRenderer: widget.NewSimpleRenderer(container.NewBorder(top, backBtn, nil, nil, d.list)),
+		cancel:         d.cancel,
+	}
+}
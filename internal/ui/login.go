@@ -0,0 +1,204 @@
+package ui
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+	"github.com/larkin1/wmsproject/internal/api"
+)
+
+// LoginUI asks the operator to pick their name and enter their PIN. PINs are
+// checked by the server; offline, against the verifier the device keeps from
+// the operator's last online sign-in. The operator list is cached so the
+// screen works offline.
+type LoginUI struct {
+	widget.BaseWidget
+
+	operatorSelect *widget.Select
+	pinInput       *widget.Entry
+	signInBtn      *widget.Button
+	errLabel       *widget.RichText
+
+	operators map[string]api.Operator
+	api       api.Backend
+	onSignIn  func(op api.Operator)
+}
+
+func NewLoginUI(apiClient api.Backend, onSignIn func(op api.Operator)) *LoginUI {
+	l := &LoginUI{
+		api:       apiClient,
+		onSignIn:  onSignIn,
+		operators: make(map[string]api.Operator),
+	}
+	l.ExtendBaseWidget(l)
+	return l
+}
+
+// signInTimeout bounds the server's PIN check and sign-in, after which the
+// PIN is checked on the device.
+const signInTimeout = 10 * time.Second
+
+// loadOperators reads the cached operator list; refreshOperators updates it.
+func (l *LoginUI) loadOperators() []string {
+	operators, err := l.api.LocalOperators()
+	if err != nil {
+		log.Printf("[LoginUI] No cached operators: %v\n", err)
+	}
+	return l.setOperators(operators)
+}
+
+func (l *LoginUI) setOperators(operators []api.Operator) []string {
+	l.operators = make(map[string]api.Operator)
+	var names []string
+	for _, op := range operators {
+		l.operators[op.Name] = op
+		names = append(names, op.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// refreshOperators fetches the operator list in the background, so the
+// screen doesn't wait on the network.
+func (l *LoginUI) refreshOperators() {
+	go func() {
+		operators, err := l.api.FetchOperators(context.Background())
+		if err != nil {
+			log.Printf("[LoginUI] FetchOperators error: %v\n", err)
+		}
+		fyne.Do(func() {
+			if err != nil {
+				if len(l.operators) == 0 {
+					l.setError("No operators available - connect to the network and restart")
+				}
+				return
+			}
+			names := l.setOperators(operators)
+			l.operatorSelect.SetOptions(names)
+			if len(names) > 0 {
+				l.setError("")
+			}
+		})
+	}()
+}
+
+func (l *LoginUI) submit() {
+	op, ok := l.operators[l.operatorSelect.Selected]
+	if !ok {
+		l.setError("Select your name")
+		return
+	}
+
+	// Whoever was signed in to the server before must not carry over, even if
+	// this operator signs in offline or has no server account.
+	auth, isAuth := l.api.(api.Authenticator)
+	if isAuth {
+		auth.SignOut()
+	}
+
+	// The PIN check runs in the background; the button stays disabled so it
+	// isn't sent twice.
+	pin := l.pinInput.Text
+	l.signInBtn.Disable()
+	l.setError("Signing in...")
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), signInTimeout)
+		defer cancel()
+		var err error
+		if isAuth {
+			err = auth.SignInOperator(ctx, op, pin)
+		} else {
+			err = l.api.VerifyPIN(ctx, op.ID, pin)
+		}
+
+		fyne.Do(func() {
+			l.signInBtn.Enable()
+			var apiErr *api.APIError
+			switch {
+			case errors.Is(err, api.ErrWrongPIN):
+				log.Printf("[LoginUI] Wrong PIN for %s\n", op.Name)
+				l.pinInput.SetText("")
+				l.setError("Wrong PIN")
+				return
+			case errors.Is(err, api.ErrPINOffline):
+				l.pinInput.SetText("")
+				l.setError("Offline - sign in once on this device while connected first")
+				return
+			case errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode == http.StatusLocked):
+				log.Printf("[LoginUI] PIN checks locked out for %s: %v\n", op.Name, err)
+				l.pinInput.SetText("")
+				l.setError("Too many PIN attempts - wait and try again")
+				return
+			case errors.As(err, &apiErr):
+				log.Printf("[LoginUI] Server rejected sign-in for %s: %v\n", op.Name, err)
+				l.pinInput.SetText("")
+				l.setError("Server rejected sign-in - ask a supervisor to check your account")
+				return
+			case err != nil:
+				// The PIN checked out but the server sign-in didn't go through,
+				// so let them work. Commits queue up and go out under the anon key.
+				log.Printf("[LoginUI] Server sign-in unavailable, continuing offline: %v\n", err)
+			}
+			l.finishSignIn(op)
+		})
+	}()
+}
+
+func (l *LoginUI) finishSignIn(op api.Operator) {
+	l.pinInput.SetText("")
+	l.setError("")
+	l.onSignIn(op)
+}
+
+func (l *LoginUI) setError(msg string) {
+	if msg == "" {
+		l.errLabel.ParseMarkdown("")
+	} else {
+		l.errLabel.ParseMarkdown(fmt.Sprintf("**%s**", msg))
+	}
+}
+
+func (l *LoginUI) CreateRenderer() fyne.WidgetRenderer {
+	names := l.loadOperators()
+
+	l.operatorSelect = widget.NewSelect(names, nil)
+	l.operatorSelect.PlaceHolder = "Select operator..."
+
+	l.pinInput = widget.NewEntry()
+	l.pinInput.SetPlaceHolder("PIN")
+	l.pinInput.Password = true
+	l.pinInput.OnSubmitted = func(string) {
+		l.submit()
+	}
+
+	l.signInBtn = widget.NewButton("Sign In", func() {
+		l.submit()
+	})
+	l.signInBtn.Importance = widget.HighImportance
+
+	l.errLabel = widget.NewRichTextFromMarkdown("")
+	if len(names) == 0 {
+		l.setError("Loading operators...")
+	}
+
+	vbox := container.NewVBox(
+		container.NewCenter(widget.NewLabel("Warehouse Management System")),
+		container.NewCenter(widget.NewLabel("Sign In")),
+		l.operatorSelect,
+		l.pinInput,
+		l.signInBtn,
+		l.errLabel,
+	)
+
+	l.refreshOperators()
+
+	return widget.NewSimpleRenderer(container.NewCenter(vbox))
+}
@@ -0,0 +1,416 @@
+package ui
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"github.com/larkin1/wmsproject/internal/api"
+	"github.com/larkin1/wmsproject/internal/catalog"
+	"github.com/larkin1/wmsproject/internal/queue"
+	"github.com/larkin1/wmsproject/internal/session"
+)
+
+// ReceiveUI receives inbound goods against an expected receipt: scan the
+// purchase order or ASN, then for each line scan the location and the item
+// and enter the quantity. Each line is queued as an ADD commit tagged with
+// the receipt's reference, and the screen keeps received against expected.
+type ReceiveUI struct {
+	widget.BaseWidget
+
+	content  *fyne.Container // the receipt list, or the receipt being received
+	list     *widget.List
+	status   *widget.Label
+	receipts []api.ExpectedReceipt
+	run      *receiveRun // receipt being received, if any
+
+	// The receipt view, rebuilt for each run.
+	lines     *widget.List
+	selection *widget.Label
+	qtyInput  *widget.Entry
+	msg       *widget.Label
+
+	ctx    context.Context // cancelled when the screen goes away
+	cancel context.CancelFunc
+
+	api      api.Backend
+	catalog  *catalog.Catalog
+	queue    *queue.Queue
+	deviceID string
+	window   fyne.Window
+	session  *session.Manager
+	onBack   func()
+}
+
+// receiveRun is a receipt being received. received holds the quantity of
+// each item received so far: the server's figure when the receipt was
+// opened, plus what was still queued then, plus what was received since.
+type receiveRun struct {
+	receipt  api.ExpectedReceipt
+	received map[int]int
+	location string
+	itemID   int
+}
+
+func NewReceiveUI(apiClient api.Backend, commitQueue *queue.Queue, deviceID string, onBack func()) *ReceiveUI {
+	r := &ReceiveUI{
+		api:      apiClient,
+		catalog:  catalog.New(apiClient),
+		queue:    commitQueue,
+		deviceID: deviceID,
+		onBack:   onBack,
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.ExtendBaseWidget(r)
+	return r
+}
+
+// SetWindow allows main to pass the window reference
+func (r *ReceiveUI) SetWindow(w fyne.Window) {
+	r.window = w
+}
+
+// SetSession sets the operator session that receipts are attributed to.
+func (r *ReceiveUI) SetSession(s *session.Manager) {
+	r.session = s
+}
+
+func (r *ReceiveUI) setReceipts(receipts []api.ExpectedReceipt) {
+	r.receipts = receipts
+	log.Printf("[ReceiveUI] %d open receipts\n", len(r.receipts))
+	if len(r.receipts) == 0 {
+		r.status.SetText("No receipts expected")
+	} else {
+		r.status.SetText(fmt.Sprintf("%d receipt(s) expected - scan the PO or ASN, or tap one", len(r.receipts)))
+	}
+	r.list.UnselectAll()
+	r.list.Refresh()
+}
+
+// refreshReceipts shows the cached receipts and fetches the current ones in
+// the background.
+func (r *ReceiveUI) refreshReceipts() {
+	receipts, err := r.api.LocalReceipts()
+	if err != nil {
+		log.Printf("[ReceiveUI] No cached receipts: %v\n", err)
+	}
+	r.setReceipts(receipts)
+
+	ctx := r.ctx
+	go func() {
+		receipts, err := r.api.FetchReceipts(ctx)
+		if err != nil {
+			log.Printf("[ReceiveUI] FetchReceipts error: %v\n", err)
+			return
+		}
+		fyne.Do(func() {
+			if ctx.Err() != nil || r.run != nil {
+				return
+			}
+			r.setReceipts(receipts)
+		})
+	}()
+}
+
+func (r *ReceiveUI) showReceipts() {
+	r.run = nil
+
+	scanner := widget.NewEntry()
+	scanner.SetPlaceHolder("Scan PO or ASN number...")
+	scanner.OnSubmitted = func(s string) {
+		scanner.SetText("")
+		r.session.Touch()
+		code := strings.TrimSpace(s)
+		receipt, ok := api.FindReceipt(r.receipts, code)
+		if !ok {
+			r.status.SetText(fmt.Sprintf("No open receipt %s", code))
+			return
+		}
+		r.startReceipt(receipt)
+	}
+
+	r.content.Objects = []fyne.CanvasObject{container.NewBorder(container.NewVBox(r.status, scanner), nil, nil, nil, r.list)}
+	r.content.Refresh()
+	r.refreshReceipts()
+}
+
+func receiptTitle(receipt api.ExpectedReceipt) string {
+	title := receipt.Reference
+	if receipt.Supplier != "" {
+		title += " - " + receipt.Supplier
+	}
+	if !receipt.ExpectedAt.IsZero() {
+		title += ", expected " + receipt.ExpectedAt.Local().Format("Jan 2")
+	}
+	return title
+}
+
+// startReceipt opens a receipt for receiving.
+func (r *ReceiveUI) startReceipt(receipt api.ExpectedReceipt) {
+	log.Printf("[ReceiveUI] Receiving %s (%d lines)\n", receipt.Reference, len(receipt.Lines))
+	run := &receiveRun{
+		receipt:  receipt,
+		received: make(map[int]int, len(receipt.Lines)),
+	}
+	for _, line := range receipt.Lines {
+		run.received[line.ItemID] = line.Received + r.queue.ReceivedSince(receipt.Reference, line.ItemID, receipt.FetchedAt)
+	}
+	r.run = run
+
+	r.lines = widget.NewList(
+		func() int {
+			return len(run.receipt.Lines)
+		},
+		func() fyne.CanvasObject {
+			return widget.NewLabel("")
+		},
+		func(id widget.ListItemID, obj fyne.CanvasObject) {
+			obj.(*widget.Label).SetText(r.lineText(run, run.receipt.Lines[id]))
+		},
+	)
+	// Tapping a line picks its item, for labels that won't scan.
+	r.lines.OnSelected = func(id widget.ListItemID) {
+		r.lines.UnselectAll()
+		r.selectItem(run.receipt.Lines[id].ItemID)
+	}
+
+	r.selection = widget.NewLabel("")
+	r.msg = widget.NewLabel("")
+	r.msg.Wrapping = fyne.TextWrapWord
+
+	scanner := widget.NewEntry()
+	scanner.SetPlaceHolder("Scan location or item...")
+	scanner.OnSubmitted = func(s string) {
+		scanner.SetText("")
+		r.session.Touch()
+		r.onScanned(strings.TrimSpace(s))
+	}
+
+	r.qtyInput = widget.NewEntry()
+	r.qtyInput.SetPlaceHolder("Enter quantity received")
+	r.qtyInput.OnSubmitted = func(string) { r.receive() }
+
+	receiveBtn := widget.NewButton("Receive", r.receive)
+	receiveBtn.Importance = widget.HighImportance
+	finishBtn := widget.NewButton("Finish", r.finish)
+
+	top := container.NewVBox(
+		widget.NewLabelWithStyle(receiptTitle(receipt), fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
+		r.selection,
+		scanner,
+		container.NewBorder(nil, nil, nil, receiveBtn, r.qtyInput),
+		r.msg,
+	)
+	r.content.Objects = []fyne.CanvasObject{container.NewBorder(top, finishBtn, nil, nil, r.lines)}
+	r.content.Refresh()
+	r.updateSelection()
+	r.window.Canvas().Focus(scanner)
+}
+
+// lineText shows how much of a line has been received, flagging over
+// receipts.
+func (r *ReceiveUI) lineText(run *receiveRun, line api.ReceiptLine) string {
+	received := run.received[line.ItemID]
+	text := fmt.Sprintf("%s: %d of %d", r.catalog.ItemName(line.ItemID), received, line.Expected)
+	switch diff := received - line.Expected; {
+	case diff < 0:
+		text += fmt.Sprintf(" - %d to come", -diff)
+	case diff > 0:
+		text += fmt.Sprintf(" - OVER by %d", diff)
+	default:
+		text += " - complete"
+	}
+	return text
+}
+
+func (r *ReceiveUI) updateSelection() {
+	run := r.run
+	location := run.location
+	if location == "" {
+		location = "scan one"
+	}
+	item := "scan one"
+	if run.itemID != 0 {
+		item = r.catalog.ItemName(run.itemID)
+	}
+	r.selection.SetText(fmt.Sprintf("Location: %s\nItem: %s", location, item))
+}
+
+// onScanned takes a location code, then an item barcode for each line
+// received into it.
+func (r *ReceiveUI) onScanned(code string) {
+	run := r.run
+	r.msg.SetText("")
+	if _, ok := r.catalog.Location(code); ok || len(r.queue.PendingItems(code)) > 0 {
+		run.location = code
+		run.itemID = 0
+		r.updateSelection()
+		return
+	}
+	item, ok := r.catalog.ItemByBarcode(code)
+	if !ok {
+		r.msg.SetText(fmt.Sprintf("%s is not a location or an item barcode", code))
+		return
+	}
+	r.selectItem(item.ID)
+}
+
+// selectItem picks the item to receive, if it is on the receipt.
+func (r *ReceiveUI) selectItem(itemID int) {
+	run := r.run
+	if run.location == "" {
+		r.msg.SetText("Scan the location first")
+		return
+	}
+	if _, ok := run.receipt.Line(itemID); !ok {
+		r.msg.SetText(fmt.Sprintf("%s is not on %s", r.catalog.ItemName(itemID), run.receipt.Reference))
+		return
+	}
+	run.itemID = itemID
+	r.msg.SetText("")
+	r.updateSelection()
+	r.window.Canvas().Focus(r.qtyInput)
+}
+
+// receive queues the quantity entered for the selected item. Receiving more
+// than the line expects needs the operator to confirm it.
+func (r *ReceiveUI) receive() {
+	run := r.run
+	r.session.Touch()
+	if run.location == "" || run.itemID == 0 {
+		r.msg.SetText("Scan the location and the item first")
+		return
+	}
+	qty, err := strconv.Atoi(strings.TrimSpace(r.qtyInput.Text))
+	if err != nil || qty <= 0 {
+		r.msg.SetText("Enter the quantity received")
+		return
+	}
+
+	line, _ := run.receipt.Line(run.itemID)
+	received := run.received[run.itemID]
+	if received+qty <= line.Expected {
+		r.submitLine(run, qty, nil)
+		return
+	}
+
+	msg := fmt.Sprintf("%s expects %d of %s and %d are already received.\nReceiving %d more is %d over.\n\nReceive anyway?",
+		run.receipt.Reference, line.Expected, r.catalog.ItemName(run.itemID), received, qty, received+qty-line.Expected)
+	log.Printf("[ReceiveUI] Over receipt of item %d on %s: %d of %d\n", run.itemID, run.receipt.Reference, received+qty, line.Expected)
+	dialog.ShowConfirm("Over Receipt", msg, func(ok bool) {
+		if !ok || r.run != run {
+			return
+		}
+		r.submitLine(run, qty, []string{queue.OverrideOverReceiptConfirmed})
+	}, r.window)
+}
+
+func (r *ReceiveUI) submitLine(run *receiveRun, qty int, overrides []string) {
+	op, ok := r.session.Current()
+	if !ok {
+		r.msg.SetText("Session expired - sign in again")
+		return
+	}
+	r.session.Touch()
+
+	log.Printf("[ReceiveUI] Receiving %d of item %d into %s against %s\n", qty, run.itemID, run.location, run.receipt.Reference)
+	_, err := r.queue.SubmitCommit(queue.Commit{
+		DeviceID:   r.deviceID,
+		OperatorID: op.ID,
+		Location:   run.location,
+		Delta:      qty,
+		ItemID:     run.itemID,
+		Overrides:  overrides,
+		ReceiptRef: run.receipt.Reference,
+	})
+	if err != nil {
+		r.msg.SetText(fmt.Sprintf("Could not save receipt: %v", err))
+		return
+	}
+	run.received[run.itemID] += qty
+	r.msg.SetText(fmt.Sprintf("Received %d %s into %s", qty, r.catalog.ItemName(run.itemID), run.location))
+	run.itemID = 0
+	r.qtyInput.SetText("")
+	r.lines.Refresh()
+	r.updateSelection()
+}
+
+// finish lists the lines received short or over, if any, and returns to the
+// receipt list. Everything received is already queued; the office decides
+// whether to close the receipt.
+func (r *ReceiveUI) finish() {
+	run := r.run
+	var flagged []string
+	for _, line := range run.receipt.Lines {
+		received := run.received[line.ItemID]
+		name := r.catalog.ItemName(line.ItemID)
+		switch {
+		case received < line.Expected:
+			flagged = append(flagged, fmt.Sprintf("%s: SHORT by %d (%d of %d)", name, line.Expected-received, received, line.Expected))
+		case received > line.Expected:
+			flagged = append(flagged, fmt.Sprintf("%s: OVER by %d (%d of %d)", name, received-line.Expected, received, line.Expected))
+		}
+	}
+
+	msg := "Every line was received as expected."
+	if len(flagged) > 0 {
+		msg = strings.Join(flagged, "\n") + "\n\nThese are left for the office to resolve."
+	}
+	dialog.ShowConfirm("Finish "+run.receipt.Reference, msg+"\n\nFinish receiving?", func(ok bool) {
+		if !ok || r.run != run {
+			return
+		}
+		log.Printf("[ReceiveUI] Finished %s with %d flagged lines\n", run.receipt.Reference, len(flagged))
+		r.showReceipts()
+	}, r.window)
+}
+
+func (r *ReceiveUI) back() {
+	if r.run == nil {
+		r.onBack()
+		return
+	}
+	// Every line received is already queued, so there is nothing to lose.
+	r.showReceipts()
+}
+
+func (r *ReceiveUI) CreateRenderer() fyne.WidgetRenderer {
+	r.status = widget.NewLabel("")
+
+	r.list = widget.NewList(
+		func() int {
+			return len(r.receipts)
+		},
+		func() fyne.CanvasObject {
+			return widget.NewLabel("")
+		},
+		func(id widget.ListItemID, obj fyne.CanvasObject) {
+			obj.(*widget.Label).SetText(receiptTitle(r.receipts[id]))
+		},
+	)
+	r.list.OnSelected = func(id widget.ListItemID) {
+		if id < len(r.receipts) {
+			r.startReceipt(r.receipts[id])
+		}
+	}
+
+	backBtn := widget.NewButton("Back", r.back)
+
+	r.content = container.NewStack()
+	r.showReceipts()
+
+	top := container.NewVBox(
+		container.NewCenter(widget.NewLabel("Receive")),
+		NewSyncBadge(r.queue),
+	)
+	return &cancelRenderer{
+		WidgetRenderer: widget.NewSimpleRenderer(container.NewBorder(top, backBtn, nil, nil, r.content)),
+		cancel:         r.cancel,
+	}
+}
@@ -1,37 +1,50 @@
 package ui
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/widget"
 	"github.com/larkin1/wmsproject/internal/api"
+	"github.com/larkin1/wmsproject/internal/config"
 )
 
 type SettingsUI struct {
 	widget.BaseWidget
 
-	urlInput   *widget.Entry
-	keyInput   *widget.Entry
-	submitBtn  *widget.Button
-	errLabel   *widget.RichText
-
-	onSubmit func(url, key string)
-	basePath string
+	backendSelect *widget.Select
+	urlInput      *widget.Entry
+	keyInput      *widget.Entry
+	deviceInput   *widget.Entry
+	submitBtn     *widget.Button
+	errLabel      *widget.RichText
+
+	onSubmit   func(backend, url, key, deviceID string)
+	newBackend func(backend, url, key string) api.Backend
+	backend    string
+	deviceID   string
 }
 
-func NewSettingsUI(onSubmit func(url, key string), basePath string) *SettingsUI {
+// NewSettingsUI shows the first-run configuration. newBackend builds a client
+// for the entered credentials so they can be checked before saving.
+func NewSettingsUI(onSubmit func(backend, url, key, deviceID string), newBackend func(backend, url, key string) api.Backend, backend, deviceID string) *SettingsUI {
 	return &SettingsUI{
-		onSubmit: onSubmit,
-		basePath: basePath,
+		onSubmit:   onSubmit,
+		newBackend: newBackend,
+		backend:    backend,
+		deviceID:   deviceID,
 	}
 }
 
-func (s *SettingsUI) checkCredentials(url, key string) bool {
-	client := api.NewClient(url, key, s.basePath)
-	return client.Check()
+// checkTimeout bounds the credentials check on the settings screen.
+const checkTimeout = 15 * time.Second
+
+func (s *SettingsUI) checkCredentials(ctx context.Context, backend, url, key string) bool {
+	return s.newBackend(backend, url, key).Check(ctx)
 }
 
 func (s *SettingsUI) submit() {
@@ -50,13 +63,24 @@ func (s *SettingsUI) submit() {
 
 	s.setError("Checking credentials...")
 
-	if !s.checkCredentials(url, key) {
-		s.setError("Invalid credentials or cannot connect")
-		return
-	}
-
-	s.setError("")
-	s.onSubmit(url, key)
+	backend := s.backendSelect.Selected
+	deviceID := strings.TrimSpace(s.deviceInput.Text)
+	s.submitBtn.Disable()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+		defer cancel()
+		ok := s.checkCredentials(ctx, backend, url, key)
+
+		fyne.Do(func() {
+			s.submitBtn.Enable()
+			if !ok {
+				s.setError("Invalid credentials or cannot connect")
+				return
+			}
+			s.setError("")
+			s.onSubmit(backend, url, key, deviceID)
+		})
+	}()
 }
 
 func (s *SettingsUI) setError(msg string) {
@@ -68,6 +92,9 @@ func (s *SettingsUI) setError(msg string) {
 }
 
 func (s *SettingsUI) CreateRenderer() fyne.WidgetRenderer {
+	s.backendSelect = widget.NewSelect([]string{config.BackendSupabase, config.BackendREST}, nil)
+	s.backendSelect.SetSelected(s.backend)
+
 	s.urlInput = widget.NewEntry()
 	s.urlInput.SetPlaceHolder("API Base URL (e.g., https://your-api.example.com)")
 	s.urlInput.OnSubmitted = func(text string) {
@@ -81,6 +108,10 @@ func (s *SettingsUI) CreateRenderer() fyne.WidgetRenderer {
 		s.submit()
 	}
 
+	s.deviceInput = widget.NewEntry()
+	s.deviceInput.SetPlaceHolder("Device name (blank to generate one)")
+	s.deviceInput.SetText(s.deviceID)
+
 	s.submitBtn = widget.NewButton("Submit", func() {
 		s.submit()
 	})
@@ -97,8 +128,11 @@ func (s *SettingsUI) CreateRenderer() fyne.WidgetRenderer {
 		container.NewCenter(subtitle),
 		widget.NewLabel(""),
 		widget.NewLabel("API Configuration:"),
+		s.backendSelect,
 		s.urlInput,
 		s.keyInput,
+		widget.NewLabel("Device:"),
+		s.deviceInput,
 		s.submitBtn,
 		s.errLabel,
 	)
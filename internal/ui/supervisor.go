@@ -0,0 +1,101 @@
+package ui
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"github.com/larkin1/wmsproject/internal/api"
+)
+
+// showSupervisorApproval asks a supervisor to approve an override with their
+// PIN and calls onApproved with them if they do. The PIN is checked like a
+// sign-in, so approval works offline for supervisors who have signed in on
+// this device before.
+func showSupervisorApproval(w fyne.Window, backend api.Backend, reason string, onApproved func(supervisor api.Operator)) {
+	operators, err := backend.LocalOperators()
+	if err != nil {
+		log.Printf("[Supervisor] No cached operators: %v\n", err)
+	}
+	supervisors := make(map[string]api.Operator)
+	var names []string
+	for _, op := range operators {
+		if op.IsSupervisor() {
+			supervisors[op.Name] = op
+			names = append(names, op.Name)
+		}
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		dialog.ShowInformation("Supervisor Needed", reason+"\n\nNo supervisors are set up on this device.", w)
+		return
+	}
+
+	nameSelect := widget.NewSelect(names, nil)
+	nameSelect.PlaceHolder = "Supervisor..."
+	pinInput := widget.NewPasswordEntry()
+	pinInput.SetPlaceHolder("Supervisor PIN")
+	errLabel := widget.NewLabel("")
+
+	var dlg dialog.Dialog
+	var approveBtn *widget.Button
+	approve := func() {
+		sup, ok := supervisors[nameSelect.Selected]
+		if !ok {
+			errLabel.SetText("Select a supervisor")
+			return
+		}
+		pin := pinInput.Text
+		approveBtn.Disable()
+		errLabel.SetText("Checking PIN...")
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), signInTimeout)
+			defer cancel()
+			err := backend.VerifyPIN(ctx, sup.ID, pin)
+
+			fyne.Do(func() {
+				approveBtn.Enable()
+				var apiErr *api.APIError
+				switch {
+				case errors.Is(err, api.ErrPINOffline):
+					pinInput.SetText("")
+					errLabel.SetText("Offline - this supervisor hasn't signed in on this device")
+					return
+				case errors.As(err, &apiErr):
+					log.Printf("[Supervisor] Server refused PIN check for %s: %v\n", sup.Name, err)
+					pinInput.SetText("")
+					errLabel.SetText("Server refused the PIN check - wait and try again")
+					return
+				case err != nil:
+					log.Printf("[Supervisor] PIN rejected for %s: %v\n", sup.Name, err)
+					pinInput.SetText("")
+					errLabel.SetText("Wrong PIN")
+					return
+				}
+				log.Printf("[Supervisor] Override approved by %s\n", sup.Name)
+				dlg.Hide()
+				onApproved(sup)
+			})
+		}()
+	}
+	pinInput.OnSubmitted = func(string) { approve() }
+
+	approveBtn = widget.NewButton("Approve", approve)
+	approveBtn.Importance = widget.HighImportance
+
+	content := container.NewVBox(
+		widget.NewLabel(reason),
+		nameSelect,
+		pinInput,
+		approveBtn,
+		errLabel,
+	)
+	dlg = dialog.NewCustom("Supervisor Approval", "Cancel", content, w)
+	dlg.Show()
+}
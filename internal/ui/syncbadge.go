@@ -0,0 +1,106 @@
+package ui
+
+import (
+	"fmt"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/widget"
+	"github.com/larkin1/wmsproject/internal/queue"
+)
+
+// SyncBadge shows how many commits are waiting and when the queue last
+// synced. It follows the queue's status updates while it is on screen.
+type SyncBadge struct {
+	widget.BaseWidget
+
+	queue *queue.Queue
+	label *widget.Label
+}
+
+func NewSyncBadge(commitQueue *queue.Queue) *SyncBadge {
+	b := &SyncBadge{
+		queue: commitQueue,
+		label: widget.NewLabel(""),
+	}
+	b.label.TextStyle = fyne.TextStyle{Bold: true}
+	b.ExtendBaseWidget(b)
+	return b
+}
+
+func (b *SyncBadge) update(s queue.Status) {
+	lastSync := "never"
+	if !s.LastSync.IsZero() {
+		lastSync = s.LastSync.Local().Format("15:04:05")
+	}
+
+	var text string
+	switch {
+	case s.Syncing:
+		text = fmt.Sprintf("Syncing %d pending...", s.Pending)
+		b.label.Importance = widget.MediumImportance
+	case s.Pending == 0:
+		text = fmt.Sprintf("All synced - last sync %s", lastSync)
+		b.label.Importance = widget.SuccessImportance
+	case s.LastError != "":
+		text = fmt.Sprintf("%d pending - not synced (%s) - last sync %s", s.Pending, s.LastError, lastSync)
+		b.label.Importance = widget.DangerImportance
+	default:
+		text = fmt.Sprintf("%d pending - last sync %s", s.Pending, lastSync)
+		b.label.Importance = widget.WarningImportance
+	}
+	if s.DeadLetters > 0 {
+		text += fmt.Sprintf(" - %d failed", s.DeadLetters)
+		b.label.Importance = widget.DangerImportance
+	}
+	b.label.SetText(text)
+}
+
+func (b *SyncBadge) CreateRenderer() fyne.WidgetRenderer {
+	r := &syncBadgeRenderer{badge: b}
+	if b.queue == nil {
+		b.label.SetText("Queue not running")
+		return r
+	}
+
+	updates, stop := b.queue.Subscribe()
+	r.stop = stop
+	go func() {
+		for s := range updates {
+			s := s
+			fyne.Do(func() {
+				b.update(s)
+			})
+		}
+	}()
+	return r
+}
+
+// syncBadgeRenderer exists so the queue subscription ends when Fyne discards
+// the badge.
+type syncBadgeRenderer struct {
+	badge *SyncBadge
+	stop  func()
+}
+
+func (r *syncBadgeRenderer) Layout(size fyne.Size) {
+	r.badge.label.Resize(size)
+}
+
+func (r *syncBadgeRenderer) MinSize() fyne.Size {
+	return r.badge.label.MinSize()
+}
+
+func (r *syncBadgeRenderer) Refresh() {
+	r.badge.label.Refresh()
+}
+
+func (r *syncBadgeRenderer) Objects() []fyne.CanvasObject {
+	return []fyne.CanvasObject{r.badge.label}
+}
+
+func (r *syncBadgeRenderer) Destroy() {
+	if r.stop != nil {
+		r.stop()
+		r.stop = nil
+	}
+}
@@ -4,16 +4,21 @@ import (
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/widget"
+	"github.com/larkin1/wmsproject/internal/queue"
 )
 
 type WelcomeScreen struct {
 	widget.BaseWidget
 	onScreenChange func(string)
+	queue          *queue.Queue
+	operatorName   string
 }
 
-func NewWelcomeScreen(onScreenChange func(string)) *WelcomeScreen {
+func NewWelcomeScreen(onScreenChange func(string), commitQueue *queue.Queue, operatorName string) *WelcomeScreen {
 	return &WelcomeScreen{
 		onScreenChange: onScreenChange,
+		queue:          commitQueue,
+		operatorName:   operatorName,
 	}
 }
 
@@ -23,18 +28,42 @@ func (w *WelcomeScreen) CreateRenderer() fyne.WidgetRenderer {
 	})
 	addBtn.Importance = widget.HighImportance
 
+	receiveBtn := widget.NewButton("Receive", func() {
+		w.onScreenChange("receive")
+	})
+
+	countBtn := widget.NewButton("Count Tasks", func() {
+		w.onScreenChange("counttasks")
+	})
+
+	failedBtn := widget.NewButton("Failed Commits", func() {
+		w.onScreenChange("deadletters")
+	})
+
+	signOutBtn := widget.NewButton("Sign Out", func() {
+		w.onScreenChange("logout")
+	})
+
 	exitBtn := widget.NewButton("Exit", func() {
 		fyne.CurrentApp().Quit()
 	})
 
 	title := widget.NewLabel("Warehouse Management System")
 	subtitle := widget.NewLabel("")
+	if w.operatorName != "" {
+		subtitle.SetText("Signed in as " + w.operatorName)
+	}
 
 	vbox := container.NewVBox(
 		container.NewCenter(title),
 		container.NewCenter(subtitle),
 		addBtn,
+		receiveBtn,
+		countBtn,
+		failedBtn,
+		signOutBtn,
 		exitBtn,
+		NewSyncBadge(w.queue),
 	)
 
 	return widget.NewSimpleRenderer(container.NewCenter(vbox))
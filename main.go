@@ -1,28 +1,39 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
 	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
 	"github.com/larkin1/wmsproject/internal/api"
+	"github.com/larkin1/wmsproject/internal/config"
 	"github.com/larkin1/wmsproject/internal/queue"
+	"github.com/larkin1/wmsproject/internal/securefile"
+	"github.com/larkin1/wmsproject/internal/session"
+	"github.com/larkin1/wmsproject/internal/storage"
 	"github.com/larkin1/wmsproject/internal/ui"
 )
 
 var (
-	basePath     string
-	settingsPath string
-	appAPI       *api.Client
-	commitQueue  *queue.Queue
-	mainWindow   fyne.Window
-	fyneApp      fyne.App
+	basePath    string
+	appSettings *config.Settings
+	appDB       *storage.DB
+	appAPI      api.Backend
+	commitQueue *queue.Queue
+	appSession  *session.Manager
+	mainWindow  fyne.Window
+	fyneApp     fyne.App
 )
 
+// idleTimeout signs the operator out after this long without activity.
+const idleTimeout = 15 * time.Minute
+
 func init() {
 	// This will be overridden in main() with proper Fyne storage
 	if exe, err := os.Executable(); err == nil {
@@ -30,7 +41,6 @@ func init() {
 	} else {
 		basePath, _ = os.Getwd()
 	}
-	settingsPath = filepath.Join(basePath, "settings.json")
 }
 
 func getStoragePath() string {
@@ -48,62 +58,124 @@ func getStoragePath() string {
 }
 
 func loadSettings() (bool, error) {
-	// Update paths using Fyne storage
-	basePath = getStoragePath()
-	settingsPath = filepath.Join(basePath, "settings.json")
-
-	log.Printf("[Main] Loading settings from: %s\n", settingsPath)
+	log.Println("[Main] Loading settings")
 
-	if _, err := os.Stat(settingsPath); os.IsNotExist(err) {
-		log.Println("[Main] Settings file not found, creating empty")
-		// Create empty settings
-		emptySettings := map[string]string{
-			"api_url": "",
-			"api_key": "",
-		}
-		data, _ := json.MarshalIndent(emptySettings, "", "  ")
-		err := os.WriteFile(settingsPath, data, 0644)
+	settings, err := config.Load(appDB)
+	if errors.Is(err, config.ErrNotConfigured) {
+		log.Println("[Main] No settings stored, creating default")
+		appSettings, err = config.CreateDefault(appDB)
 		if err != nil {
 			log.Printf("[Main] Failed to write settings: %v\n", err)
 		}
 		return false, nil
 	}
-
-	data, err := os.ReadFile(settingsPath)
 	if err != nil {
 		log.Printf("[Main] Failed to read settings: %v\n", err)
 		return false, err
 	}
+	appSettings = settings
 
-	var settings map[string]string
-	err = json.Unmarshal(data, &settings)
-	if err != nil {
-		log.Printf("[Main] Failed to parse settings: %v\n", err)
-		return false, err
+	if settings.EnsureDeviceID() {
+		log.Printf("[Main] Generated device ID %s\n", settings.DeviceID)
+		if err := config.Save(appDB, settings); err != nil {
+			log.Printf("[Main] Failed to save settings: %v\n", err)
+		}
 	}
 
-	log.Printf("[Main] Settings loaded: api_url=%s\n", settings["api_url"])
+	log.Printf("[Main] Settings loaded: backend=%s api_url=%s device_id=%s\n", settings.Backend, settings.APIURL, settings.DeviceID)
 
-	if settings["api_url"] == "" || settings["api_key"] == "" {
+	if settings.APIURL == "" || settings.APIKey == "" {
 		log.Println("[Main] Settings incomplete")
 		return false, nil
 	}
 
-	appAPI = api.NewClient(settings["api_url"], settings["api_key"], basePath)
-	commitQueue = queue.NewQueue(appAPI, basePath)
-	commitQueue.Start()
+	appAPI = settings.NewBackend(settings.APIURL, settings.APIKey, appDB)
+	if err := startQueue(); err != nil {
+		return false, err
+	}
 
 	log.Println("[Main] API client and queue initialized")
 	return true, nil
 }
 
+func startQueue() error {
+	q, err := queue.NewQueue(appAPI, appDB, appSettings.DeviceID)
+	if err != nil {
+		log.Printf("[Main] Failed to open commit queue: %v\n", err)
+		return err
+	}
+	commitQueue = q
+	commitQueue.Start()
+	return nil
+}
+
+func startSession() {
+	if appSession != nil {
+		return
+	}
+	appSession = session.NewManager(idleTimeout, func() {
+		signOutAPI()
+		fyne.Do(func() {
+			switchScreen("login")
+		})
+	})
+	appSession.Start()
+}
+
+// signOutAPI ends the operator's server session, if the backend has one.
+func signOutAPI() {
+	if auth, ok := appAPI.(api.Authenticator); ok {
+		auth.SignOut()
+	}
+}
+
 func switchScreen(screenName string) {
 	log.Printf("[Main] Switching to screen: %s\n", screenName)
+
+	if screenName == "logout" {
+		appSession.SignOut()
+		signOutAPI()
+		screenName = "login"
+	}
+	if _, ok := appSession.Current(); !ok {
+		screenName = "login"
+	}
+	appSession.Touch()
+
 	switch screenName {
+	case "login":
+		loginUI := ui.NewLoginUI(appAPI, func(op api.Operator) {
+			appSession.SignIn(op)
+			switchScreen("welcome")
+		})
+		mainWindow.SetContent(loginUI)
 	case "commit":
-		commitUI := ui.NewCommitUI(appAPI, commitQueue, basePath)
+		commitUI := ui.NewCommitUI(appAPI, commitQueue, appSettings.DeviceID)
 		commitUI.SetWindow(mainWindow)
+		commitUI.SetStockPolicy(config.ParseNegativeStockPolicy(string(appSettings.NegativeStockPolicy)))
+		commitUI.SetItemScanConfirm(appSettings.ConfirmItemScan)
+		commitUI.SetSession(appSession)
 		mainWindow.SetContent(commitUI)
+	case "counttasks":
+		countUI := ui.NewCountTasksUI(appAPI, commitQueue, appSettings.DeviceID, func() {
+			switchScreen("welcome")
+		})
+		countUI.SetWindow(mainWindow)
+		countUI.SetSession(appSession)
+		mainWindow.SetContent(countUI)
+	case "receive":
+		receiveUI := ui.NewReceiveUI(appAPI, commitQueue, appSettings.DeviceID, func() {
+			switchScreen("welcome")
+		})
+		receiveUI.SetWindow(mainWindow)
+		receiveUI.SetSession(appSession)
+		mainWindow.SetContent(receiveUI)
+	case "deadletters":
+		deadLetterUI := ui.NewDeadLetterUI(appAPI, commitQueue, func() {
+			switchScreen("welcome")
+		})
+		deadLetterUI.SetWindow(mainWindow)
+		mainWindow.SetContent(deadLetterUI)
 	case "welcome":
 		mainWindow.SetContent(makeApp())
 	default:
@@ -125,50 +197,105 @@ func main() {
 	log.Printf("[Main] Base path: %s\n", basePath)
 
 	// Ensure directory exists
-	os.MkdirAll(basePath, 0755)
+	os.MkdirAll(basePath, 0700)
+
+	// Credentials and the commit queue are encrypted with a key derived from
+	// the device secret and, if set, the admin passphrase.
+	files, err := securefile.Open(filepath.Join(basePath, "device.key"), os.Getenv("WMS_ADMIN_PASSPHRASE"))
+	if err != nil {
+		log.Fatalf("[Main] Cannot open encrypted storage: %v\n", err)
+	}
+
+	// Everything else the app keeps lives in one database next to the key.
+	db, err := storage.Open(filepath.Join(basePath, "wms.db"), files)
+	if err != nil {
+		log.Fatalf("[Main] Cannot open local database: %v\n", err)
+	}
+	appDB = db
+
+	startSession()
 
-	hasSettings, _ := loadSettings()
+	hasSettings, err := loadSettings()
+	if err != nil && commitQueue == nil && appAPI != nil {
+		// Settings are fine but the queue could not be opened. Running
+		// without it would silently drop commits.
+		log.Fatalf("[Main] Cannot start without the commit queue: %v\n", err)
+	}
 
 	if !hasSettings {
 		log.Println("[Main] No settings found, showing settings screen")
 		// Show settings screen
-		settingsUI := ui.NewSettingsUI(func(apiURL, apiKey string) {
-			log.Printf("[Main] Settings saved: %s\n", apiURL)
-			appAPI = api.NewClient(apiURL, apiKey, basePath)
-			commitQueue = queue.NewQueue(appAPI, basePath)
-			commitQueue.Start()
-
-			// Save settings
-			settings := map[string]string{
-				"api_url": apiURL,
-				"api_key": apiKey,
+		settingsUI := ui.NewSettingsUI(func(backend, apiURL, apiKey, deviceID string) {
+			log.Printf("[Main] Settings saved: %s %s\n", backend, apiURL)
+			if appSettings == nil {
+				appSettings = &config.Settings{}
+			}
+			appSettings.Backend = backend
+			appSettings.APIURL = apiURL
+			appSettings.APIKey = apiKey
+			appSettings.DeviceID = deviceID
+			appSettings.EnsureDeviceID()
+
+			appAPI = appSettings.NewBackend(apiURL, apiKey, appDB)
+			if err := startQueue(); err != nil {
+				dialog.ShowError(err, w)
+				return
 			}
-			data, _ := json.MarshalIndent(settings, "", "  ")
-			err := os.WriteFile(settingsPath, data, 0644)
-			if err != nil {
+
+			if err := config.Save(appDB, appSettings); err != nil {
 				log.Printf("[Main] Failed to save settings: %v\n", err)
 			}
 
-			// Show welcome screen
-			w.SetContent(makeApp())
-		}, basePath)
+			switchScreen("login")
+		}, newBackend, currentBackend(), currentDeviceID())
 
 		w.SetContent(settingsUI)
 	} else {
-		log.Println("[Main] Settings found, showing welcome screen")
-		w.SetContent(makeApp())
+		log.Println("[Main] Settings found, showing sign-in screen")
+		switchScreen("login")
 	}
 
 	w.ShowAndRun()
 
+	appSession.Stop()
+
 	if commitQueue != nil {
 		log.Println("[Main] Stopping queue")
 		commitQueue.Stop()
 	}
+	appDB.Close()
+}
+
+// newBackend builds a client to check credentials entered on the settings
+// screen, keeping any REST layout already in the settings.
+func newBackend(backend, url, key string) api.Backend {
+	s := config.Settings{Backend: backend}
+	if appSettings != nil {
+		s.REST = appSettings.REST
+	}
+	return s.NewBackend(url, key, appDB)
+}
+
+func currentBackend() string {
+	if appSettings == nil || appSettings.Backend == "" {
+		return config.BackendSupabase
+	}
+	return appSettings.Backend
+}
+
+func currentDeviceID() string {
+	if appSettings == nil {
+		return ""
+	}
+	return appSettings.DeviceID
 }
 
 func makeApp() fyne.CanvasObject {
+	operatorName := ""
+	if op, ok := appSession.Current(); ok {
+		operatorName = op.Name
+	}
 	return container.NewVBox(
-		ui.NewWelcomeScreen(switchScreen),
+		ui.NewWelcomeScreen(switchScreen, commitQueue, operatorName),
 	)
 }